@@ -0,0 +1,134 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+const NUMSHARDS = 16
+
+/*
+- Identifies a cached block: Namespace tells apart users sharing a cache (e.g. DBs in the same process), File + Offset the block within them
+- Namespaces are handed out by NewNamespace
+*/
+type Key struct {
+	Namespace, File, Offset uint64
+}
+
+/*
+- Size-bounded LRU cache of byte slices, safe for concurrent use
+- Entries are spread over NUMSHARDS shards by key, each with its own lock + LRU list, so that concurrent readers rarely contend
+- Capacity is in bytes, each shard holds up to an equal share of it
+- Cached values are shared with every caller, they must not be modified
+*/
+type Cache struct {
+	shards        [NUMSHARDS]shard
+	nextNamespace atomic.Uint64
+	hits, misses  atomic.Uint64
+}
+
+type shard struct {
+	mu       sync.Mutex
+	capacity int
+	usage    int
+	entries  map[Key]*list.Element
+	lru      *list.List /* Most recently used at the front */
+}
+
+type entry struct {
+	key   Key
+	value []byte
+}
+
+func NewLRUCache(capacity int) *Cache {
+	c := &Cache{}
+	shardCapacity := (capacity + NUMSHARDS - 1) / NUMSHARDS
+	for i := range c.shards {
+		c.shards[i] = shard{capacity: shardCapacity, entries: map[Key]*list.Element{}, lru: list.New()}
+	}
+	return c
+}
+
+func (c *Cache) shard(key Key) *shard {
+	h := key.Namespace*0x9E3779B97F4A7C15 ^ key.File*0xC2B2AE3D27D4EB4F ^ key.Offset*0x165667B19E3779F9
+	return &c.shards[(h>>32)%NUMSHARDS]
+}
+
+/* Returns a namespace which no other user of the cache has, so that their keys never collide */
+func (c *Cache) NewNamespace() uint64 {
+	return c.nextNamespace.Add(1)
+}
+
+func (c *Cache) Get(key Key) (value []byte, ok bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	s.lru.MoveToFront(elem)
+	return elem.Value.(*entry).value, true
+}
+
+/* Inserts/replaces the value for key, evicting least recently used entries as needed - a value larger than a shard is not cached */
+func (c *Cache) Insert(key Key, value []byte) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(value) > s.capacity {
+		return
+	}
+	if elem, ok := s.entries[key]; ok {
+		s.remove(elem)
+	}
+	s.entries[key] = s.lru.PushFront(&entry{key: key, value: value})
+	s.usage += len(value)
+	for s.usage > s.capacity {
+		s.remove(s.lru.Back())
+	}
+}
+
+func (c *Cache) Erase(key Key) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[key]; ok {
+		s.remove(elem)
+	}
+}
+
+/* Must be called with mu held */
+func (s *shard) remove(elem *list.Element) {
+	e := s.lru.Remove(elem).(*entry)
+	delete(s.entries, e.key)
+	s.usage -= len(e.value)
+}
+
+/* Total size of the cached values in bytes */
+func (c *Cache) Size() int {
+	size := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		size += s.usage
+		s.mu.Unlock()
+	}
+	return size
+}
+
+/* Number of lookups which found their key */
+func (c *Cache) Hits() uint64 {
+	return c.hits.Load()
+}
+
+/* Number of lookups which did not find their key */
+func (c *Cache) Misses() uint64 {
+	return c.misses.Load()
+}
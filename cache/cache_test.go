@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRUCache(t *testing.T) {
+	/* A single block of 10 bytes fits per shard */
+	c := NewLRUCache(10 * NUMSHARDS)
+	namespace := c.NewNamespace()
+	key := func(i int) Key { return Key{Namespace: namespace, File: 1, Offset: uint64(i)} }
+	val := func(i int) []byte { return []byte(fmt.Sprintf("value%05d", i)) }
+
+	_, ok := c.Get(key(0))
+	require.False(t, ok)
+	c.Insert(key(0), val(0))
+	v, ok := c.Get(key(0))
+	require.True(t, ok)
+	require.Equal(t, val(0), v)
+	require.Equal(t, uint64(1), c.Hits())
+	require.Equal(t, uint64(1), c.Misses())
+
+	/* Keys from another namespace don't collide */
+	other := key(0)
+	other.Namespace = c.NewNamespace()
+	_, ok = c.Get(other)
+	require.False(t, ok)
+
+	/* Filling the cache evicts older entries, it never grows beyond its capacity */
+	for i := 1; i < 10*NUMSHARDS; i++ {
+		c.Insert(key(i), val(i))
+		require.LessOrEqual(t, c.Size(), 10*NUMSHARDS)
+	}
+	found := 0
+	for i := 0; i < 10*NUMSHARDS; i++ {
+		if v, ok := c.Get(key(i)); ok {
+			require.Equal(t, val(i), v)
+			found++
+		}
+	}
+	require.Less(t, found, 10*NUMSHARDS)
+	require.Equal(t, found*10, c.Size())
+
+	/* Values that don't fit in a shard are not cached */
+	c.Insert(key(-1), make([]byte, 11))
+	_, ok = c.Get(key(-1))
+	require.False(t, ok)
+
+	c.Erase(key(10*NUMSHARDS - 1))
+	_, ok = c.Get(key(10*NUMSHARDS - 1))
+	require.False(t, ok)
+}
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewLRUCache(30 * NUMSHARDS)
+	/* Pick keys which land in the same shard so that they compete for its 30 bytes */
+	keys := []Key{}
+	for i := 0; len(keys) < 4; i++ {
+		k := Key{Offset: uint64(i)}
+		if c.shard(k) == c.shard(Key{}) {
+			keys = append(keys, k)
+		}
+	}
+
+	for _, k := range keys[:3] {
+		c.Insert(k, make([]byte, 10))
+	}
+	/* Touch the oldest key, so the second one is evicted to make room for the fourth */
+	_, ok := c.Get(keys[0])
+	require.True(t, ok)
+	c.Insert(keys[3], make([]byte, 10))
+
+	for i, want := range []bool{true, false, true, true} {
+		_, ok := c.Get(keys[i])
+		require.Equal(t, want, ok, "key %d", i)
+	}
+}
+
+func TestLRUCacheConcurrent(t *testing.T) {
+	c := NewLRUCache(1024)
+	wg := sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				k := Key{Namespace: uint64(g), Offset: uint64(i % 50)}
+				if _, ok := c.Get(k); !ok {
+					c.Insert(k, make([]byte, 8))
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	require.LessOrEqual(t, c.Size(), 1024)
+	require.Equal(t, uint64(8000), c.Hits()+c.Misses())
+}
@@ -0,0 +1,17 @@
+package common
+
+import "hash/crc32"
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+/*
+- CRC32C of the concatenation of data, used to checksum SSTable blocks + log fragments
+- The CRC is masked the same way LevelDB does, so that the checksum of data which itself holds checksums is not weakened
+*/
+func MaskedCRC(data ...[]byte) uint32 {
+	crc := uint32(0)
+	for _, b := range data {
+		crc = crc32.Update(crc, crcTable, b)
+	}
+	return (crc>>15 | crc<<17) + 0xa282ead8
+}
@@ -0,0 +1,117 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+/*
+- A comparator defines the order of keys, every component ordering keys (memdb, SSTables, iterators, compaction) uses the one given to the DB
+- The name is persisted with the DB, a DB can only be reopened with a comparator of the same name - so the name must change whenever the ordering does
+- FindShortestSeparator + FindShortSuccessor are used to shorten the keys of SSTable index blocks, returning the key passed in is always correct
+*/
+type Comparator interface {
+	Compare(a, b []byte) int
+	Name() string
+	FindShortestSeparator(start, limit []byte) []byte /* A key k with start <= k < limit, assuming start < limit */
+	FindShortSuccessor(key []byte) []byte             /* A key k with key <= k */
+}
+
+/* Orders keys lexicographically by their bytes i.e. bytes.Compare */
+var BytewiseComparator Comparator = bytewiseComparator{}
+
+type bytewiseComparator struct{}
+
+func (bytewiseComparator) Compare(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+func (bytewiseComparator) Name() string {
+	return "leveldb.BytewiseComparator"
+}
+
+/* Keeps the common prefix of start + limit and increments the first byte where they differ, if that still sorts before limit */
+func (bytewiseComparator) FindShortestSeparator(start, limit []byte) []byte {
+	n := 0
+	for n < len(start) && n < len(limit) && start[n] == limit[n] {
+		n++
+	}
+	/* One is a prefix of the other, start can't be shortened */
+	if n >= len(start) || n >= len(limit) {
+		return start
+	}
+
+	if diff := start[n]; diff < 0xff && diff+1 < limit[n] {
+		separator := append([]byte{}, start[:n+1]...)
+		separator[n]++
+		return separator
+	}
+	return start
+}
+
+/* Increments the first byte which isn't 0xff and drops everything after it */
+func (bytewiseComparator) FindShortSuccessor(key []byte) []byte {
+	for i, b := range key {
+		if b != 0xff {
+			successor := append([]byte{}, key[:i+1]...)
+			successor[i]++
+			return successor
+		}
+	}
+	return key
+}
+
+/*
+- Orders internal keys by user key using the user comparator, then by trailer descending so the newest version of a key comes first
+- Separators are found on the user keys, a shortened user key gets the largest possible trailer so it sorts before every version of itself
+*/
+type InternalKeyComparator struct {
+	user Comparator
+}
+
+func NewInternalKeyComparator(user Comparator) *InternalKeyComparator {
+	return &InternalKeyComparator{user: user}
+}
+
+func (icmp *InternalKeyComparator) UserComparator() Comparator {
+	return icmp.user
+}
+
+func (icmp *InternalKeyComparator) Compare(a, b []byte) int {
+	if c := icmp.user.Compare(ExtractUserKey(a), ExtractUserKey(b)); c != 0 {
+		return c
+	}
+
+	/* Larger trailer i.e. newer sequence number first */
+	trailerA := binary.BigEndian.Uint64(a[len(a)-INTERNALKEYTRAILERLEN:])
+	trailerB := binary.BigEndian.Uint64(b[len(b)-INTERNALKEYTRAILERLEN:])
+	switch {
+	case trailerA > trailerB:
+		return -1
+	case trailerA < trailerB:
+		return 1
+	}
+	return 0
+}
+
+func (icmp *InternalKeyComparator) Name() string {
+	return "leveldb.InternalKeyComparator"
+}
+
+func (icmp *InternalKeyComparator) FindShortestSeparator(start, limit []byte) []byte {
+	userStart, userLimit := ExtractUserKey(start), ExtractUserKey(limit)
+	separator := icmp.user.FindShortestSeparator(userStart, userLimit)
+	if len(separator) < len(userStart) && icmp.user.Compare(userStart, separator) < 0 {
+		return MakeInternalKey(separator, MaxSequenceNumber, ValueTypeForSeek)
+	}
+	return start
+}
+
+func (icmp *InternalKeyComparator) FindShortSuccessor(key []byte) []byte {
+	userKey := ExtractUserKey(key)
+	successor := icmp.user.FindShortSuccessor(userKey)
+	if len(successor) < len(userKey) && icmp.user.Compare(userKey, successor) < 0 {
+		return MakeInternalKey(successor, MaxSequenceNumber, ValueTypeForSeek)
+	}
+	return key
+}
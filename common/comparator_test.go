@@ -0,0 +1,57 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBytewiseComparator(t *testing.T) {
+	tcs := []struct {
+		name         string
+		start, limit string
+		want         string
+	}{
+		{name: "shortened at the first differing byte", start: "abcdef", limit: "abzz", want: "abd"},
+		{name: "differing bytes are adjacent", start: "abcdef", limit: "abdz", want: "abcdef"},
+		{name: "start is a prefix of limit", start: "abc", limit: "abcdef", want: "abc"},
+		{name: "byte can't be incremented", start: "a\xffc", limit: "b", want: "a\xffc"},
+	}
+	for _, tc := range tcs {
+		got := BytewiseComparator.FindShortestSeparator([]byte(tc.start), []byte(tc.limit))
+		require.Equal(t, []byte(tc.want), got, tc.name)
+	}
+
+	require.Equal(t, []byte("b"), BytewiseComparator.FindShortSuccessor([]byte("abc")))
+	require.Equal(t, []byte("\xff\x01"), BytewiseComparator.FindShortSuccessor([]byte("\xff\x00\x05")))
+	require.Equal(t, []byte("\xff\xff"), BytewiseComparator.FindShortSuccessor([]byte("\xff\xff")))
+}
+
+func TestInternalKeyComparator(t *testing.T) {
+	icmp := NewInternalKeyComparator(BytewiseComparator)
+
+	/* User key ascending, then newest first */
+	keys := [][]byte{
+		MakeInternalKey([]byte("a"), 5, TypeValue),
+		MakeInternalKey([]byte("a"), 5, TypeDeletion),
+		MakeInternalKey([]byte("a"), 2, TypeValue),
+		MakeInternalKey([]byte("b"), 9, TypeValue),
+	}
+	for i := 0; i < len(keys)-1; i++ {
+		require.Negative(t, icmp.Compare(keys[i], keys[i+1]))
+		require.Positive(t, icmp.Compare(keys[i+1], keys[i]))
+	}
+	require.Zero(t, icmp.Compare(keys[0], MakeInternalKey([]byte("a"), 5, TypeValue)))
+
+	/* A shortened user key sorts before every version of itself, keys which can't be shortened are returned as is */
+	start, limit := MakeInternalKey([]byte("abcdef"), 3, TypeValue), MakeInternalKey([]byte("abzz"), 8, TypeValue)
+	separator := icmp.FindShortestSeparator(start, limit)
+	require.Equal(t, MakeInternalKey([]byte("abd"), MaxSequenceNumber, ValueTypeForSeek), separator)
+	require.Negative(t, icmp.Compare(start, separator))
+	require.Negative(t, icmp.Compare(separator, limit))
+	require.Equal(t, keys[0], icmp.FindShortestSeparator(keys[0], keys[2]))
+
+	successor := icmp.FindShortSuccessor(start)
+	require.Equal(t, MakeInternalKey([]byte("b"), MaxSequenceNumber, ValueTypeForSeek), successor)
+	require.Negative(t, icmp.Compare(start, successor))
+}
@@ -3,7 +3,8 @@ package common
 import "errors"
 
 var ErrTombstoneEncountered = errors.New("tombstone encountered")
+var ErrMergeOperandEncountered = errors.New("merge operand encountered, the value is only known once it is merged with the older versions of the key")
+var ErrExpiringValueEncountered = errors.New("value with an expiry encountered, it is up to the reader to check it against the clock")
 var ErrKeyDoesNotExist = errors.New("key does not exist")
-var ErrValDoesNotExist = errors.New("val does not exist")
 var ErrIdxOutOfBounds = errors.New("index out of bounds")
 var ErrInvalidRange = errors.New("range is invalid")
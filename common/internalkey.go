@@ -0,0 +1,55 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/*
+- Every write is stamped with a sequence number and a value type, the user key + these form an internal key
+- Format: [user key:trailer(8 bytes)], the trailer is (sequence number << 8 | value type) in Big-Endian
+- Internal keys are ordered by user key ascending, then sequence number descending so the newest version of a key comes first - see InternalKeyComparator
+*/
+
+type ValueType byte
+
+const (
+	TypeDeletion ValueType = iota
+	TypeValue
+	TypeMerge           /* An operand to be combined with the older versions of the key by the DB's merge operator */
+	TypeValueWithExpiry /* A value prefixed with the time it expires at, after which it reads as a deletion */
+)
+
+const (
+	INTERNALKEYTRAILERLEN = 8
+	MaxSequenceNumber     = (uint64(1) << 56) - 1
+	/* Types are ordered descending for the same sequence number, so seeking with the largest type finds every entry with that sequence number */
+	ValueTypeForSeek = TypeValueWithExpiry
+)
+
+var ErrInvalidInternalKey = errors.New("invalid internal key")
+
+func MakeInternalKey(userKey []byte, seq uint64, valueType ValueType) []byte {
+	ikey := make([]byte, 0, len(userKey)+INTERNALKEYTRAILERLEN)
+	ikey = append(ikey, userKey...)
+	return binary.BigEndian.AppendUint64(ikey, seq<<8|uint64(valueType))
+}
+
+func ParseInternalKey(ikey []byte) (userKey []byte, seq uint64, valueType ValueType, err error) {
+	if len(ikey) < INTERNALKEYTRAILERLEN {
+		return nil, 0, 0, ErrInvalidInternalKey
+	}
+
+	n := len(ikey) - INTERNALKEYTRAILERLEN
+	trailer := binary.BigEndian.Uint64(ikey[n:])
+	valueType = ValueType(trailer & 0xff)
+	if valueType > TypeValueWithExpiry {
+		return nil, 0, 0, ErrInvalidInternalKey
+	}
+	return ikey[:n], trailer >> 8, valueType, nil
+}
+
+/* Assumes ikey is a valid internal key */
+func ExtractUserKey(ikey []byte) []byte {
+	return ikey[:len(ikey)-INTERNALKEYTRAILERLEN]
+}
@@ -0,0 +1,262 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/chettriyuvraj/leveldb-clone/memdb"
+	"github.com/chettriyuvraj/leveldb-clone/sstable"
+)
+
+/*
+- Flushes and compactions run on two background goroutines so that writers never pay for them inline
+- A full memdb of a column family becomes its immutable memdb (imm), and a new memdb takes its place while writes move to a new log - the flush goroutine then turns imm into a level 0 SSTable of the family
+- Compactions are scheduled after every flush and run one at a time on the compaction goroutine, whichever family they are for
+*/
+
+/* Makes sure the memdb of every column family written by the batch (the leader's batch group) has room for it - must be called with mu held by the leader of the write queue */
+func (db *DB) makeRoomForWrite(batch *WriteBatch) error {
+	for _, id := range batch.columnFamilies() {
+		if err := db.makeRoomInColumnFamily(id, batch.size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Makes sure the memdb of the family can take 'size' more bytes, swapping it out for a new one if required */
+func (db *DB) makeRoomInColumnFamily(id uint32, size int) error {
+	for {
+		cf, ok := db.versions.families[id]
+		switch {
+		case db.closed:
+			return ErrDBClosed
+		case db.bgErr != nil:
+			return db.bgErr
+		case !ok:
+			/* Dropped while we waited, the write skips it */
+			return nil
+		case cf.memdb.Size()+size <= db.memdbLimit || cf.memdb.Size() == 0:
+			return nil
+		case cf.imm != nil:
+			/* Previous memdb is still being flushed */
+			db.bgCond.Wait()
+		case len(cf.current.Files(0)) >= cf.opts.Level0StopWritesTrigger:
+			/* Too many level 0 files, let compaction catch up before adding more */
+			db.bgCond.Wait()
+		default:
+			imm := cf.memdb
+			if err := db.newMemDB(cf); err != nil {
+				return errors.Join(ErrSSTableCreate, err)
+			}
+			cf.imm = imm
+			db.scheduleFlush()
+		}
+	}
+}
+
+func (db *DB) scheduleFlush() {
+	select {
+	case db.flushSignal <- struct{}{}:
+	default:
+	}
+}
+
+func (db *DB) maybeScheduleCompaction() {
+	if db.versions.pickCompaction() == nil {
+		return
+	}
+	select {
+	case db.compactSignal <- struct{}{}:
+	default:
+	}
+}
+
+func (db *DB) flushLoop() {
+	defer db.bgWG.Done()
+	for {
+		select {
+		case <-db.closing:
+			return
+		case <-db.flushSignal:
+			db.mu.Lock()
+			if err := db.flushMemDBs(); err != nil && db.bgErr == nil {
+				db.bgErr = err
+			}
+			db.bgCond.Broadcast()
+			db.mu.Unlock()
+		}
+	}
+}
+
+func (db *DB) compactionLoop() {
+	defer db.bgWG.Done()
+	for {
+		select {
+		case <-db.closing:
+			return
+		case <-db.compactSignal:
+			db.mu.Lock()
+			db.compacting = true
+			for !db.closed && db.bgErr == nil {
+				c := db.versions.pickCompaction()
+				if c == nil {
+					break
+				}
+				if err := db.runCompaction(c); err != nil {
+					db.bgErr = errors.Join(ErrCompactionDB, err)
+				}
+				db.bgCond.Broadcast()
+			}
+			db.compacting = false
+			db.bgCond.Broadcast()
+			db.mu.Unlock()
+		}
+	}
+}
+
+/* Flushes the imm of every column family which has one, until none is left */
+func (db *DB) flushMemDBs() error {
+	for {
+		var cf *columnFamily
+		for _, family := range db.versions.columnFamilies() {
+			if family.imm != nil {
+				cf = family
+				break
+			}
+		}
+		if cf == nil {
+			return nil
+		}
+		if err := db.flushMemDB(cf); err != nil {
+			return err
+		}
+		db.bgCond.Broadcast()
+	}
+}
+
+/*
+- Writes the imm of cf to a level 0 SSTable and records it in the MANIFEST along with the log number of its memdb, logs older than that of every family are deleted after that
+- Called with mu held, mu is released while the SSTable is written
+*/
+func (db *DB) flushMemDB(cf *columnFamily) error {
+	imm := cf.imm
+	number := db.versions.NewFileNumber()
+	db.pendingOutputs[number] = true
+	defer delete(db.pendingOutputs, number)
+
+	db.mu.Unlock()
+	meta, err := db.writeMemDBToSSTable(cf, imm, number)
+	db.mu.Lock()
+	/* The family was dropped in the meantime, the table is deleted as it is not part of any version */
+	if cf.dropped {
+		cf.imm = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	edit := VersionEdit{}
+	edit.SetColumnFamily(cf.id)
+	edit.AddFile(0, meta)
+	edit.SetLogNumber(cf.memLogNumber)
+	if err := db.versions.LogAndApply(&edit); err != nil {
+		return errors.Join(ErrSSTableCreate, err)
+	}
+	cf.imm = nil
+	if err := db.advanceIdleLogNumbers(); err != nil {
+		return errors.Join(ErrSSTableCreate, err)
+	}
+
+	if err := db.deleteObsoleteFiles(); err != nil {
+		return err
+	}
+	db.maybeScheduleCompaction()
+	return nil
+}
+
+/*
+- A family with nothing left to flush has none of its writes in any log before the current one, its log number is moved up to it
+- Otherwise a family which isn't written to would hold on to every log written since its last flush
+- Must be called with mu held
+*/
+func (db *DB) advanceIdleLogNumbers() error {
+	for _, cf := range db.versions.columnFamilies() {
+		/* A write being inserted into memdb right now is in the current log, so it is covered either way */
+		if cf.imm != nil || cf.memdb.Size() > 0 || cf.logNumber >= db.logNumber {
+			continue
+		}
+		edit := VersionEdit{}
+		edit.SetColumnFamily(cf.id)
+		edit.SetLogNumber(db.logNumber)
+		if err := db.versions.LogAndApply(&edit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+- imm is never modified, so it can be read without holding mu
+- Every version in imm is written out keyed by its internal key, older versions are dropped by compaction
+*/
+func (db *DB) writeMemDBToSSTable(cf *columnFamily, imm *memdb.MemDB, number uint64) (*FileMetadata, error) {
+	iter, err := imm.InternalScan(nil, nil)
+	if err != nil {
+		return nil, errors.Join(ErrSSTableCreate, err)
+	}
+
+	data, err := sstable.GetSSTableDataWithOptions(iter, cf.opts.BlockSize, db.sstableOptions(cf))
+	if err != nil {
+		return nil, errors.Join(ErrSSTableCreate, err)
+	}
+
+	return db.writeSSTable(cf, number, data)
+}
+
+/* Syncs the log backing memdb every interval, so that writes which aren't synced themselves are still made durable within about an interval */
+func (db *DB) syncLoop(interval time.Duration) {
+	defer db.bgWG.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.closing:
+			return
+		case <-ticker.C:
+			/* A log swapped out in the meantime was synced when it was closed */
+			db.mu.Lock()
+			log := db.log
+			db.mu.Unlock()
+			if err := log.Sync(); err != nil {
+				db.mu.Lock()
+				if db.bgErr == nil {
+					db.bgErr = errors.Join(ErrWALSync, err)
+				}
+				db.bgCond.Broadcast()
+				db.mu.Unlock()
+			}
+		}
+	}
+}
+
+/* Blocks until no flush or compaction is pending or running */
+func (db *DB) waitForBackgroundWork() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for !db.closed && db.bgErr == nil && (db.hasImm() || db.compacting || db.versions.pickCompaction() != nil) {
+		db.bgCond.Wait()
+	}
+	return db.bgErr
+}
+
+/* Returns true if any column family has a memdb waiting to be flushed - must be called with mu held */
+func (db *DB) hasImm() bool {
+	for _, cf := range db.versions.families {
+		if cf.imm != nil {
+			return true
+		}
+	}
+	return false
+}
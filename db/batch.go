@@ -0,0 +1,172 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/chettriyuvraj/leveldb-clone/common"
+	"github.com/chettriyuvraj/leveldb-clone/memdb"
+)
+
+var ErrBatchDecode = errors.New("error decoding write batch")
+
+/* Set on the value type byte of an encoded entry which is followed by a column family ID, entries of the default family leave it out */
+const BATCHCOLUMNFAMILYFLAG = 0x80
+
+type batchEntry struct {
+	columnFamily uint32
+	valueType    common.ValueType
+	key, val     []byte
+}
+
+/*
+- A set of puts/deletes/merges (puts optionally with an expiry) which DB.Write applies atomically, either all of them are visible to reads or none are
+- Entries are applied in order, so a later entry for a key wins over an earlier one
+- Put/Delete/Merge write to the default column family, PutCF/DeleteCF/MergeCF to the given one - a batch may span several families
+- Keys and values are copied, so the caller may reuse them once Put/Delete/Merge returns
+*/
+type WriteBatch struct {
+	entries []batchEntry
+	size    int /* Sum of sizes of the keys + values of all entries */
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+func (batch *WriteBatch) Put(key, val []byte) {
+	batch.append(DEFAULTCOLUMNFAMILYID, common.TypeValue, key, val)
+}
+
+/* The value reads as missing from expiresAt on, and is dropped by compaction after that - see PutWithTTL */
+func (batch *WriteBatch) PutWithExpiry(key, val []byte, expiresAt time.Time) {
+	batch.append(DEFAULTCOLUMNFAMILYID, common.TypeValueWithExpiry, key, encodeExpiringValue(expiresAt, val))
+}
+
+/* Unlike DB.Delete, deleting a key which does not exist is not an error */
+func (batch *WriteBatch) Delete(key []byte) {
+	batch.append(DEFAULTCOLUMNFAMILYID, common.TypeDeletion, key, nil)
+}
+
+/* Requires the DB to have a merge operator */
+func (batch *WriteBatch) Merge(key, operand []byte) {
+	batch.append(DEFAULTCOLUMNFAMILYID, common.TypeMerge, key, operand)
+}
+
+func (batch *WriteBatch) PutCF(cf *ColumnFamilyHandle, key, val []byte) {
+	batch.append(cf.id, common.TypeValue, key, val)
+}
+
+func (batch *WriteBatch) PutCFWithExpiry(cf *ColumnFamilyHandle, key, val []byte, expiresAt time.Time) {
+	batch.append(cf.id, common.TypeValueWithExpiry, key, encodeExpiringValue(expiresAt, val))
+}
+
+func (batch *WriteBatch) DeleteCF(cf *ColumnFamilyHandle, key []byte) {
+	batch.append(cf.id, common.TypeDeletion, key, nil)
+}
+
+/* Requires the column family to have a merge operator */
+func (batch *WriteBatch) MergeCF(cf *ColumnFamilyHandle, key, operand []byte) {
+	batch.append(cf.id, common.TypeMerge, key, operand)
+}
+
+func (batch *WriteBatch) append(columnFamily uint32, valueType common.ValueType, key, val []byte) {
+	/* Values + operands may be empty, only deletions have a nil val */
+	entry := batchEntry{columnFamily: columnFamily, valueType: valueType, key: append([]byte{}, key...)}
+	if valueType != common.TypeDeletion {
+		entry.val = append([]byte{}, val...)
+	}
+	batch.entries = append(batch.entries, entry)
+	batch.size += len(key) + len(val)
+}
+
+/* Appends the entries of 'other' after the ones in batch, entries are shared rather than copied */
+func (batch *WriteBatch) appendBatch(other *WriteBatch) {
+	batch.entries = append(batch.entries, other.entries...)
+	batch.size += other.size
+}
+
+func (batch *WriteBatch) Clear() {
+	batch.entries, batch.size = nil, 0
+}
+
+/* Number of entries in the batch */
+func (batch *WriteBatch) Len() int {
+	return len(batch.entries)
+}
+
+/* IDs of the column families written by the batch, in the order they first appear */
+func (batch *WriteBatch) columnFamilies() []uint32 {
+	ids, seen := []uint32{}, map[uint32]bool{}
+	for _, entry := range batch.entries {
+		if !seen[entry.columnFamily] {
+			ids, seen[entry.columnFamily] = append(ids, entry.columnFamily), true
+		}
+	}
+	return ids
+}
+
+/* Checks every entry up front, so that a batch is never partially applied */
+func (batch *WriteBatch) validate() error {
+	for _, entry := range batch.entries {
+		if len(entry.key) == 0 {
+			return memdb.ErrEmptyKeyNotAllowed
+		}
+	}
+	return nil
+}
+
+/*
+- Format: [count(4 bytes)] followed by 'count' entries, each being [value type(1 byte):column family ID(4 bytes):key length(4 bytes):key:val length(4 bytes):val]
+- The column family ID is only present if BATCHCOLUMNFAMILYFLAG is set on the value type, so batches logged before column families existed decode as batches of the default family
+*/
+func (batch *WriteBatch) MarshalBinary() (data []byte, err error) {
+	data = binary.BigEndian.AppendUint32(data, uint32(len(batch.entries)))
+	for _, entry := range batch.entries {
+		if entry.columnFamily == DEFAULTCOLUMNFAMILYID {
+			data = append(data, byte(entry.valueType))
+		} else {
+			data = append(data, byte(entry.valueType)|BATCHCOLUMNFAMILYFLAG)
+			data = binary.BigEndian.AppendUint32(data, entry.columnFamily)
+		}
+		data = binary.BigEndian.AppendUint32(data, uint32(len(entry.key)))
+		data = append(data, entry.key...)
+		data = binary.BigEndian.AppendUint32(data, uint32(len(entry.val)))
+		data = append(data, entry.val...)
+	}
+	return data, nil
+}
+
+/* Replaces the contents of the batch with the decoded entries */
+func (batch *WriteBatch) UnmarshalBinary(data []byte) error {
+	batch.Clear()
+
+	d := editDecoder{data: data}
+	count := d.readUint32()
+	for i := uint32(0); i < count && d.err == nil; i++ {
+		tag, columnFamily := d.readByte(), DEFAULTCOLUMNFAMILYID
+		if tag&BATCHCOLUMNFAMILYFLAG != 0 {
+			columnFamily = d.readUint32()
+		}
+		valueType := common.ValueType(tag &^ BATCHCOLUMNFAMILYFLAG)
+		key := d.readBytes()
+		val := d.readBytes()
+		if d.err != nil {
+			break
+		}
+
+		switch valueType {
+		case common.TypeValue, common.TypeDeletion, common.TypeMerge, common.TypeValueWithExpiry:
+			batch.append(columnFamily, valueType, key, val)
+		default:
+			batch.Clear()
+			return ErrBatchDecode
+		}
+	}
+	if d.err != nil || d.offset != len(data) {
+		batch.Clear()
+		return ErrBatchDecode
+	}
+	return nil
+}
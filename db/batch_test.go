@@ -0,0 +1,93 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chettriyuvraj/leveldb-clone/common"
+	"github.com/chettriyuvraj/leveldb-clone/memdb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteBatchMarshal(t *testing.T) {
+	batch := NewWriteBatch()
+	batch.Put([]byte("key1"), []byte("val1"))
+	batch.Delete([]byte("key2"))
+	batch.Put([]byte("key3"), []byte("val3"))
+	batch.Merge([]byte("key3"), []byte("operand"))
+	batch.PutCF(&ColumnFamilyHandle{id: 3}, []byte("key4"), []byte("val4"))
+	batch.DeleteCF(&ColumnFamilyHandle{id: 1 << 20}, []byte("key5"))
+	batch.PutWithExpiry([]byte("key6"), []byte("val6"), time.Unix(1700000000, 0))
+	batch.PutCFWithExpiry(&ColumnFamilyHandle{id: 3}, []byte("key7"), nil, time.Unix(1700000000, 0))
+
+	data, err := batch.MarshalBinary()
+	require.NoError(t, err)
+
+	got := NewWriteBatch()
+	require.NoError(t, got.UnmarshalBinary(data))
+	require.Equal(t, batch.Len(), got.Len())
+	require.Equal(t, batch.size, got.size)
+	for i, entry := range batch.entries {
+		require.Equal(t, entry.columnFamily, got.entries[i].columnFamily)
+		require.Equal(t, entry.valueType, got.entries[i].valueType)
+		require.Equal(t, entry.key, got.entries[i].key)
+		require.Equal(t, string(entry.val), string(got.entries[i].val))
+	}
+
+	/* Truncated batches must not decode */
+	require.ErrorIs(t, NewWriteBatch().UnmarshalBinary(data[:len(data)-1]), ErrBatchDecode)
+
+	batch.Clear()
+	require.Zero(t, batch.Len())
+}
+
+func TestWrite(t *testing.T) {
+	defer cleanupTestDB(t)
+
+	config := DBConfig{dirName: TESTDBCONFIG.dirName, memdbLimit: 100, createNew: true}
+	db1, err := NewDB(config)
+	require.NoError(t, err)
+
+	require.NoError(t, db1.Put([]byte("key1"), []byte("val1")))
+	batch := NewWriteBatch()
+	batch.Put([]byte("key2"), []byte("val2"))
+	batch.Delete([]byte("key1"))
+	batch.Put([]byte("key3"), []byte("val3"))
+	batch.Put([]byte("key2"), []byte("val2-new"))
+
+	/* An invalid entry anywhere in the batch means none of it is applied */
+	invalid := NewWriteBatch()
+	invalid.Put([]byte("key4"), []byte("val4"))
+	invalid.Put(nil, []byte("val5"))
+	require.ErrorIs(t, db1.Write(invalid, WriteOptions{}), memdb.ErrEmptyKeyNotAllowed)
+	_, err = db1.Get([]byte("key4"))
+	require.ErrorIs(t, err, common.ErrKeyDoesNotExist)
+
+	/* Reads see the batch all at once, later entries for the same key win */
+	snapshot, err := db1.GetSnapshot()
+	require.NoError(t, err)
+	require.NoError(t, db1.Write(batch, WriteOptions{}))
+	check := func(db *DB) {
+		_, err := db.Get([]byte("key1"))
+		require.ErrorIs(t, err, common.ErrKeyDoesNotExist)
+		v, err := db.Get([]byte("key2"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("val2-new"), v)
+		v, err = db.Get([]byte("key3"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("val3"), v)
+	}
+	check(db1)
+	has, err := db1.HasWithOptions([]byte("key3"), ReadOptions{Snapshot: snapshot})
+	require.NoError(t, err)
+	require.False(t, has)
+	db1.ReleaseSnapshot(snapshot)
+
+	/* The batch is recovered as a whole from the WAL */
+	require.NoError(t, db1.Close())
+	config.createNew = false
+	db2, err := NewDB(config)
+	require.NoError(t, err)
+	defer db2.Close()
+	check(db2)
+}
@@ -0,0 +1,230 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/chettriyuvraj/leveldb-clone/common"
+	"github.com/chettriyuvraj/leveldb-clone/memdb"
+)
+
+const (
+	DEFAULTCOLUMNFAMILYID   = uint32(0)
+	DEFAULTCOLUMNFAMILYNAME = "default"
+)
+
+var ErrColumnFamilyNotFound = errors.New("column family does not exist")
+var ErrColumnFamilyExists = errors.New("column family already exists")
+var ErrDropDefaultColumnFamily = errors.New("default column family can't be dropped")
+
+/*
+- A column family is a keyspace of its own within the DB, with its own memdbs, SSTables (levels + compaction) and options
+- Families share the DB's WAL, MANIFEST, sequence numbers and file numbers - so a write batch spanning families is applied atomically, and a snapshot covers every family
+- The default family always exists and can't be dropped, DB.Get/Put/Delete/... operate on it
+- Fields are guarded by the DB's mu, the version set updates current, compactPointers and logNumber
+*/
+type columnFamily struct {
+	id              uint32
+	name            string
+	opts            Options /* Only the fields which apply to a single family are read from these (see Options.ColumnFamilies), the rest come from the DB's options */
+	icmp            *common.InternalKeyComparator
+	current         *Version
+	compactPointers [][]byte /* Per level, the largest key of the last compaction - the next compaction at that level starts after it */
+	logNumber       uint64   /* Logs older than this hold none of the family's writes which are not in its SSTables */
+	memdb           *memdb.MemDB
+	imm             *memdb.MemDB /* Full memdb being flushed in the background */
+	memLogNumber    uint64       /* First log holding writes in memdb, it becomes logNumber once memdb is flushed */
+	dropped         bool
+}
+
+/* Handle to a column family, returned by CreateColumnFamily/ColumnFamily - every operation fails with ErrColumnFamilyNotFound once the family is dropped */
+type ColumnFamilyHandle struct {
+	db   *DB
+	id   uint32
+	name string
+}
+
+func (cf *ColumnFamilyHandle) Name() string {
+	return cf.name
+}
+
+func (db *DB) DefaultColumnFamily() *ColumnFamilyHandle {
+	return &ColumnFamilyHandle{db: db, id: DEFAULTCOLUMNFAMILYID, name: DEFAULTCOLUMNFAMILYNAME}
+}
+
+/*
+- Creates a new, empty column family, which is recorded in the MANIFEST before this returns
+- opts sets the comparator, merge operator, compaction, SSTable and compression options of the family - options shared by the whole DB (caches, syncing, recovery) are taken from the DB's options
+- Options are not persisted, a family whose options differ from the DB's must be given them in Options.ColumnFamilies every time the DB is opened
+*/
+func (db *DB) CreateColumnFamily(name string, opts Options) (*ColumnFamilyHandle, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+	for _, cf := range db.versions.families {
+		if cf.name == name {
+			return nil, ErrColumnFamilyExists
+		}
+	}
+
+	mem, err := memdb.NewMemDBWithComparator(opts.withDefaults().Comparator)
+	if err != nil {
+		return nil, err
+	}
+	/* The family has nothing in the logs before the current one */
+	cf, err := db.versions.CreateColumnFamily(name, opts.withDefaults(), db.logNumber)
+	if err != nil {
+		return nil, err
+	}
+	cf.memdb, cf.memLogNumber = mem, db.logNumber
+	return &ColumnFamilyHandle{db: db, id: cf.id, name: cf.name}, nil
+}
+
+/*
+- Drops the column family, its SSTables are deleted once no reader uses them and its writes in the WAL are ignored from then on
+- Iterators and snapshots already taken keep reading the family as it was
+*/
+func (db *DB) DropColumnFamily(handle *ColumnFamilyHandle) error {
+	if handle.id == DEFAULTCOLUMNFAMILYID {
+		return ErrDropDefaultColumnFamily
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrDBClosed
+	}
+	cf, ok := db.versions.families[handle.id]
+	if !ok {
+		return ErrColumnFamilyNotFound
+	}
+
+	/* A flush or compaction of the family in progress finds it dropped once it is done, and discards its output */
+	if err := db.versions.DropColumnFamily(cf); err != nil {
+		return err
+	}
+	db.bgCond.Broadcast()
+	return db.deleteObsoleteFiles()
+}
+
+/* Names of every column family of the DB, the default family first and the others in the order they were created */
+func (db *DB) ListColumnFamilies() ([]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+
+	names := []string{}
+	for _, cf := range db.versions.columnFamilies() {
+		names = append(names, cf.name)
+	}
+	return names, nil
+}
+
+/* Returns a handle to an existing column family, e.g. one created before the DB was reopened */
+func (db *DB) ColumnFamily(name string) (*ColumnFamilyHandle, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+
+	for _, cf := range db.versions.families {
+		if cf.name == name {
+			return &ColumnFamilyHandle{db: db, id: cf.id, name: cf.name}, nil
+		}
+	}
+	return nil, ErrColumnFamilyNotFound
+}
+
+func (cf *ColumnFamilyHandle) Get(key []byte) ([]byte, error) {
+	return cf.GetWithOptions(key, ReadOptions{})
+}
+
+func (cf *ColumnFamilyHandle) GetWithOptions(key []byte, opts ReadOptions) ([]byte, error) {
+	state, err := cf.db.acquireReadState(cf.id, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cf.db.releaseReadState(state)
+	return cf.db.get(state, key)
+}
+
+func (cf *ColumnFamilyHandle) Has(key []byte) (bool, error) {
+	return cf.HasWithOptions(key, ReadOptions{})
+}
+
+func (cf *ColumnFamilyHandle) HasWithOptions(key []byte, opts ReadOptions) (bool, error) {
+	_, err := cf.GetWithOptions(key, opts)
+	if err != nil {
+		if !errors.Is(err, common.ErrKeyDoesNotExist) {
+			return false, errors.Join(ErrMemDB, err)
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+func (cf *ColumnFamilyHandle) Put(key, val []byte) error {
+	return cf.PutWithOptions(key, val, WriteOptions{})
+}
+
+func (cf *ColumnFamilyHandle) PutWithOptions(key, val []byte, opts WriteOptions) error {
+	batch := NewWriteBatch()
+	batch.PutCF(cf, key, val)
+	return cf.db.Write(batch, opts)
+}
+
+func (cf *ColumnFamilyHandle) PutWithTTL(key, val []byte, ttl time.Duration) error {
+	return cf.PutWithTTLWithOptions(key, val, ttl, WriteOptions{})
+}
+
+func (cf *ColumnFamilyHandle) PutWithTTLWithOptions(key, val []byte, ttl time.Duration, opts WriteOptions) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	batch := NewWriteBatch()
+	batch.PutCFWithExpiry(cf, key, val, cf.db.opts.Clock().Add(ttl))
+	return cf.db.Write(batch, opts)
+}
+
+func (cf *ColumnFamilyHandle) Merge(key, operand []byte) error {
+	return cf.MergeWithOptions(key, operand, WriteOptions{})
+}
+
+func (cf *ColumnFamilyHandle) MergeWithOptions(key, operand []byte, opts WriteOptions) error {
+	batch := NewWriteBatch()
+	batch.MergeCF(cf, key, operand)
+	return cf.db.Write(batch, opts)
+}
+
+func (cf *ColumnFamilyHandle) Delete(key []byte) error {
+	return cf.DeleteWithOptions(key, WriteOptions{})
+}
+
+func (cf *ColumnFamilyHandle) DeleteWithOptions(key []byte, opts WriteOptions) error {
+	cf.db.deleteMu.Lock()
+	defer cf.db.deleteMu.Unlock()
+
+	/* Check if key exists - deletes are serialized so it can't be deleted in the meantime */
+	if _, err := cf.Get(key); err != nil {
+		return err
+	}
+
+	/* Insert tombstone only if key exists */
+	batch := NewWriteBatch()
+	batch.DeleteCF(cf, key)
+	return cf.db.Write(batch, opts)
+}
+
+func (cf *ColumnFamilyHandle) RangeScan(start, limit []byte) (common.Iterator, error) {
+	return cf.RangeScanWithOptions(start, limit, ReadOptions{})
+}
+
+/* The iterator sees the family as it was when RangeScanWithOptions was called, or as of the snapshot in opts */
+func (cf *ColumnFamilyHandle) RangeScanWithOptions(start, limit []byte, opts ReadOptions) (common.Iterator, error) {
+	return newMergeIterator(cf.db, cf.id, start, limit, opts)
+}
@@ -0,0 +1,190 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/chettriyuvraj/leveldb-clone/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestColumnFamilies(t *testing.T) {
+	dirName := t.TempDir()
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	val := func(family string, i int) []byte { return []byte(fmt.Sprintf("%s%03d", family, i)) }
+
+	/* Counters are ordered in reverse and merged, users take the options of the DB */
+	countersOpts := TESTLEVELEDOPTIONS
+	countersOpts.Comparator, countersOpts.MergeOperator = reverseComparator{}, counterOperator{}
+	opts := TESTLEVELEDOPTIONS
+	opts.ColumnFamilies = map[string]Options{"counters": countersOpts}
+
+	db, err := NewDB(NewDBConfigWithOptions(100, true, dirName, opts))
+	require.NoError(t, err)
+	users, err := db.CreateColumnFamily("users", TESTLEVELEDOPTIONS)
+	require.NoError(t, err)
+	counters, err := db.CreateColumnFamily("counters", countersOpts)
+	require.NoError(t, err)
+	_, err = db.CreateColumnFamily("users", TESTLEVELEDOPTIONS)
+	require.ErrorIs(t, err, ErrColumnFamilyExists)
+	names, err := db.ListColumnFamilies()
+	require.NoError(t, err)
+	require.Equal(t, []string{DEFAULTCOLUMNFAMILYNAME, "users", "counters"}, names)
+
+	/* The same keys are written to every family, a batch spans all three */
+	const keys = 50
+	for i := 0; i < keys; i++ {
+		require.NoError(t, db.Put(key(i), val("default", i)))
+		batch := NewWriteBatch()
+		batch.PutCF(users, key(i), val("user", i))
+		batch.MergeCF(counters, key(i), counter(uint64(i)))
+		batch.MergeCF(counters, key(i), counter(1))
+		require.NoError(t, db.Write(batch, WriteOptions{}))
+	}
+	require.ErrorIs(t, db.Merge(key(0), counter(1)), ErrNoMergeOperator)
+
+	check := func(db *DB, families map[string]bool) {
+		for name := range families {
+			cf, err := db.ColumnFamily(name)
+			require.NoError(t, err)
+			for i := 0; i < keys; i++ {
+				v, err := cf.Get(key(i))
+				require.NoError(t, err)
+				switch name {
+				case "counters":
+					require.Equal(t, counter(uint64(i+1)), v)
+				case "users":
+					require.Equal(t, val("user", i), v)
+				default:
+					require.Equal(t, val("default", i), v)
+				}
+			}
+		}
+
+		/* Each family is scanned in the order of its own comparator */
+		if families["counters"] {
+			cf, err := db.ColumnFamily("counters")
+			require.NoError(t, err)
+			iter, err := cf.RangeScan(nil, nil)
+			require.NoError(t, err)
+			for i := keys - 1; i >= 0; i-- {
+				require.Equal(t, key(i), iter.Key())
+				iter.Next()
+			}
+			require.Nil(t, iter.Key())
+		}
+	}
+	check(db, map[string]bool{DEFAULTCOLUMNFAMILYNAME: true, "users": true, "counters": true})
+
+	/* Every family has SSTables of its own */
+	require.NoError(t, db.waitForBackgroundWork())
+	owners := map[uint64]uint32{}
+	for _, cf := range db.versions.columnFamilies() {
+		require.NotEmpty(t, cf.current.liveFiles(), cf.name)
+		for number := range cf.current.liveFiles() {
+			require.NotContains(t, owners, number)
+			owners[number] = cf.id
+		}
+	}
+	require.NoError(t, db.Close())
+
+	/* Families have to be reopened with the comparator they were created with */
+	_, err = NewDB(NewDBConfigWithOptions(100, false, dirName, TESTLEVELEDOPTIONS))
+	require.ErrorIs(t, err, ErrComparatorMismatch)
+
+	db, err = NewDB(NewDBConfigWithOptions(100, false, dirName, opts))
+	require.NoError(t, err)
+	check(db, map[string]bool{DEFAULTCOLUMNFAMILYNAME: true, "users": true, "counters": true})
+
+	/* A dropped family can't be used any more and its tables are deleted, the other families are left as they are */
+	users, err = db.ColumnFamily("users")
+	require.NoError(t, err)
+	require.ErrorIs(t, db.DropColumnFamily(db.DefaultColumnFamily()), ErrDropDefaultColumnFamily)
+	usersFiles := db.versions.families[users.id].current.liveFiles()
+	require.NoError(t, db.DropColumnFamily(users))
+	require.ErrorIs(t, db.DropColumnFamily(users), ErrColumnFamilyNotFound)
+	_, err = users.Get(key(0))
+	require.ErrorIs(t, err, ErrColumnFamilyNotFound)
+	require.ErrorIs(t, users.Put(key(0), val("user", 0)), ErrColumnFamilyNotFound)
+	for number := range usersFiles {
+		_, err := os.Stat(sstFileName(dirName, number))
+		require.ErrorIs(t, err, os.ErrNotExist)
+	}
+	names, err = db.ListColumnFamilies()
+	require.NoError(t, err)
+	require.Equal(t, []string{DEFAULTCOLUMNFAMILYNAME, "counters"}, names)
+	check(db, map[string]bool{DEFAULTCOLUMNFAMILYNAME: true, "counters": true})
+	require.NoError(t, db.Close())
+
+	/* The drop survives a restart, a family created under the same name is a new, empty one - the old family's writes in the logs are not replayed into it */
+	db, err = NewDB(NewDBConfigWithOptions(100, false, dirName, opts))
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.ColumnFamily("users")
+	require.ErrorIs(t, err, ErrColumnFamilyNotFound)
+	users, err = db.CreateColumnFamily("users", TESTLEVELEDOPTIONS)
+	require.NoError(t, err)
+	iter, err := users.RangeScan(nil, nil)
+	require.NoError(t, err)
+	require.Nil(t, iter.Key())
+	check(db, map[string]bool{DEFAULTCOLUMNFAMILYNAME: true, "counters": true})
+}
+
+func TestColumnFamilyLogs(t *testing.T) {
+	dirName := t.TempDir()
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	logFiles := func() []uint64 {
+		entries, err := os.ReadDir(dirName)
+		require.NoError(t, err)
+		logs := []uint64{}
+		for _, entry := range entries {
+			if fileType, number := parseFileName(entry.Name()); fileType == FILETYPELOG {
+				logs = append(logs, number)
+			}
+		}
+		return logs
+	}
+
+	db, err := NewDB(NewDBConfigWithOptions(100, true, dirName, TESTLEVELEDOPTIONS))
+	require.NoError(t, err)
+	idle, err := db.CreateColumnFamily("idle", Options{})
+	require.NoError(t, err)
+
+	/* A family which is never written to does not keep old logs around while the default family flushes */
+	for i := 0; i < 50; i++ {
+		require.NoError(t, db.Put(key(i), key(i)))
+	}
+	require.NoError(t, db.waitForBackgroundWork())
+	require.Equal(t, []uint64{db.logNumber}, logFiles())
+
+	/* A family whose memdb isn't flushed keeps the log holding its write, even as the other family moves on to new logs */
+	require.NoError(t, idle.Put([]byte("rare"), []byte("write")))
+	oldestLog := db.logNumber
+	for i := 50; i < 100; i++ {
+		require.NoError(t, db.Put(key(i), key(i)))
+	}
+	require.NoError(t, db.waitForBackgroundWork())
+	require.Greater(t, db.logNumber, oldestLog)
+	require.Contains(t, logFiles(), oldestLog)
+	require.NoError(t, db.Close())
+
+	db, err = NewDB(NewDBConfigWithOptions(100, false, dirName, TESTLEVELEDOPTIONS))
+	require.NoError(t, err)
+	defer db.Close()
+	idle, err = db.ColumnFamily("idle")
+	require.NoError(t, err)
+	v, err := idle.Get([]byte("rare"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("write"), v)
+	_, err = idle.Get(key(0))
+	require.ErrorIs(t, err, common.ErrKeyDoesNotExist)
+	for i := 0; i < 100; i++ {
+		v, err := db.Get(key(i))
+		require.NoError(t, err)
+		require.Equal(t, key(i), v)
+	}
+
+	/* Recovery flushed every family, so only the new log is left */
+	require.Equal(t, []uint64{db.logNumber}, logFiles())
+}
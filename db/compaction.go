@@ -0,0 +1,482 @@
+package db
+
+import (
+	"github.com/chettriyuvraj/leveldb-clone/common"
+	"github.com/chettriyuvraj/leveldb-clone/sstable"
+)
+
+/* A compaction merges files from 'level' of a column family with the files from 'level+1' which overlap them, outputs are written to 'level+1' */
+type compaction struct {
+	cf     *columnFamily
+	level  int
+	inputs [2][]*FileMetadata
+}
+
+/* Picks the compaction with the highest score across every column family, nil if none is needed */
+func (vs *VersionSet) pickCompaction() *compaction {
+	var best *compaction
+	bestScore := 0.0
+	for _, cf := range vs.columnFamilies() {
+		if c, score := cf.pickCompaction(); c != nil && score > bestScore {
+			best, bestScore = c, score
+		}
+	}
+	return best
+}
+
+/*
+- Level 0 is scored by number of files, every other level by its total size relative to its max size
+- The level with the highest score above 1 is compacted, the last level is never compacted
+*/
+func (cf *columnFamily) pickCompaction() (*compaction, float64) {
+	v := cf.current
+	bestLevel, bestScore := -1, 1.0
+	for level := 0; level < v.NumLevels()-1; level++ {
+		var score float64
+		if level == 0 {
+			score = float64(len(v.levels[0])) / float64(cf.opts.Level0CompactionTrigger)
+		} else {
+			score = float64(v.LevelSize(level)) / float64(cf.opts.maxBytesForLevel(level))
+		}
+		if score > bestScore {
+			bestLevel, bestScore = level, score
+		}
+	}
+	if bestLevel < 0 {
+		return nil, 0
+	}
+
+	c := &compaction{cf: cf, level: bestLevel}
+	files := v.levels[bestLevel]
+	if bestLevel == 0 {
+		/* Level 0 files overlap each other, so pick the oldest one + every other level 0 file overlapping it */
+		smallest, largest := common.ExtractUserKey(files[0].smallest), common.ExtractUserKey(files[0].largest)
+		c.inputs[0] = v.overlappingFiles(0, smallest, largest)
+	} else {
+		/* Rotate through the key space - pick the first file after the key where the last compaction for this level stopped */
+		picked := files[0]
+		if pointer := cf.compactPointers[bestLevel]; pointer != nil {
+			for _, f := range files {
+				if cf.icmp.Compare(f.largest, pointer) > 0 {
+					picked = f
+					break
+				}
+			}
+		}
+		c.inputs[0] = []*FileMetadata{picked}
+	}
+
+	smallest, largest := keyRange(cf.icmp, c.inputs[0])
+	c.inputs[1] = v.overlappingFiles(bestLevel+1, common.ExtractUserKey(smallest), common.ExtractUserKey(largest))
+	return c, bestScore
+}
+
+/*
+- Returns files in the level which overlap the user keys [smallest, largest]
+- For level 0, the range is widened to cover any overlapping file and the search restarted, since level 0 files may overlap each other
+*/
+func (v *Version) overlappingFiles(level int, smallest, largest []byte) []*FileMetadata {
+	ucmp := v.icmp.UserComparator()
+	overlapping := []*FileMetadata{}
+	files := v.levels[level]
+	for i := 0; i < len(files); i++ {
+		f := files[i]
+		fileSmallest, fileLargest := common.ExtractUserKey(f.smallest), common.ExtractUserKey(f.largest)
+		if ucmp.Compare(fileLargest, smallest) < 0 || ucmp.Compare(fileSmallest, largest) > 0 {
+			continue
+		}
+
+		if level == 0 {
+			widened := false
+			if ucmp.Compare(fileSmallest, smallest) < 0 {
+				smallest, widened = fileSmallest, true
+			}
+			if ucmp.Compare(fileLargest, largest) > 0 {
+				largest, widened = fileLargest, true
+			}
+			if widened {
+				overlapping, i = []*FileMetadata{}, -1
+				continue
+			}
+		}
+		overlapping = append(overlapping, f)
+	}
+	return overlapping
+}
+
+/* Returns true if no level deeper than 'level' can contain the user key */
+func (v *Version) isBaseLevelForKey(level int, key []byte) bool {
+	ucmp := v.icmp.UserComparator()
+	for l := level + 1; l < v.NumLevels(); l++ {
+		for _, f := range v.levels[l] {
+			if ucmp.Compare(key, common.ExtractUserKey(f.smallest)) >= 0 && ucmp.Compare(key, common.ExtractUserKey(f.largest)) <= 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+/* Smallest and largest internal key across all files */
+func keyRange(icmp *common.InternalKeyComparator, files []*FileMetadata) (smallest, largest []byte) {
+	for i, f := range files {
+		if i == 0 || icmp.Compare(f.smallest, smallest) < 0 {
+			smallest = f.smallest
+		}
+		if i == 0 || icmp.Compare(f.largest, largest) > 0 {
+			largest = f.largest
+		}
+	}
+	return smallest, largest
+}
+
+/* A single file with nothing to merge with in the next level can simply be moved down */
+func (c *compaction) isTrivialMove() bool {
+	return len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0
+}
+
+/*
+- Merges the inputs into new SSTables of roughly TargetFileSize at level+1
+- Old tables are deleted only once the new version has been recorded in the MANIFEST
+- Called with mu held, mu is released while the output SSTables are written
+*/
+func (db *DB) runCompaction(c *compaction) error {
+	edit := VersionEdit{}
+	edit.SetColumnFamily(c.cf.id)
+	_, largest := keyRange(c.cf.icmp, c.inputs[0])
+	edit.SetCompactPointer(c.level, largest)
+	for which, files := range c.inputs {
+		for _, meta := range files {
+			edit.DeleteFile(c.level+which, meta.number)
+		}
+	}
+
+	if c.isTrivialMove() {
+		edit.AddFile(c.level+1, c.inputs[0][0])
+	} else {
+		/* Input files aren't deleted while mu is released - only compactions remove files from the current version and they run one at a time, a dropped family's files are kept by referencing the version */
+		/* Snapshots taken while mu is released can't see anything older than the inputs' newest versions, so the smallest snapshot now is safe to use */
+		current, smallestSnapshot := c.cf.current, db.smallestSnapshot()
+		db.versions.Ref(current)
+		db.mu.Unlock()
+		outputs, err := db.createCompactionFiles(c, current, smallestSnapshot)
+		db.mu.Lock()
+		db.versions.Unref(current)
+		for _, meta := range outputs {
+			delete(db.pendingOutputs, meta.number)
+			edit.AddFile(c.level+1, meta)
+		}
+		/* The family was dropped in the meantime, the outputs are deleted as they are not part of any version */
+		if c.cf.dropped {
+			return db.deleteObsoleteFiles()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := db.versions.LogAndApply(&edit); err != nil {
+		return err
+	}
+	return db.deleteObsoleteFiles()
+}
+
+/*
+- Merges the input tables and splits the result into SSTables of roughly TargetFileSize bytes each
+- Called without holding mu, output file numbers are registered as pending so they aren't deleted before they are installed
+*/
+func (db *DB) createCompactionFiles(c *compaction, current *Version, smallestSnapshot uint64) (outputs []*FileMetadata, err error) {
+	iter, err := db.newCompactionIterator(c, current, smallestSnapshot)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	for iter.Key() != nil {
+		data, err := sstable.GetSSTableDataWithOptions(&outputSplitIterator{Iterator: iter, ucmp: c.cf.opts.Comparator, limit: c.cf.opts.TargetFileSize}, c.cf.opts.BlockSize, db.sstableOptions(c.cf))
+		if err != nil {
+			return outputs, err
+		}
+
+		db.mu.Lock()
+		number := db.versions.NewFileNumber()
+		db.pendingOutputs[number] = true
+		db.mu.Unlock()
+
+		meta, err := db.writeSSTable(c.cf, number, data)
+		if err != nil {
+			db.mu.Lock()
+			delete(db.pendingOutputs, number)
+			db.mu.Unlock()
+			return outputs, err
+		}
+		outputs = append(outputs, meta)
+	}
+
+	return outputs, iter.Error()
+}
+
+/* Merges the input tables, their order doesn't matter since versions are told apart by sequence number - 'current' is the version the compaction was picked from */
+func (db *DB) newCompactionIterator(c *compaction, current *Version, smallestSnapshot uint64) (*compactionIterator, error) {
+	mergeIter, err := newTablesMergeIterator(db.tableCache, c.cf, append(append([]*FileMetadata{}, c.inputs[0]...), c.inputs[1]...))
+	if err != nil {
+		return nil, err
+	}
+
+	outputLevel := c.level + 1
+	return newDroppingIterator(mergeIter, c.cf.opts.Comparator, c.cf.opts.MergeOperator, smallestSnapshot, db.opts.Clock().UnixNano(), func(key []byte) bool {
+		return current.isBaseLevelForKey(outputLevel, key)
+	}), nil
+}
+
+/*
+- Wraps the merged inputs of a compaction and drops entries which can never be read again
+- Older versions of a user key are dropped once a newer version is visible to the oldest snapshot (and so to every read)
+- Deletions visible to the oldest snapshot are dropped once no deeper level may contain an older version of the key
+- Values visible to the oldest snapshot which have expired as of now are dropped the same way, and replaced with a deletion if a deeper level may still contain an older version
+- Merge operands visible to the oldest snapshot are merged with the older versions of their key: into a value if the value below them (or a deletion) is among the inputs or no deeper level may contain the key, otherwise into as few operands as the merge operator's PartialMerge allows
+- A value which has yet to expire is never merged into, since the operands on top of it read differently once it does - they are only combined with each other
+- Every other version is kept, since some live snapshot may still read it
+*/
+type compactionIterator struct {
+	common.Iterator
+	ucmp              common.Comparator
+	merge             MergeOperator /* nil if the column family has none, operands are then kept as is */
+	isBaseLevelForKey func(key []byte) bool
+	smallestSnapshot  uint64
+	now               int64          /* Unix time in nanoseconds which expiring values are checked against */
+	lastUserKey       []byte         /* User key of the previous entry, nil at the start */
+	lastSeqForKey     uint64         /* Sequence number of the previous version of lastUserKey, common.MaxSequenceNumber if there is none */
+	merged            []mergeOperand /* Entries produced by merging operands or expiring values (newest first), yielded before moving on with the wrapped iterator which is already past them */
+	err               error
+}
+
+func newDroppingIterator(iter common.Iterator, ucmp common.Comparator, merge MergeOperator, smallestSnapshot uint64, now int64, isBaseLevelForKey func(key []byte) bool) *compactionIterator {
+	compactionIter := &compactionIterator{Iterator: iter, ucmp: ucmp, merge: merge, isBaseLevelForKey: isBaseLevelForKey, smallestSnapshot: smallestSnapshot, now: now}
+	compactionIter.settle()
+	return compactionIter
+}
+
+/* Moves past the droppable entries from the wrapped iterator's current entry on, merging operands where it can */
+func (iter *compactionIterator) settle() bool {
+	for iter.err == nil && iter.Iterator.Key() != nil {
+		droppable, mergeable, expired := iter.classify()
+		switch {
+		case droppable:
+			iter.Iterator.Next()
+		case mergeable:
+			iter.mergeOperands()
+			return iter.err == nil
+		case expired:
+			iter.expire()
+			return true
+		default:
+			return iter.err == nil
+		}
+	}
+	return false
+}
+
+func (iter *compactionIterator) classify() (droppable, mergeable, expired bool) {
+	userKey, seq, valueType, err := common.ParseInternalKey(iter.Iterator.Key())
+	if err != nil {
+		iter.err = err
+		return false, false, false
+	}
+	if iter.lastUserKey == nil || iter.ucmp.Compare(userKey, iter.lastUserKey) != 0 {
+		iter.lastUserKey, iter.lastSeqForKey = userKey, common.MaxSequenceNumber
+	}
+	hasExpired := false
+	if valueType == common.TypeValueWithExpiry && seq <= iter.smallestSnapshot {
+		if _, hasExpired, err = resolveExpiry(valueType, iter.Iterator.Value(), iter.now); err != nil {
+			iter.err = err
+			return false, false, false
+		}
+	}
+
+	switch {
+	case iter.lastSeqForKey <= iter.smallestSnapshot:
+		/* Shadowed by a newer version which every snapshot sees */
+		droppable = true
+	case valueType == common.TypeDeletion && seq <= iter.smallestSnapshot && iter.isBaseLevelForKey(userKey):
+		droppable = true
+	case hasExpired && iter.isBaseLevelForKey(userKey):
+		/* Every read sees it as a deletion, which can be dropped */
+		droppable = true
+	case hasExpired:
+		expired = true
+	case valueType == common.TypeMerge && seq <= iter.smallestSnapshot && iter.merge != nil:
+		mergeable = true
+	}
+	/* An operand which is not merged doesn't shadow anything, the versions below it are still needed to merge it later */
+	if valueType != common.TypeMerge || mergeable {
+		iter.lastSeqForKey = seq
+	}
+	return droppable, mergeable, expired
+}
+
+/* Replaces the expired value the wrapped iterator is at with a deletion, which keeps hiding the older versions of its key in deeper levels */
+func (iter *compactionIterator) expire() {
+	userKey, seq, _, _ := common.ParseInternalKey(iter.Iterator.Key())
+	iter.merged = []mergeOperand{{key: common.MakeInternalKey(userKey, seq, common.TypeDeletion)}}
+	iter.Iterator.Next()
+}
+
+/*
+- Merges the operand the wrapped iterator is at with the older versions of its key, every snapshot sees the result in place of all of them
+- The wrapped iterator is left after the versions consumed, older versions after them are dropped since they are shadowed
+*/
+func (iter *compactionIterator) mergeOperands() {
+	newest := mergeOperand{key: iter.Iterator.Key(), val: iter.Iterator.Value()}
+	userKey := common.ExtractUserKey(newest.key)
+	iter.Iterator.Next()
+
+	peek := func() (key, val []byte) { return iter.Iterator.Key(), iter.Iterator.Value() }
+	advance := func() { iter.Iterator.Next() }
+	operands, base, err := collectOperands(peek, advance, iter.ucmp, userKey, common.MaxSequenceNumber)
+	if err != nil {
+		iter.err = err
+		return
+	}
+	operands = append([]mergeOperand{newest}, operands...)
+
+	unexpired := false
+	if base != nil {
+		_, _, valueType, _ := common.ParseInternalKey(base.key)
+		_, expired, err := resolveExpiry(valueType, base.val, iter.now)
+		if err != nil {
+			iter.err = err
+			return
+		}
+		unexpired = valueType == common.TypeValueWithExpiry && !expired
+	}
+
+	if (base != nil && !unexpired) || (base == nil && iter.isBaseLevelForKey(userKey)) {
+		existing, err := baseValue(base, iter.now)
+		if err != nil {
+			iter.err = err
+			return
+		}
+		val, err := fullMerge(iter.merge, userKey, existing, operands)
+		if err != nil {
+			iter.err = err
+			return
+		}
+		_, seq, _, _ := common.ParseInternalKey(newest.key)
+		iter.merged = []mergeOperand{{key: common.MakeInternalKey(userKey, seq, common.TypeValue), val: val}}
+		return
+	}
+
+	/* Deeper levels may still hold the value below the operands, or it has yet to expire - combine them oldest first, each result takes the key of the newer operand */
+	combined := []mergeOperand{}
+	for i := len(operands) - 1; i >= 0; i-- {
+		if n := len(combined); n > 0 {
+			if val, ok := iter.merge.PartialMerge(userKey, combined[n-1].val, operands[i].val); ok {
+				combined[n-1] = mergeOperand{key: operands[i].key, val: val}
+				continue
+			}
+		}
+		combined = append(combined, operands[i])
+	}
+	iter.merged = nil
+	for i := len(combined) - 1; i >= 0; i-- {
+		iter.merged = append(iter.merged, combined[i])
+	}
+	if unexpired {
+		iter.merged = append(iter.merged, *base)
+	}
+}
+
+/* Releases the input tables */
+func (iter *compactionIterator) Close() error {
+	closeIterators([]common.Iterator{iter.Iterator})
+	return nil
+}
+
+func (iter *compactionIterator) Next() bool {
+	if iter.err != nil {
+		return false
+	}
+	if len(iter.merged) > 0 {
+		iter.merged = iter.merged[1:]
+		if len(iter.merged) > 0 {
+			return true
+		}
+		return iter.settle()
+	}
+	if !iter.Iterator.Next() {
+		return false
+	}
+	return iter.settle()
+}
+
+func (iter *compactionIterator) Key() []byte {
+	if iter.err != nil {
+		return nil
+	}
+	if len(iter.merged) > 0 {
+		return iter.merged[0].key
+	}
+	return iter.Iterator.Key()
+}
+
+func (iter *compactionIterator) Value() []byte {
+	if iter.err != nil {
+		return nil
+	}
+	if len(iter.merged) > 0 {
+		return iter.merged[0].val
+	}
+	return iter.Iterator.Value()
+}
+
+func (iter *compactionIterator) Error() error {
+	if iter.err != nil {
+		return iter.err
+	}
+	return iter.Iterator.Error()
+}
+
+/*
+- Ends once roughly 'limit' bytes have been read and the user key changes, so all versions of a user key end up in the same output file
+- The wrapped iterator is left at the first entry which was not read, ready for the next output file
+*/
+type outputSplitIterator struct {
+	common.Iterator
+	ucmp    common.Comparator
+	limit   uint64
+	read    uint64
+	stopped bool
+}
+
+func (iter *outputSplitIterator) Next() bool {
+	if iter.stopped {
+		return false
+	}
+
+	prevKey := iter.Iterator.Key()
+	iter.read += uint64(len(prevKey) + len(iter.Iterator.Value()))
+	if !iter.Iterator.Next() {
+		return false
+	}
+
+	if iter.read >= iter.limit && iter.ucmp.Compare(common.ExtractUserKey(prevKey), common.ExtractUserKey(iter.Iterator.Key())) != 0 {
+		iter.stopped = true
+		return false
+	}
+	return true
+}
+
+func (iter *outputSplitIterator) Key() []byte {
+	if iter.stopped {
+		return nil
+	}
+	return iter.Iterator.Key()
+}
+
+func (iter *outputSplitIterator) Value() []byte {
+	if iter.stopped {
+		return nil
+	}
+	return iter.Iterator.Value()
+}
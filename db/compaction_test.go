@@ -0,0 +1,124 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/chettriyuvraj/leveldb-clone/common"
+	"github.com/chettriyuvraj/leveldb-clone/memdb"
+	"github.com/stretchr/testify/require"
+)
+
+var TESTLEVELEDOPTIONS Options = Options{
+	NumLevels:               4,
+	Level0CompactionTrigger: 2,
+	BaseLevelSize:           200,
+	LevelSizeMultiplier:     2,
+	TargetFileSize:          60,
+}
+
+func TestLeveledCompaction(t *testing.T) {
+	defer cleanupTestDB(t)
+
+	config := NewDBConfigWithOptions(30, true, TESTDBCONFIG.dirName, TESTLEVELEDOPTIONS)
+	db, err := NewDB(config)
+	require.NoError(t, err)
+	defer db.Close()
+
+	/* Write enough data to push files down to the deepest level, overwriting + deleting a few keys along the way */
+	n := 300
+	for i := 0; i < n; i++ {
+		k, v := []byte(fmt.Sprintf("key%03d", i%150)), []byte(fmt.Sprintf("val%03d", i))
+		require.NoError(t, db.Put(k, v))
+	}
+	for i := 0; i < 150; i += 10 {
+		require.NoError(t, db.Delete([]byte(fmt.Sprintf("key%03d", i))))
+	}
+	require.NoError(t, db.waitForBackgroundWork())
+
+	current := db.versions.defaultColumnFamily().current
+	require.NotEmpty(t, current.Files(current.NumLevels()-1), "data should have reached the last level")
+	require.LessOrEqual(t, len(current.Files(0)), TESTLEVELEDOPTIONS.Level0CompactionTrigger)
+	for level := 1; level < current.NumLevels(); level++ {
+		/* Files in levels other than 0 are sorted + non overlapping */
+		files := current.Files(level)
+		for i := 1; i < len(files); i++ {
+			require.Less(t, bytes.Compare(common.ExtractUserKey(files[i-1].largest), common.ExtractUserKey(files[i].smallest)), 0)
+		}
+		/* Every level except the last stays within its limit after compaction */
+		if level < current.NumLevels()-1 {
+			require.LessOrEqual(t, current.LevelSize(level), db.opts.maxBytesForLevel(level))
+		}
+	}
+
+	/* Newest value wins, deleted keys stay deleted */
+	for i := 0; i < 150; i++ {
+		k := []byte(fmt.Sprintf("key%03d", i))
+		v, err := db.Get(k)
+		if i%10 == 0 {
+			require.ErrorIs(t, err, common.ErrKeyDoesNotExist)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("val%03d", i+150)), v)
+	}
+}
+
+func TestOverlappingFiles(t *testing.T) {
+	file := func(number uint64, smallest, largest string) *FileMetadata {
+		return &FileMetadata{number: number, smallest: common.MakeInternalKey([]byte(smallest), number, common.TypeValue), largest: common.MakeInternalKey([]byte(largest), number, common.TypeValue)}
+	}
+	v := newVersion(3, common.NewInternalKeyComparator(common.BytewiseComparator))
+	v.levels[0] = []*FileMetadata{file(1, "b", "d"), file(2, "c", "f"), file(3, "g", "h"), file(4, "a", "b")}
+	v.levels[1] = []*FileMetadata{file(5, "a", "c"), file(6, "d", "e"), file(7, "x", "z")}
+
+	/* Level 0 range widens transitively: [e,e] -> [c,f] -> [b,f] -> [a,f] */
+	got := v.overlappingFiles(0, []byte("e"), []byte("e"))
+	require.ElementsMatch(t, []*FileMetadata{v.levels[0][0], v.levels[0][1], v.levels[0][3]}, got)
+
+	/* Other levels don't widen */
+	got = v.overlappingFiles(1, []byte("c"), []byte("d"))
+	require.Equal(t, []*FileMetadata{v.levels[1][0], v.levels[1][1]}, got)
+
+	require.False(t, v.isBaseLevelForKey(0, []byte("y")))
+	require.True(t, v.isBaseLevelForKey(0, []byte("m")))
+	require.True(t, v.isBaseLevelForKey(1, []byte("y")))
+}
+
+func TestCompactionKeepsSnapshotVersions(t *testing.T) {
+	mem, err := memdb.NewMemDB()
+	require.NoError(t, err)
+	k := []byte("key")
+	for _, seq := range []uint64{2, 4, 6, 8} {
+		require.NoError(t, mem.Add(seq, common.TypeValue, k, []byte(fmt.Sprintf("val%d", seq))))
+	}
+	require.NoError(t, mem.Add(9, common.TypeDeletion, k, nil))
+
+	tcs := []struct {
+		smallestSnapshot uint64
+		want             []uint64
+	}{
+		/* No snapshot older than the deletion, so nothing is visible anymore */
+		{smallestSnapshot: 9, want: []uint64{}},
+		/* A snapshot at 8 still sees val8 and nothing older */
+		{smallestSnapshot: 8, want: []uint64{9, 8}},
+		/* A snapshot at 5 sees val4 */
+		{smallestSnapshot: 5, want: []uint64{9, 8, 6, 4}},
+		{smallestSnapshot: 1, want: []uint64{9, 8, 6, 4, 2}},
+	}
+	for _, tc := range tcs {
+		internalIter, err := mem.InternalScan(nil, nil)
+		require.NoError(t, err)
+		iter := newDroppingIterator(internalIter, common.BytewiseComparator, nil, tc.smallestSnapshot, 0, func(key []byte) bool { return true })
+
+		got := []uint64{}
+		for ; iter.Key() != nil; iter.Next() {
+			_, seq, _, err := common.ParseInternalKey(iter.Key())
+			require.NoError(t, err)
+			got = append(got, seq)
+		}
+		require.NoError(t, iter.Error())
+		require.Equal(t, tc.want, got, "smallest snapshot %d", tc.smallestSnapshot)
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/chettriyuvraj/leveldb-clone/cache"
 	"github.com/chettriyuvraj/leveldb-clone/common"
 	"github.com/chettriyuvraj/leveldb-clone/memdb"
 	"github.com/chettriyuvraj/leveldb-clone/sstable"
@@ -14,457 +17,687 @@ import (
 )
 
 const (
-	DEFAULTWALFILENAME   = "log"
-	DEFAULTSSTFILENAME   = "sst"
-	DEFAULTCOMPACTIONDIR = "compact"
-	LEVEL0SSTLIMIT       = 4
-	LEVEL1SSTFILESIZE    = 80 /* In bytes */
+	DEFAULTWALFILEEXT      = "log"
+	DEFAULTSSTFILEEXT      = "sst"
+	DEFAULTMANIFESTPREFIX  = "MANIFEST"
+	DEFAULTCURRENTFILENAME = "CURRENT"
+	DEFAULTTEMPFILEEXT     = ".tmp"
+	LEVEL0SSTLIMIT         = 4
 )
 
+/*
+Concurrency model - a DB is safe for concurrent use by multiple goroutines
+- Writes (Put/Delete/Write) queue up in writers, the writer at the front of the queue (the leader) appends its own write and those queued behind it to the log as one record and inserts them into the memdbs of their column families - without holding mu
+- Deletes are also serialized by deleteMu, which is held from the check that the key exists until the tombstone is written
+- Every write is stamped with the sequence number after the last one, a batch takes one per entry - they are recorded in the version set only once the whole write is in memdb, which is what makes a batch atomic to readers
+- mu guards every field below it along with the column families, it is only held briefly: readers take it to capture a family's memdb, imm and a referenced version (see readState) and then read without it
+- Memdbs synchronize internally, SSTables are immutable and read using ReadAt, so reads proceed in parallel with each other, with writes and with background work
+- Files of a version are deleted only once no reader references that version, tables are opened on demand by the table cache which keeps them open while a reader uses them
+- Background flushes/compactions release mu while writing SSTable files
+- bgCond is signalled whenever background work finishes or the write queue drains, leaders waiting for room in the memdb and Close wait on it
+- Close must not be called until all other calls on the DB have returned
+*/
 type DB struct {
-	dirName         string
-	memdb           *memdb.MemDB
-	memdbLimit      int /* Max size of memdb before flush */
-	sstables        []sstable.SSTableDB
-	compactSSTables []sstable.SSTableDB
-	log             *wal.WAL
+	dirName        string
+	memdbLimit     int     /* Max size of memdb before flush */
+	opts           Options /* Options of the DB, which are also the options of the default column family */
+	deleteMu       sync.Mutex
+	mu             sync.Mutex
+	bgCond         *sync.Cond
+	versions       *VersionSet     /* Holds the column families, each with its memdb, imm and current version */
+	tableCache     *tableCache     /* Open SSTables, opened on demand */
+	pendingOutputs map[uint64]bool /* SSTables being written which are not part of any version yet */
+	log            *wal.WAL        /* Shared by every column family */
+	logNumber      uint64          /* Number of the log being written */
+	writers        []*writer       /* Queued writes, the first one is being written by its leader */
+	snapshots      []*Snapshot     /* Live snapshots, oldest first */
+	compacting     bool
+	bgErr          error /* First error hit by background work, all writes fail after it */
+	closed         bool
+	flushSignal    chan struct{}
+	compactSignal  chan struct{}
+	closing        chan struct{}
+	bgWG           sync.WaitGroup
+	filterStats    sstable.FilterStats /* Shared by the bloom filters of every table */
+	blockCache     *cache.Cache
+	cacheNamespace uint64 /* Keeps the blocks of this DB apart from those of other DBs sharing blockCache */
 }
 
 type DBConfig struct {
 	memdbLimit int
 	createNew  bool /* Should we create new DB if dirName already exists? */
 	dirName    string
+	options    Options
 }
 
 var ErrMemDB = errors.New("error while querying memdb")
 var ErrInitDB = errors.New("error initializing DB")
-var ErrWALPUT = errors.New("error appending PUT to WAL")
-var ErrWALDELETE = errors.New("error appending DELETE to WAL")
+var ErrWALBATCH = errors.New("error appending write batch to WAL")
 var ErrWALReplay = errors.New("error replaying records from WAL")
+var ErrWALSync = errors.New("error syncing WAL")
 var ErrSSTableCreate = errors.New("error creating SSTable file")
 var ErrCompactionDB = errors.New("error compacting DB")
+var ErrOpenSSTable = errors.New("error opening SSTable")
+var ErrDBClosed = errors.New("DB is closed")
 
 func NewDBConfig(memdbLimit int, createNew bool, dirName string) DBConfig {
 	return DBConfig{memdbLimit: memdbLimit, createNew: createNew, dirName: dirName}
 }
 
+func NewDBConfigWithOptions(memdbLimit int, createNew bool, dirName string, options Options) DBConfig {
+	return DBConfig{memdbLimit: memdbLimit, createNew: createNew, dirName: dirName, options: options}
+}
+
 /* Initialize DB only using this function */
 func NewDB(config DBConfig) (*DB, error) {
 	dirName := config.dirName
+	opts := config.options.withDefaults()
+
+	/* No background work has started before db is returned, so failing only has to close what is open */
+	var db *DB
+	fail := func(err error) (*DB, error) {
+		if db != nil {
+			if db.log != nil {
+				db.log.Close()
+			}
+			db.tableCache.close()
+			db.versions.Close()
+		}
+		return nil, errors.Join(ErrInitDB, err)
+	}
 
 	/* Create directory for DB */
 	exists, err := fileOrDirExists(dirName)
 	if err != nil {
-		return nil, errors.Join(ErrInitDB, err)
+		return fail(err)
 	}
 	if exists && config.createNew {
 		err := emptyDir(dirName, true)
 		if err != nil {
-			return nil, err
+			return fail(err)
 		}
 	}
 	if !exists {
 		err := os.Mkdir(dirName, 0777)
 		if err != nil {
-			errors.Join(ErrInitDB, err)
+			return fail(err)
 		}
 	}
 
-	/* Attach WAL */
-	logPath := filepath.Join(dirName, DEFAULTWALFILENAME)
-	log, err := wal.Open(logPath)
+	/* Replay the MANIFEST to find out which SSTables make up the DB */
+	versions, err := OpenVersionSet(dirName, opts)
 	if err != nil {
-		return nil, errors.Join(ErrInitDB, err)
+		return fail(err)
 	}
 
-	/* Attach SSTables if they exist, both current and compacted ones */
-	sstables, err := getExistingSSTables(dirName)
-	if err != nil {
-		return nil, errors.Join(ErrInitDB, err)
+	db = &DB{
+		dirName:        dirName,
+		memdbLimit:     config.memdbLimit,
+		opts:           opts,
+		versions:       versions,
+		pendingOutputs: map[uint64]bool{},
+		flushSignal:    make(chan struct{}, 1),
+		compactSignal:  make(chan struct{}, 1),
+		closing:        make(chan struct{}),
 	}
-	compactionDir := filepath.Join(dirName, DEFAULTCOMPACTIONDIR)
-	compactSSTables, err := getExistingSSTables(compactionDir)
-	if err != nil {
-		return nil, errors.Join(ErrInitDB, err)
+	db.bgCond = sync.NewCond(&db.mu)
+	db.blockCache = opts.BlockCache
+	if db.blockCache == nil {
+		db.blockCache = cache.NewLRUCache(opts.BlockCacheSize)
 	}
+	db.cacheNamespace = db.blockCache.NewNamespace()
+	db.tableCache = newTableCache(opts.MaxOpenFiles, db.openSSTable)
 
-	memdb, err := memdb.NewMemDB()
-	if err != nil {
-		return nil, errors.Join(ErrInitDB, err)
+	/* Recover what the previous run left in its logs, which also attaches a new WAL */
+	if err := db.recover(); err != nil {
+		return fail(errors.Join(ErrWALReplay, err))
+	}
+
+	/* Clean up anything left over from a flush/compaction which crashed midway */
+	if err := db.deleteObsoleteFiles(); err != nil {
+		return fail(err)
+	}
+
+	db.bgWG.Add(2)
+	go db.flushLoop()
+	go db.compactionLoop()
+	if opts.SyncInterval > 0 {
+		db.bgWG.Add(1)
+		go db.syncLoop(opts.SyncInterval)
 	}
+	db.maybeScheduleCompaction()
 
-	return &DB{memdb: memdb, log: log, dirName: dirName, memdbLimit: config.memdbLimit, sstables: sstables, compactSSTables: compactSSTables}, nil
+	return db, nil
 }
 
-/* DB is attached with a default WAL, but we have the option to attach our own as well */
-func (db *DB) AttachWAL(filename string) error {
-	log, err := wal.Open(filename)
+/* Switches writes over to a freshly numbered log, the logs before it are kept until every column family has flushed the writes they hold */
+func (db *DB) newLog() error {
+	logNumber := db.versions.NewFileNumber()
+	log, err := wal.Open(logFileName(db.dirName, logNumber))
 	if err != nil {
 		return err
 	}
-	db.log = log
+	/* The new log is only durable once the directory entry pointing at it is */
+	if err := syncDir(db.dirName); err != nil {
+		log.Close()
+		return err
+	}
+
+	if db.log != nil {
+		db.log.Close()
+	}
+	db.log, db.logNumber = log, logNumber
 	return nil
 }
 
-func (db *DB) Get(key []byte) (val []byte, err error) {
-	val, err = db.memdb.Get(key)
+/* Replaces the memdb of cf with an empty one, its writes go to a new log from now on */
+func (db *DB) newMemDB(cf *columnFamily) error {
+	mem, err := memdb.NewMemDBWithComparator(cf.opts.Comparator)
 	if err != nil {
-		if !errors.Is(err, common.ErrKeyDoesNotExist) {
-			return nil, errors.Join(ErrMemDB, err)
-		}
-		return db.searchSSTables(key)
+		return err
 	}
-
-	/* Tombstone encountered in memtable */
-	if val == nil {
-		return nil, common.ErrKeyDoesNotExist
+	if err := db.newLog(); err != nil {
+		return err
 	}
-
-	return val, nil
+	cf.memdb, cf.memLogNumber = mem, db.logNumber
+	return nil
 }
 
-func (db *DB) searchSSTables(key []byte) (val []byte, err error) {
-	tables := append(db.sstables, db.compactSSTables...)
-	/* Search each sstable; TODO : search only compacted tables which match the range of the key */
-	for _, sst := range tables {
-		val, err := sst.Get(key)
-		if err != nil {
-			if !errors.Is(err, common.ErrKeyDoesNotExist) {
-				return nil, fmt.Errorf("error searching sstables: %w", err)
-			}
-			continue
-		}
-		/* Tombstone encountered - in SSTables, values of length 0 imply tombstones */
-		if val == nil {
-			break
-		}
-		return val, nil
+/* Logs at or after the oldest log number of any column family recorded in the MANIFEST hold data that never made it to an SSTable */
+func (db *DB) getLogsToReplay() ([]uint64, error) {
+	dirEntries, err := os.ReadDir(db.dirName)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, common.ErrKeyDoesNotExist
-}
-
-func (db *DB) Has(key []byte) (ret bool, err error) {
-	_, err = db.Get(key)
-	if err != nil {
-		if !errors.Is(err, common.ErrKeyDoesNotExist) {
-			return false, errors.Join(ErrMemDB, err)
+	logNumbers := []uint64{}
+	for _, dirEntry := range dirEntries {
+		fileType, number := parseFileName(dirEntry.Name())
+		if fileType == FILETYPELOG && number >= db.versions.LogNumber() {
+			logNumbers = append(logNumbers, number)
 		}
-		return false, nil
 	}
-	return true, nil
+	sort.Slice(logNumbers, func(i, j int) bool { return logNumbers[i] < logNumbers[j] })
+	return logNumbers, nil
 }
 
-func (db *DB) Put(key, val []byte) error { // to modify in memdb
-	if len(val) == 0 {
-		return common.ErrValDoesNotExist
+/* Everything a read of a column family needs, captured under mu so that the read itself can run without holding it */
+type readState struct {
+	cf       *columnFamily
+	mem, imm *memdb.MemDB
+	version  *Version
+	seq      uint64 /* Only versions with a sequence number <= seq are visible to the read */
+	now      int64  /* Unix time in nanoseconds which expiring values are checked against */
+	ro       sstable.ReadOptions
+}
+
+/*
+- The version is referenced so its files aren't deleted until releaseReadState
+- Reads see the DB as of the snapshot in opts, or as of now if there is none
+*/
+func (db *DB) acquireReadState(id uint32, opts ReadOptions) (*readState, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+	cf, ok := db.versions.families[id]
+	if !ok {
+		return nil, ErrColumnFamilyNotFound
+	}
+
+	seq := db.versions.LastSequence()
+	if opts.Snapshot != nil {
+		if opts.Snapshot.released {
+			return nil, ErrSnapshotReleased
+		}
+		seq = opts.Snapshot.seq
 	}
 
-	dataSize := len(key) + len(val)
+	state := &readState{cf: cf, mem: cf.memdb, imm: cf.imm, version: cf.current, seq: seq, now: db.opts.Clock().UnixNano(), ro: sstable.ReadOptions{VerifyChecksums: opts.VerifyChecksums}}
+	db.versions.Ref(state.version)
+	return state, nil
+}
 
-	/* Check if Put will exceed memdb limit */
-	if db.memdb.Size()+dataSize > db.memdbLimit {
-		if len(db.sstables) > LEVEL0SSTLIMIT {
-			err := db.compact()
-			if err != nil {
-				return err
-			}
+func (db *DB) releaseReadState(state *readState) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.versions.Unref(state.version)
+}
 
-			err = db.resetMemDB()
-			if err != nil {
-				return err
-			}
+func (db *DB) Get(key []byte) (val []byte, err error) {
+	return db.GetWithOptions(key, ReadOptions{})
+}
 
-			return db.putToMemDB(key, val)
-		}
+func (db *DB) GetWithOptions(key []byte, opts ReadOptions) (val []byte, err error) {
+	return db.DefaultColumnFamily().GetWithOptions(key, opts)
+}
 
-		err := db.flushToSSTable()
-		if err != nil {
-			return err
+/* Searches memdb, then the memdb being flushed, then the SSTables for the newest version visible at state.seq */
+func (db *DB) get(state *readState, key []byte) (val []byte, err error) {
+	for _, mem := range []*memdb.MemDB{state.mem, state.imm} {
+		if mem == nil {
+			continue
 		}
 
-		err = db.resetMemDB()
+		val, valueType, err := mem.LookupEntry(key, state.seq)
 		if err != nil {
-			return err
+			if errors.Is(err, common.ErrKeyDoesNotExist) {
+				continue
+			}
+			return nil, errors.Join(ErrMemDB, err)
 		}
+		return db.resolve(state, key, val, valueType)
 	}
 
-	return db.putToMemDB(key, val)
+	newest, err := db.searchSSTables(state, key)
+	if err != nil {
+		return nil, err
+	}
+	if newest == nil {
+		return nil, common.ErrKeyDoesNotExist
+	}
+	return db.resolve(state, key, newest.val, newest.valueType)
 }
 
-func (db *DB) putToMemDB(key, val []byte) error {
-	if len(val) == 0 {
-		return common.ErrValDoesNotExist
+/* Value of key given its newest version visible to the read - older versions further down must not be looked at unless it is a merge operand */
+func (db *DB) resolve(state *readState, key, val []byte, valueType common.ValueType) ([]byte, error) {
+	switch valueType {
+	case common.TypeDeletion:
+		return nil, common.ErrKeyDoesNotExist
+	case common.TypeMerge:
+		return db.getMerged(state, key)
 	}
 
-	err := db.log.Append(key, val, wal.PUT)
+	val, expired, err := resolveExpiry(valueType, val, state.now)
 	if err != nil {
-		return errors.Join(ErrWALPUT, err)
+		return nil, err
 	}
-
-	if err := db.memdb.Put(key, val); err != nil {
-		return errors.Join(ErrMemDB, err)
+	if expired {
+		return nil, common.ErrKeyDoesNotExist
 	}
-
-	return nil
+	return val, nil
 }
 
-func (db *DB) resetMemDB() error {
-	/* Truncate log file and seek to the start */
-	err := os.Truncate(db.log.Filename(), 0)
+/* Reads every version of key visible at state.seq newest first, merging the operands on top of the newest value below them */
+func (db *DB) getMerged(state *readState, key []byte) ([]byte, error) {
+	children, err := db.readStateIterators(state, key, key)
 	if err != nil {
-		return errors.Join(ErrSSTableCreate, err)
+		return nil, err
 	}
-	_, err = db.log.Seek(0, 0)
-	if err != nil {
-		return errors.Join(ErrSSTableCreate, err)
+	iter := &MergeIterator{startKey: key, limitKey: key, seq: state.seq, now: state.now, heap: IterHeap{icmp: state.cf.icmp}, merge: state.cf.opts.MergeOperator}
+	if err := iter.init(children); err != nil {
+		return nil, err
 	}
+	defer iter.Close()
 
-	/* Create new memdb */
-	memdb, err := memdb.NewMemDB()
-	if err != nil {
-		return errors.Join(ErrSSTableCreate, err)
+	if iter.Key() == nil {
+		return nil, common.ErrKeyDoesNotExist
 	}
-	db.memdb = memdb
-
-	return nil
+	return iter.Value(), nil
 }
 
-/* Flushes MemDB to SSTable */
-func (db *DB) flushToSSTable() error {
-	filename, err := getNextSSTableName(db.dirName)
-	if err != nil {
-		return err
+/*
+- Level 0 tables may overlap so each of them is searched, the version with the largest sequence number wins
+- Tables in deeper levels don't overlap, so at most one table per level can contain the key
+- Any version found in a level is newer than every version in the levels below it, so the search stops at the first level holding one
+- Returns nil if no table holds a version of key visible at state.seq
+*/
+func (db *DB) searchSSTables(state *readState, key []byte) (*tableEntry, error) {
+	ucmp := state.cf.opts.Comparator
+	for level := 0; level < state.version.NumLevels(); level++ {
+		files := state.version.Files(level)
+		var newest *tableEntry
+		for i := range files {
+			if level > 0 {
+				i = sort.Search(len(files), func(i int) bool { return ucmp.Compare(common.ExtractUserKey(files[i].largest), key) >= 0 })
+				if i == len(files) {
+					break
+				}
+			}
+			if ucmp.Compare(key, common.ExtractUserKey(files[i].smallest)) < 0 || ucmp.Compare(key, common.ExtractUserKey(files[i].largest)) > 0 {
+				if level > 0 {
+					break
+				}
+				continue
+			}
+
+			entry, err := db.lookupTable(state.cf, files[i].number, key, state.seq, state.ro)
+			if err != nil {
+				return nil, fmt.Errorf("error searching sstables: %w", err)
+			}
+			if entry != nil && (newest == nil || entry.seq > newest.seq) {
+				newest = entry
+			}
+			if level > 0 {
+				break
+			}
+		}
+
+		if newest != nil {
+			return newest, nil
+		}
 	}
 
-	sstPath := filepath.Join(db.dirName, filename)
-	f, err := os.OpenFile(sstPath, os.O_RDWR|os.O_CREATE, 0777) /* TODO: use lesser permissions */
+	return nil, nil
+}
+
+/* Newest version of a user key visible to a read within a single SSTable */
+type tableEntry struct {
+	val       []byte
+	seq       uint64
+	valueType common.ValueType
+}
+
+/* Returns nil if the table holds no version of key with a sequence number <= seq */
+func (db *DB) lookupTable(cf *columnFamily, number uint64, key []byte, seq uint64, ro sstable.ReadOptions) (*tableEntry, error) {
+	handle, err := db.tableCache.get(number, cf)
 	if err != nil {
-		return errors.Join(ErrSSTableCreate, err)
+		return nil, err
 	}
-	defer f.Close()
+	defer db.tableCache.release(handle)
+	return lookupSSTable(&handle.sst, cf.opts.Comparator, key, seq, ro)
+}
 
-	err = db.memdb.FlushSSTable(f)
+func lookupSSTable(sst *sstable.SSTableDB, ucmp common.Comparator, key []byte, seq uint64, ro sstable.ReadOptions) (*tableEntry, error) {
+	/* Tables filter on user keys, so a table without any version of key is usually skipped without being read */
+	foundKey, val, err := sst.LookupWithOptions(common.MakeInternalKey(key, seq, common.ValueTypeForSeek), ro)
 	if err != nil {
-		return errors.Join(ErrSSTableCreate, err)
+		if errors.Is(err, common.ErrKeyDoesNotExist) {
+			return nil, nil
+		}
+		return nil, err
 	}
 
-	sstable, err := sstable.OpenSSTableDB(sstPath)
+	userKey, seq, valueType, err := common.ParseInternalKey(foundKey)
 	if err != nil {
-		return errors.Join(ErrSSTableCreate, err)
+		return nil, err
+	}
+	if ucmp.Compare(userKey, key) != 0 {
+		return nil, nil
 	}
-	db.sstables = append(db.sstables, sstable)
+	return &tableEntry{val: val, seq: seq, valueType: valueType}, nil
+}
 
-	return nil
+func (db *DB) Has(key []byte) (ret bool, err error) {
+	return db.HasWithOptions(key, ReadOptions{})
 }
 
-func (db *DB) Delete(key []byte) error { // to modify in memdb
-	if db.log != nil {
-		err := db.log.Append(key, nil, wal.DELETE)
-		if err != nil {
-			return errors.Join(ErrWALDELETE, err)
-		}
-	}
+func (db *DB) HasWithOptions(key []byte, opts ReadOptions) (ret bool, err error) {
+	return db.DefaultColumnFamily().HasWithOptions(key, opts)
+}
 
-	/* Check if key exists */
-	if _, err := db.Get(key); err != nil {
-		return err
-	}
+func (db *DB) Put(key, val []byte) error { // to modify in memdb
+	return db.PutWithOptions(key, val, WriteOptions{})
+}
 
-	/* Insert tombstone only if key exists */
-	if err := db.memdb.InsertTombstone(key); err != nil {
-		return errors.Join(ErrMemDB, err)
-	}
+func (db *DB) PutWithOptions(key, val []byte, opts WriteOptions) error {
+	return db.DefaultColumnFamily().PutWithOptions(key, val, opts)
+}
 
-	return nil
+/*
+- Writes key with a value which reads as missing once ttl has passed, and which compaction drops after that
+- The expiry is fixed as Options.Clock + ttl when this is called, writing key again replaces it along with the value
+*/
+func (db *DB) PutWithTTL(key, val []byte, ttl time.Duration) error {
+	return db.PutWithTTLWithOptions(key, val, ttl, WriteOptions{})
 }
 
-/* TODO: Implement range scans with ss tables */
-func (db *DB) RangeScan(start, limit []byte) (common.Iterator, error) {
-	return NewMergeIterator(db, start, limit)
+func (db *DB) PutWithTTLWithOptions(key, val []byte, ttl time.Duration, opts WriteOptions) error {
+	return db.DefaultColumnFamily().PutWithTTLWithOptions(key, val, ttl, opts)
 }
 
-func (db *DB) Replay() error {
-	records, err := db.log.Replay()
-	if err != nil {
-		return errors.Join(ErrWALReplay, err)
-	}
-	for _, record := range records {
-		op := record.Op()
-		switch op {
-		case wal.PUT:
-			err := db.Put(record.Key(), record.Val())
-			if err != nil {
-				return errors.Join(ErrWALReplay, ErrWALPUT, err)
-			}
-		case wal.DELETE:
-			err := db.Delete(record.Key())
-			if err != nil {
-				return errors.Join(ErrWALReplay, ErrWALDELETE, err)
-			}
-		}
-	}
-	return nil
+/* Writes operand as a merge operand of key, which Options.MergeOperator merges with the value of key when it is read or compacted */
+func (db *DB) Merge(key, operand []byte) error {
+	return db.MergeWithOptions(key, operand, WriteOptions{})
 }
 
-func (db *DB) compact() error {
-	compactionDir := filepath.Join(db.dirName, DEFAULTCOMPACTIONDIR)
-	compactionDirTemp := filepath.Join(db.dirName, fmt.Sprintf("%stemp", DEFAULTCOMPACTIONDIR))
+func (db *DB) MergeWithOptions(key, operand []byte, opts WriteOptions) error {
+	return db.DefaultColumnFamily().MergeWithOptions(key, operand, opts)
+}
 
-	/* Create directory for compaction - temp and then rename later*/
-	compactionDirTempExists, err := fileOrDirExists(compactionDirTemp)
-	if err != nil {
-		return errors.Join(ErrCompactionDB, err)
-	}
-	if !compactionDirTempExists {
-		err := os.Mkdir(compactionDirTemp, 0777)
-		if err != nil {
-			errors.Join(ErrCompactionDB, err)
-		}
+/*
+- Applies every entry of the batch atomically, even if they are for different column families - the batch is logged as part of a single WAL record
+- Concurrent writes are grouped together (see writequeue.go), a write returns once it is in memdb
+*/
+func (db *DB) Write(batch *WriteBatch, opts WriteOptions) error {
+	if err := batch.validate(); err != nil {
+		return err
 	}
-	compactionDirExists, err := fileOrDirExists(compactionDir)
-	if err != nil {
-		return errors.Join(ErrCompactionDB, err)
+	if batch.Len() == 0 {
+		return nil
 	}
 
-	/* Add prev compacted sstables to dbs sstable list  */
-	prevCompactedSSTables, err := getExistingSSTables(compactionDir)
-	if err != nil {
-		return errors.Join(ErrCompactionDB, err)
+	w := &writer{batch: batch, sync: opts.Sync || db.opts.Sync, cond: sync.NewCond(&db.mu)}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.validateColumnFamilies(batch); err != nil {
+		return err
 	}
-	combinedSSTables := append(db.sstables, prevCompactedSSTables...)
-
-	/* Compute total size of data ~ roughly */
-	totalSize := uint64(db.memdb.Size())
-	for _, sst := range combinedSSTables {
-		totalSize += sst.Size()
+	db.writers = append(db.writers, w)
+	for !w.done && db.writers[0] != w {
+		w.cond.Wait()
 	}
-
-	/* Do a full scan on the entire data and split it into equal sized pieces - passing a dummy db obj since actual one used for incoming reads until data fully compacted */
-	fullScanIter, err := NewFullMergeIterator(&DB{memdb: db.memdb, sstables: combinedSSTables})
-	if err != nil {
-		return err
+	if w.done {
+		return w.err
 	}
 
-	/* Create compaction files in temp dir, then delete old compaction folder + rename temp dir + delete level 0 sstables */
-	if err = db.createCompactionFiles(compactionDirTemp, fullScanIter, LEVEL1SSTFILESIZE); err != nil {
-		return errors.Join(ErrCompactionDB, err)
-	}
+	/* w leads the writes queued behind it - room is made for the whole group, as the writes it takes may be larger or for other column families */
+	group, last := db.buildBatchGroup()
+	err := db.makeRoomForWrite(group)
+	if err == nil {
+		mems, log, seq := db.memdbs(), db.log, db.versions.LastSequence()+1
 
-	if compactionDirExists {
-		if err := emptyDir(compactionDir, true); err != nil {
-			errors.Join(ErrCompactionDB, err)
-		}
-		if err := os.Remove(compactionDir); err != nil {
-			errors.Join(ErrCompactionDB, err)
+		/* Only the leader touches memdbs + log and hands out sequence numbers, so mu can be released while writing */
+		db.mu.Unlock()
+		err = db.write(mems, log, group, seq, w.sync)
+		db.mu.Lock()
+		/* Entries are invisible to reads until the last sequence number is set */
+		if err == nil {
+			db.versions.SetLastSequence(seq + uint64(group.Len()) - 1)
 		}
 	}
+	db.finishBatchGroup(last, err)
+	return err
+}
 
-	if err := os.Rename(compactionDirTemp, compactionDir); err != nil {
-		return errors.Join(ErrCompactionDB, err)
+/*
+- Every entry must be for a column family which exists, merges for one with a merge operator
+- Must be called with mu held
+*/
+func (db *DB) validateColumnFamilies(batch *WriteBatch) error {
+	for _, entry := range batch.entries {
+		cf, ok := db.versions.families[entry.columnFamily]
+		if !ok {
+			return ErrColumnFamilyNotFound
+		}
+		if entry.valueType == common.TypeMerge && cf.opts.MergeOperator == nil {
+			return ErrNoMergeOperator
+		}
 	}
+	return nil
+}
 
-	if err = removeSSTFiles(db.dirName); err != nil {
-		return errors.Join(ErrCompactionDB, err)
+/* The memdb of every column family by ID - must be called with mu held */
+func (db *DB) memdbs() map[uint32]*memdb.MemDB {
+	mems := map[uint32]*memdb.MemDB{}
+	for id, cf := range db.versions.families {
+		mems[id] = cf.memdb
 	}
+	return mems
+}
 
-	db.sstables = []sstable.SSTableDB{}
-	db.compactSSTables, err = getExistingSSTables(compactionDir)
+/* Logs the batch and inserts each entry into the memdb of its column family, stamping the entries with sequence numbers starting at seq */
+func (db *DB) write(mems map[uint32]*memdb.MemDB, log *wal.WAL, batch *WriteBatch, seq uint64, sync bool) error {
+	data, err := batch.MarshalBinary()
 	if err != nil {
-		return errors.Join(ErrCompactionDB, err)
+		return errors.Join(ErrWALBATCH, err)
+	}
+	if err := log.Append(nil, data, wal.BATCH, seq); err != nil {
+		return errors.Join(ErrWALBATCH, err)
+	}
+	if sync {
+		if err := log.Sync(); err != nil {
+			return errors.Join(ErrWALSync, err)
+		}
 	}
 
+	for i, entry := range batch.entries {
+		/* The family was dropped after the batch was validated, the entry is logged but never read */
+		mem, ok := mems[entry.columnFamily]
+		if !ok {
+			continue
+		}
+		if err := mem.Add(seq+uint64(i), entry.valueType, entry.key, entry.val); err != nil {
+			return errors.Join(ErrMemDB, err)
+		}
+	}
 	return nil
 }
 
-func (db *DB) createCompactionFiles(compactionDir string, iter common.Iterator, sizePerFile uint64) error {
-	for iter.Key() != nil {
-		data, err := sstable.GetSSTableDataUntilLimit(iter, sstable.DEFAULTINDEXDISTANCE, sizePerFile)
-		if err != nil {
-			return errors.Join(ErrCompactionDB, err)
-		}
+/*
+- Writes SSTable data to the file with the given number and returns its metadata along with the opened table
+- Does not touch any DB state so it can be called without holding mu
+*/
+func (db *DB) writeSSTable(cf *columnFamily, number uint64, data []byte) (*FileMetadata, error) {
+	sstPath := sstFileName(db.dirName, number)
+	f, err := os.OpenFile(sstPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0777) /* TODO: use lesser permissions */
+	if err != nil {
+		return nil, errors.Join(ErrSSTableCreate, err)
+	}
+	defer f.Close()
 
-		/* If current level 0 sstables are named as 'sst1', 'sst2' .. these will be 'sst3', 'sst4' for now, then renamed as 'sst1', 'sst2'... */
-		filename, err := getNextSSTableName(compactionDir)
-		if err != nil {
-			return err
-		}
+	if _, err := f.Write(data); err != nil {
+		return nil, errors.Join(ErrSSTableCreate, err)
+	}
+	if err := f.Sync(); err != nil {
+		return nil, errors.Join(ErrSSTableCreate, err)
+	}
+	/* The MANIFEST is about to reference the table and the logs holding its data may be deleted, so its directory entry must survive a crash too */
+	if err := syncDir(db.dirName); err != nil {
+		return nil, errors.Join(ErrSSTableCreate, err)
+	}
 
-		sstPath := filepath.Join(compactionDir, filename)
-		f, err := os.OpenFile(sstPath, os.O_RDWR|os.O_CREATE, 0777) /* TODO: use lesser permissions */
-		if err != nil {
-			return errors.Join(ErrSSTableCreate, err)
-		}
-		defer f.Close()
+	/* Opening the table through the cache checks that it can be read back, and leaves it open for the reads that follow */
+	handle, err := db.tableCache.get(number, cf)
+	if err != nil {
+		return nil, errors.Join(ErrSSTableCreate, err)
+	}
+	defer db.tableCache.release(handle)
 
-		_, err = f.Write(data)
-		if err != nil {
-			return err
-		}
+	return &FileMetadata{number: number, size: handle.sst.Size(), smallest: handle.sst.SmallestKey(), largest: handle.sst.LargestKey()}, nil
+}
 
+/*
+- SSTables of a column family are keyed by its internal keys, their bloom filters hold user keys
+- All tables share the DB's namespace in the block cache, and are told apart by file number
+*/
+func (db *DB) sstableOptions(cf *columnFamily) sstable.Options {
+	return sstable.Options{
+		Comparator:           cf.icmp,
+		Compression:          cf.opts.Compression,
+		BlockRestartInterval: cf.opts.BlockRestartInterval,
+		FilterBitsPerKey:     cf.opts.FilterBitsPerKey,
+		FilterKey:            common.ExtractUserKey,
+		FilterKeyComparator:  cf.opts.Comparator,
+		FilterStats:          &db.filterStats,
+		BlockCache:           db.blockCache,
+		CacheNamespace:       db.cacheNamespace,
 	}
+}
 
-	return nil
+func (db *DB) openSSTable(number uint64, cf *columnFamily) (sstable.SSTableDB, error) {
+	opts := db.sstableOptions(cf)
+	opts.FileNumber = number
+	return sstable.OpenSSTableDBWithOptions(sstFileName(db.dirName, number), opts)
+}
 
+/* Cache of SSTable blocks used by the DB, which may be shared with other DBs (see Options.BlockCache) */
+func (db *DB) BlockCache() *cache.Cache {
+	return db.blockCache
 }
 
-/* Can we do this differently? */
-func (db *DB) Close() error {
-	return db.log.Close()
+/* Counts of how the bloom filters of all tables fared on lookups */
+func (db *DB) FilterStats() *sstable.FilterStats {
+	return &db.filterStats
 }
 
-/* Gets next SSTableName WRT 'dirName' inside the current directory */
-func getNextSSTableName(dirName string) (string, error) {
-	dirEntries, err := os.ReadDir(dirName)
+/*
+- Removes SSTables and MANIFESTs which are no longer part of the current version, along with logs whose data has been flushed
+- Must be called with mu held
+*/
+func (db *DB) deleteObsoleteFiles() error {
+	dirEntries, err := os.ReadDir(db.dirName)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	/* Grab all sst file names - we are sure that any 'DEFAULTSSTFILENAME' belongs to sst files only */
-	sstFileNames := []string{}
+	live := db.versions.liveFiles()
 	for _, dirEntry := range dirEntries {
-		if strings.HasPrefix(dirEntry.Name(), DEFAULTSSTFILENAME) {
-			sstFileNames = append(sstFileNames, dirEntry.Name())
+		fileType, number := parseFileName(dirEntry.Name())
+		keep := true
+		switch fileType {
+		case FILETYPESST:
+			keep = live[number] || db.pendingOutputs[number]
+		case FILETYPELOG:
+			keep = number >= db.versions.LogNumber() || number == db.logNumber
+		case FILETYPEMANIFEST:
+			keep = number == db.versions.ManifestNumber()
+		case FILETYPETEMP:
+			keep = false
 		}
-	}
 
-	curSSTFileIdx := len(sstFileNames) + 1
-	return fmt.Sprintf("%s%d", DEFAULTSSTFILENAME, curSSTFileIdx), nil
+		if !keep {
+			if fileType == FILETYPESST {
+				db.tableCache.evict(number)
+			}
+			if err := os.Remove(filepath.Join(db.dirName, dirEntry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-func getExistingSSTables(dirName string) (sstables []sstable.SSTableDB, err error) {
-	/* check if dir exists */
-	exists, err := fileOrDirExists(dirName)
-	if err != nil {
-		return nil, err
-	}
-	if !exists {
-		return []sstable.SSTableDB{}, nil
-	}
+func (db *DB) Delete(key []byte) error { // to modify in memdb
+	return db.DeleteWithOptions(key, WriteOptions{})
+}
 
-	dirEntries, err := os.ReadDir(dirName)
-	if err != nil {
-		return nil, err
-	}
+func (db *DB) DeleteWithOptions(key []byte, opts WriteOptions) error {
+	return db.DefaultColumnFamily().DeleteWithOptions(key, opts)
+}
 
-	/* Grab all sst file names - we are sure that any prefix '{DEFAULTSSTFILENAME}' belongs to sst files only */
-	sstFileNames := []string{}
-	for _, dirEntry := range dirEntries {
-		if strings.HasPrefix(dirEntry.Name(), DEFAULTSSTFILENAME) {
-			sstFileNames = append(sstFileNames, dirEntry.Name())
-		}
-	}
+func (db *DB) RangeScan(start, limit []byte) (common.Iterator, error) {
+	return db.RangeScanWithOptions(start, limit, ReadOptions{})
+}
 
-	for _, filename := range sstFileNames {
-		path := filepath.Join(dirName, filename)
-		sst, err := sstable.OpenSSTableDB(path)
-		if err != nil {
-			return nil, err
-		}
-		sstables = append(sstables, sst)
-	}
+/* The iterator sees the DB as it was when RangeScanWithOptions was called, or as of the snapshot in opts */
+func (db *DB) RangeScanWithOptions(start, limit []byte, opts ReadOptions) (common.Iterator, error) {
+	return db.DefaultColumnFamily().RangeScanWithOptions(start, limit, opts)
+}
 
-	return sstables, nil
+/* Waits for background work in progress to finish, data in memdbs which are not flushed yet remains in their logs */
+func (db *DB) Close() error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrDBClosed
+	}
+	db.closed = true
+	close(db.closing)
+	db.bgCond.Broadcast()
+
+	/* A leader waiting for room has been woken up and fails its group, wait for the leader appending to the log (if any) to finish */
+	for len(db.writers) > 0 {
+		db.bgCond.Wait()
+	}
+	db.mu.Unlock()
+	db.bgWG.Wait()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.tableCache.close()
+	return errors.Join(db.log.Close(), db.versions.Close())
 }
 
 func fileOrDirExists(path string) (bool, error) {
@@ -512,26 +745,3 @@ func emptyDir(dirName string, recurse bool) error {
 	}
 	return nil
 }
-
-func removeSSTFiles(dirName string) error {
-	dirEntries, err := os.ReadDir(dirName)
-	if err != nil {
-		return fmt.Errorf("error reading dir entries to empty %w", err)
-	}
-
-	for _, dirEntry := range dirEntries {
-		dirEntryPath := filepath.Join(dirName, dirEntry.Name())
-		info, err := os.Stat(dirEntryPath)
-		if err != nil {
-			return fmt.Errorf("error removing sst files from dir %s %w", dirName, err)
-		}
-
-		if !info.IsDir() && strings.HasPrefix(dirEntry.Name(), DEFAULTSSTFILENAME) {
-			err := os.Remove(dirEntryPath)
-			if err != nil {
-				return fmt.Errorf("error removing sst files from dir %s %w", dirName, err)
-			}
-		}
-	}
-	return nil
-}
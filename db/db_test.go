@@ -1,13 +1,19 @@
 package db
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/chettriyuvraj/leveldb-clone/cache"
 	"github.com/chettriyuvraj/leveldb-clone/common"
+	"github.com/chettriyuvraj/leveldb-clone/sstable"
 	"github.com/chettriyuvraj/leveldb-clone/test"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -17,13 +23,31 @@ var TESTDBCONFIG DBConfig = DBConfig{
 	createNew:  true, /* Each test will create a new db */
 }
 
-/* Workaround done exclusively to match signature with test suite */
+/* DB handed out by NewDBAsInterface, the test suite doesn't close the DBs it creates */
+var lastTestDB *DB
+
+/*
+- Workaround done exclusively to match signature with test suite
+- The previous DB is closed first, otherwise its background flushes/compactions would keep modifying the directory the new DB is created in
+*/
 func NewDBAsInterface() common.DB {
-	db, _ := NewDB(TESTDBCONFIG)
+	if lastTestDB != nil {
+		lastTestDB.Close()
+	}
+	db, err := NewDB(TESTDBCONFIG)
+	if err != nil {
+		panic(err)
+	}
+	lastTestDB = db
 	return db
 }
 
 func cleanupTestDB(t *testing.T) {
+	/* Background work of the last DB handed out would otherwise keep adding files while the directory is removed */
+	if lastTestDB != nil {
+		lastTestDB.Close()
+		lastTestDB = nil
+	}
 	exists, err := fileOrDirExists(TESTDBCONFIG.dirName)
 	require.NoError(t, err)
 	if exists {
@@ -73,7 +97,6 @@ func TestWAL(t *testing.T) {
 	/* Init db1 and populate */
 	db1, err := NewDB(TESTWALCONFIG)
 	require.NoError(t, err)
-	defer db1.Close()
 
 	for _, record := range records {
 		switch record.op {
@@ -86,12 +109,11 @@ func TestWAL(t *testing.T) {
 		}
 	}
 
-	/* Use the same WAL + retain SSTables */
+	/* Recover from the same WAL + retain SSTables */
+	require.NoError(t, db1.Close())
 	db2, err := NewDB(TESTWALCONFIG)
 	require.NoError(t, err)
 	defer db2.Close()
-	err = db2.Replay()
-	require.NoError(t, err)
 
 	tcs := []struct {
 		k, v   []byte
@@ -118,25 +140,6 @@ func TestWAL(t *testing.T) {
 	}
 }
 
-func TestGetNextSSTableName(t *testing.T) {
-	_, err := NewDB(TESTDBCONFIG)
-	require.NoError(t, err)
-	defer cleanupTestDB(t)
-	for i := 1; i <= 5; i++ {
-		/* Check if next sst filename for "test" directory correct - since dir is empty we should get "sst1", "sst2"...in order after creating each one */
-		filenameWant := fmt.Sprintf("%s%d", DEFAULTSSTFILENAME, i)
-		filenameGot, err := getNextSSTableName(TESTDBCONFIG.dirName)
-		require.NoError(t, err)
-		require.Equal(t, filenameWant, filenameGot)
-
-		/* Create the sst filename */
-		sstPath := filepath.Join(TESTDBCONFIG.dirName, filenameWant)
-		_, err = os.Create(sstPath)
-		require.NoError(t, err)
-		defer os.Remove(sstPath)
-	}
-}
-
 func TestSSTCompaction(t *testing.T) {
 	TESTCOMPACTIONCONFIG := DBConfig{
 		dirName:    TESTDBCONFIG.dirName,
@@ -235,3 +238,596 @@ func TestSSTCompaction(t *testing.T) {
 	}
 
 }
+
+func TestBackgroundFlush(t *testing.T) {
+	defer cleanupTestDB(t)
+
+	config := DBConfig{dirName: TESTDBCONFIG.dirName, memdbLimit: 13, createNew: true}
+	db, err := NewDB(config)
+	require.NoError(t, err)
+	defer db.Close()
+
+	/* Every key must stay readable while its memdb moves to imm -> level 0 -> lower levels */
+	for i := 1; i <= 50; i++ {
+		k, v := []byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i))
+		require.NoError(t, db.Put(k, v))
+		for j := 1; j <= i; j++ {
+			v, err := db.Get([]byte(fmt.Sprintf("key%d", j)))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("val%d", j)), v)
+		}
+	}
+	require.NoError(t, db.waitForBackgroundWork())
+	require.Nil(t, db.versions.defaultColumnFamily().imm)
+	require.NotEmpty(t, db.versions.defaultColumnFamily().current.liveFiles())
+
+	/* Only the log backing the current memdb remains */
+	entries, err := os.ReadDir(config.dirName)
+	require.NoError(t, err)
+	logs := []uint64{}
+	for _, entry := range entries {
+		if fileType, number := parseFileName(entry.Name()); fileType == FILETYPELOG {
+			logs = append(logs, number)
+		}
+	}
+	require.Equal(t, []uint64{db.logNumber}, logs)
+}
+
+/* Meant to be run with -race: concurrent readers and writers while flushes + compactions run in the background */
+func TestConcurrentReadWrite(t *testing.T) {
+	defer cleanupTestDB(t)
+
+	config := NewDBConfigWithOptions(60, true, TESTDBCONFIG.dirName, TESTLEVELEDOPTIONS)
+	db, err := NewDB(config)
+	require.NoError(t, err)
+	defer db.Close()
+
+	/* Each writer owns a set of keys, values always start with the key they belong to */
+	const writers, readers, keysPerWriter, rounds = 4, 4, 25, 4
+	key := func(w, i int) []byte { return []byte(fmt.Sprintf("w%d-key%02d", w, i)) }
+	val := func(w, i, round int) []byte { return []byte(fmt.Sprintf("w%d-key%02d-round%d", w, i, round)) }
+
+	writersWG, readersWG := sync.WaitGroup{}, sync.WaitGroup{}
+	done := make(chan struct{})
+	for w := 0; w < writers; w++ {
+		writersWG.Add(1)
+		go func(w int) {
+			defer writersWG.Done()
+			for round := 0; round < rounds; round++ {
+				for i := 0; i < keysPerWriter; i++ {
+					assert.NoError(t, db.Put(key(w, i), val(w, i, round)))
+				}
+				/* Odd keys are deleted at the end of every round but the last */
+				if round < rounds-1 {
+					for i := 1; i < keysPerWriter; i += 2 {
+						assert.NoError(t, db.Delete(key(w, i)))
+					}
+				}
+			}
+		}(w)
+	}
+
+	for r := 0; r < readers; r++ {
+		readersWG.Add(1)
+		go func(r int) {
+			defer readersWG.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				k := key(i%writers, (i+r)%keysPerWriter)
+				v, err := db.Get(k)
+				if err != nil {
+					assert.ErrorIs(t, err, common.ErrKeyDoesNotExist)
+				} else {
+					assert.True(t, bytes.HasPrefix(v, k), "value %s does not belong to key %s", v, k)
+				}
+
+				iter, err := db.RangeScan(key(r%writers, 0), key(r%writers, keysPerWriter))
+				if !assert.NoError(t, err) {
+					return
+				}
+				var prev []byte
+				for ; iter.Key() != nil; iter.Next() {
+					assert.True(t, bytes.HasPrefix(iter.Value(), iter.Key()), "value %s does not belong to key %s", iter.Value(), iter.Key())
+					assert.Less(t, bytes.Compare(prev, iter.Key()), 0)
+					prev = iter.Key()
+				}
+			}
+		}(r)
+	}
+
+	writersWG.Wait()
+	close(done)
+	readersWG.Wait()
+	require.NoError(t, db.waitForBackgroundWork())
+
+	/* Every key holds the value of the last round */
+	for w := 0; w < writers; w++ {
+		for i := 0; i < keysPerWriter; i++ {
+			v, err := db.Get(key(w, i))
+			require.NoError(t, err)
+			require.Equal(t, val(w, i, rounds-1), v)
+		}
+	}
+
+	/* Every reader has released the tables it used, only the table cache holds them now */
+	requireTablesReleased(t, db)
+}
+
+func requireTablesReleased(t *testing.T, db *DB) {
+	db.tableCache.mu.Lock()
+	defer db.tableCache.mu.Unlock()
+	require.LessOrEqual(t, db.tableCache.lru.Len(), db.opts.MaxOpenFiles)
+	for _, elem := range db.tableCache.tables {
+		require.Equal(t, 1, elem.Value.(*tableHandle).refs)
+	}
+}
+
+func TestNewestVersionWins(t *testing.T) {
+	defer cleanupTestDB(t)
+
+	/* Keep every flush in level 0 so that each key has versions spread across overlapping tables */
+	opts := Options{Level0CompactionTrigger: 100, Level0StopWritesTrigger: 200}
+	config := NewDBConfigWithOptions(20, true, TESTDBCONFIG.dirName, opts)
+	db, err := NewDB(config)
+	require.NoError(t, err)
+
+	const keys, rounds = 5, 6
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%d", i)) }
+	val := func(i, round int) []byte { return []byte(fmt.Sprintf("val%d-%d", i, round)) }
+	for round := 0; round < rounds; round++ {
+		for i := 0; i < keys; i++ {
+			require.NoError(t, db.Put(key(i), val(i, round)))
+		}
+	}
+	require.NoError(t, db.Delete(key(0)))
+	require.NoError(t, db.waitForBackgroundWork())
+	require.Greater(t, len(db.versions.defaultColumnFamily().current.Files(0)), 1)
+
+	check := func(db *DB) {
+		_, err := db.Get(key(0))
+		require.ErrorIs(t, err, common.ErrKeyDoesNotExist)
+		for i := 1; i < keys; i++ {
+			v, err := db.Get(key(i))
+			require.NoError(t, err)
+			require.Equal(t, val(i, rounds-1), v)
+		}
+
+		iter, err := db.RangeScan(key(0), key(keys))
+		require.NoError(t, err)
+		for i := 1; i < keys; i++ {
+			require.Equal(t, key(i), iter.Key())
+			require.Equal(t, val(i, rounds-1), iter.Value())
+			iter.Next()
+		}
+		require.Nil(t, iter.Key())
+	}
+	check(db)
+
+	/* Sequence numbers survive a restart, so newer writes keep shadowing older ones */
+	lastSequence := db.versions.LastSequence()
+	require.NoError(t, db.Close())
+	config.createNew = false
+	db, err = NewDB(config)
+	require.NoError(t, err)
+	defer db.Close()
+	require.GreaterOrEqual(t, db.versions.LastSequence(), lastSequence)
+	check(db)
+}
+
+func TestRangeScanAcrossLevels(t *testing.T) {
+	defer cleanupTestDB(t)
+
+	config := NewDBConfigWithOptions(30, true, TESTDBCONFIG.dirName, TESTLEVELEDOPTIONS)
+	db, err := NewDB(config)
+	require.NoError(t, err)
+	defer db.Close()
+
+	/* Older values + deletes get pushed down to deeper levels, while newer ones stay in level 0 and memdb */
+	const keys = 150
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	want := map[string]string{}
+	for i := 0; i < 2*keys; i++ {
+		k, v := key(i%keys), []byte(fmt.Sprintf("val%03d", i))
+		require.NoError(t, db.Put(k, v))
+		want[string(k)] = string(v)
+	}
+	for i := 0; i < keys; i += 10 {
+		require.NoError(t, db.Delete(key(i)))
+		delete(want, string(key(i)))
+	}
+	require.NoError(t, db.waitForBackgroundWork())
+	current := db.versions.defaultColumnFamily().current
+	require.NotEmpty(t, current.Files(current.NumLevels()-1), "data should have reached the last level")
+	for i := 0; i < keys; i += 7 {
+		k, v := key(i), []byte(fmt.Sprintf("newval%03d", i))
+		require.NoError(t, db.Put(k, v))
+		want[string(k)] = string(v)
+	}
+
+	tcs := []struct {
+		name       string
+		start, end int
+	}{
+		{name: "entire key space", start: 0, end: keys},
+		{name: "range starting + ending within tables", start: 33, end: 111},
+		{name: "single key", start: 42, end: 42},
+		{name: "deleted key only", start: 50, end: 50},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			iter, err := db.RangeScan(key(tc.start), key(tc.end))
+			require.NoError(t, err)
+			for i := tc.start; i <= tc.end; i++ {
+				v, ok := want[string(key(i))]
+				if !ok {
+					continue
+				}
+				require.Equal(t, key(i), iter.Key())
+				require.Equal(t, []byte(v), iter.Value())
+				iter.Next()
+			}
+			require.Nil(t, iter.Key())
+			require.NoError(t, iter.Error())
+		})
+	}
+
+	iter, err := NewFullMergeIterator(db)
+	require.NoError(t, err)
+	got := map[string]string{}
+	for ; iter.Key() != nil; iter.Next() {
+		got[string(iter.Key())] = string(iter.Value())
+	}
+	require.NoError(t, iter.Error())
+	require.Equal(t, want, got)
+}
+
+func TestFilterStats(t *testing.T) {
+	defer cleanupTestDB(t)
+
+	/* Keep every flush in level 0 so that a lookup consults the filter of every table */
+	opts := Options{Level0CompactionTrigger: 100, Level0StopWritesTrigger: 200}
+	db, err := NewDB(NewDBConfigWithOptions(30, true, TESTDBCONFIG.dirName, opts))
+	require.NoError(t, err)
+	defer db.Close()
+
+	const keys = 100
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	for i := 0; i < keys; i += 2 {
+		require.NoError(t, db.Put(key(i), key(i)))
+	}
+	require.NoError(t, db.waitForBackgroundWork())
+	require.Greater(t, len(db.versions.defaultColumnFamily().current.Files(0)), 1)
+
+	/* Odd keys fall within the key range of a table without being in it, the filter rules that table out */
+	for i := 0; i < keys; i++ {
+		_, err := db.Get(key(i))
+		if i%2 == 0 {
+			require.NoError(t, err)
+			continue
+		}
+		require.ErrorIs(t, err, common.ErrKeyDoesNotExist)
+	}
+	stats := db.FilterStats()
+	require.Greater(t, stats.Useful(), uint64(keys/10))
+	require.Less(t, stats.FalsePositive(), stats.Useful())
+}
+
+func TestSharedBlockCache(t *testing.T) {
+	blockCache := cache.NewLRUCache(1 << 20)
+	opts := Options{Level0CompactionTrigger: 100, Level0StopWritesTrigger: 200, BlockCache: blockCache}
+
+	/* Both DBs number their files the same way, the cache must keep their blocks apart */
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	val := func(d, i int) []byte { return []byte(fmt.Sprintf("db%d-val%03d", d, i)) }
+	const keys = 20
+	dbs := []*DB{}
+	for d := 0; d < 2; d++ {
+		db, err := NewDB(NewDBConfigWithOptions(30, true, t.TempDir(), opts))
+		require.NoError(t, err)
+		defer db.Close()
+		for i := 0; i < keys; i++ {
+			require.NoError(t, db.Put(key(i), val(d, i)))
+		}
+		require.NoError(t, db.waitForBackgroundWork())
+		require.Equal(t, blockCache, db.BlockCache())
+		dbs = append(dbs, db)
+	}
+
+	for round := 0; round < 2; round++ {
+		hits := blockCache.Hits()
+		for d, db := range dbs {
+			for i := 0; i < keys; i++ {
+				v, err := db.Get(key(i))
+				require.NoError(t, err)
+				require.Equal(t, val(d, i), v)
+			}
+		}
+		/* Blocks read in the first round are served from the cache in the second */
+		if round == 1 {
+			require.Greater(t, blockCache.Hits(), hits)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	dirName := t.TempDir()
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	val := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id": %d, "name": "user", "email": "user@example.com"}`, i))
+	}
+
+	/* Tables written with one compression stay readable after reopening the DB with another */
+	const keys = 200
+	for round, compression := range []sstable.CompressionType{sstable.SnappyCompression, sstable.FlateCompression} {
+		opts := Options{Compression: compression, BlockSize: 256}
+		db, err := NewDB(NewDBConfigWithOptions(1000, round == 0, dirName, opts))
+		require.NoError(t, err)
+		for i := round; i < keys; i += 2 {
+			require.NoError(t, db.Put(key(i), val(i)))
+		}
+		require.NoError(t, db.waitForBackgroundWork())
+
+		for i := 0; i < keys; i++ {
+			v, err := db.Get(key(i))
+			if i%2 > round {
+				require.ErrorIs(t, err, common.ErrKeyDoesNotExist)
+				continue
+			}
+			require.NoError(t, err)
+			require.Equal(t, val(i), v)
+		}
+		require.NoError(t, db.Close())
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	dirName := t.TempDir()
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	val := func(i int) []byte { return []byte(fmt.Sprintf("val%03d", i)) }
+	const keys = 100
+	/* Tables hold many small blocks, so the value checked isn't in the first block of its table - which is always verified when the table is opened */
+	opts := Options{BlockSize: 64}
+	db, err := NewDB(NewDBConfigWithOptions(1000, true, dirName, opts))
+	require.NoError(t, err)
+	for i := 0; i < keys; i++ {
+		require.NoError(t, db.Put(key(i), val(i)))
+	}
+	require.NoError(t, db.waitForBackgroundWork())
+	require.NoError(t, db.Close())
+
+	/* Flip a bit in the SSTable holding a value, reading it with VerifyChecksums must report where the corruption is */
+	dirEntries, err := os.ReadDir(dirName)
+	require.NoError(t, err)
+	corruptFile := ""
+	for _, dirEntry := range dirEntries {
+		if fileType, _ := parseFileName(dirEntry.Name()); fileType != FILETYPESST {
+			continue
+		}
+		filename := filepath.Join(dirName, dirEntry.Name())
+		data, err := os.ReadFile(filename)
+		require.NoError(t, err)
+		if i := bytes.Index(data, val(keys/2)); i >= 0 {
+			data[i] ^= 1
+			require.NoError(t, os.WriteFile(filename, data, 0644))
+			corruptFile = filename
+		}
+	}
+	require.NotEmpty(t, corruptFile)
+
+	db, err = NewDB(NewDBConfigWithOptions(1000, false, dirName, opts))
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.GetWithOptions(key(keys/2), ReadOptions{VerifyChecksums: true})
+	corruption := &sstable.ErrCorruption{}
+	require.ErrorAs(t, err, &corruption)
+	require.ErrorIs(t, err, sstable.ErrChecksumMismatch)
+	require.Equal(t, corruptFile, corruption.File)
+
+	/* Without verification the corrupt value is returned as is, other blocks are unaffected */
+	v, err := db.Get(key(keys / 2))
+	require.NoError(t, err)
+	require.NotEqual(t, val(keys/2), v)
+	v, err = db.GetWithOptions(key(0), ReadOptions{VerifyChecksums: true})
+	require.NoError(t, err)
+	require.Equal(t, val(0), v)
+}
+
+func TestSyncedWrites(t *testing.T) {
+	dirName := t.TempDir()
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	val := func(i int) []byte { return []byte(fmt.Sprintf("val%03d", i)) }
+
+	/* Writes synced one by one, by the DB default and in the background all make it to the WAL */
+	const keys = 30
+	db, err := NewDB(NewDBConfigWithOptions(1000, true, dirName, Options{SyncInterval: time.Millisecond}))
+	require.NoError(t, err)
+	for i := 0; i < keys; i++ {
+		require.NoError(t, db.PutWithOptions(key(i), val(i), WriteOptions{Sync: i%3 == 1}))
+		if i%3 == 0 {
+			require.NoError(t, db.DeleteWithOptions(key(i), WriteOptions{Sync: true}))
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, db.Close())
+
+	db, err = NewDB(NewDBConfigWithOptions(1000, false, dirName, Options{Sync: true}))
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Put(key(keys), val(keys)))
+	for i := 0; i <= keys; i++ {
+		v, err := db.Get(key(i))
+		if i%3 == 0 && i != keys {
+			require.ErrorIs(t, err, common.ErrKeyDoesNotExist)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, val(i), v)
+	}
+}
+
+func TestInterruptedFlush(t *testing.T) {
+	dirName := t.TempDir()
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	val := func(i int) []byte { return []byte(fmt.Sprintf("val%03d", i)) }
+
+	const keys = 20
+	db, err := NewDB(NewDBConfigWithOptions(1<<20, true, dirName, Options{}))
+	require.NoError(t, err)
+	for i := 0; i < keys; i++ {
+		require.NoError(t, db.Put(key(i), val(i)))
+	}
+	logNumber := db.logNumber
+	require.NoError(t, db.Close())
+
+	/* A flush which crashed after writing its table but before recording it in the MANIFEST leaves the table behind, and the WAL in place */
+	leftover := sstFileName(dirName, 999)
+	require.NoError(t, os.WriteFile(leftover, []byte("partially written table"), 0644))
+
+	db, err = NewDB(NewDBConfigWithOptions(100, false, dirName, Options{}))
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = os.Stat(leftover)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	for i := 0; i < keys; i++ {
+		v, err := db.Get(key(i))
+		require.NoError(t, err)
+		require.Equal(t, val(i), v)
+	}
+
+	/* Recovery flushed the old WAL, so it is gone and nothing was logged again */
+	_, err = os.Stat(logFileName(dirName, logNumber))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.Greater(t, db.versions.LogNumber(), logNumber)
+	require.Zero(t, db.versions.defaultColumnFamily().memdb.Size())
+	require.NotEmpty(t, db.versions.defaultColumnFamily().current.Files(0))
+}
+
+func TestEmptyValues(t *testing.T) {
+	dirName := t.TempDir()
+	key := func(i int) []byte { return []byte(fmt.Sprintf("member%03d", i)) }
+
+	/* Every key is a set membership marker with an empty value, every third one is removed from the set again */
+	const keys = 60
+	check := func(db *DB) {
+		for i := 0; i < keys; i++ {
+			v, err := db.Get(key(i))
+			has, hasErr := db.Has(key(i))
+			require.NoError(t, hasErr)
+			if i%3 == 0 {
+				require.ErrorIs(t, err, common.ErrKeyDoesNotExist)
+				require.False(t, has)
+				continue
+			}
+			require.NoError(t, err)
+			require.Empty(t, v)
+			require.True(t, has)
+		}
+
+		iter, err := db.RangeScan(key(0), key(keys))
+		require.NoError(t, err)
+		scanned := 0
+		for ; iter.Key() != nil; iter.Next() {
+			require.Empty(t, iter.Value())
+			scanned++
+		}
+		require.Equal(t, keys-keys/3, scanned)
+	}
+
+	/* Values stay empty (not deleted) in memdb, through flushes + compactions and after recovery */
+	db, err := NewDB(NewDBConfigWithOptions(100, true, dirName, TESTLEVELEDOPTIONS))
+	require.NoError(t, err)
+	for i := 0; i < keys; i++ {
+		require.NoError(t, db.Put(key(i), []byte{}))
+	}
+	for i := 0; i < keys; i += 3 {
+		require.NoError(t, db.Delete(key(i)))
+	}
+	check(db)
+	require.NoError(t, db.waitForBackgroundWork())
+	check(db)
+	require.NoError(t, db.Close())
+
+	db, err = NewDB(NewDBConfigWithOptions(100, false, dirName, TESTLEVELEDOPTIONS))
+	require.NoError(t, err)
+	defer db.Close()
+	check(db)
+}
+
+/* Orders user keys in reverse */
+type reverseComparator struct{}
+
+func (reverseComparator) Compare(a, b []byte) int { return bytes.Compare(b, a) }
+
+func (reverseComparator) Name() string { return "test.ReverseComparator" }
+
+func (reverseComparator) FindShortestSeparator(start, limit []byte) []byte { return start }
+
+func (reverseComparator) FindShortSuccessor(key []byte) []byte { return key }
+
+func TestCustomComparator(t *testing.T) {
+	dirName := t.TempDir()
+	opts := TESTLEVELEDOPTIONS
+	opts.Comparator = reverseComparator{}
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+
+	/* Keys are read back in the comparator's order from memdb, level 0 and deeper levels alike */
+	const keys = 150
+	check := func(db *DB) {
+		for i := 0; i < keys; i++ {
+			v, err := db.Get(key(i))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("val%03d", i)), v)
+		}
+
+		fullIter, err := NewFullMergeIterator(db)
+		require.NoError(t, err)
+		for i := keys - 1; i >= 0; i-- {
+			require.Equal(t, key(i), fullIter.Key())
+			fullIter.Next()
+		}
+		require.Nil(t, fullIter.Key())
+
+		/* Ranges run from the larger key to the smaller one, a nil limit scans to the end */
+		iter, err := db.RangeScan(key(100), key(90))
+		require.NoError(t, err)
+		for i := 100; i >= 90; i-- {
+			require.Equal(t, key(i), iter.Key())
+			iter.Next()
+		}
+		require.Nil(t, iter.Key())
+		iter, err = db.RangeScan(key(10), nil)
+		require.NoError(t, err)
+		for i := 10; i >= 0; i-- {
+			require.Equal(t, key(i), iter.Key())
+			iter.Next()
+		}
+		require.Nil(t, iter.Key())
+		_, err = db.RangeScan(key(90), key(100))
+		require.ErrorIs(t, err, common.ErrInvalidRange)
+	}
+
+	db, err := NewDB(NewDBConfigWithOptions(100, true, dirName, opts))
+	require.NoError(t, err)
+	for i := 0; i < keys; i++ {
+		require.NoError(t, db.Put(key(i), []byte(fmt.Sprintf("val%03d", i))))
+	}
+	check(db)
+	require.NoError(t, db.waitForBackgroundWork())
+	current := db.versions.defaultColumnFamily().current
+	require.NotEmpty(t, current.Files(current.NumLevels()-1), "data should have reached the last level")
+	check(db)
+	require.NoError(t, db.Close())
+
+	/* The DB can't be opened with a different ordering, only with the same comparator */
+	_, err = NewDB(NewDBConfigWithOptions(100, false, dirName, TESTLEVELEDOPTIONS))
+	require.ErrorIs(t, err, ErrComparatorMismatch)
+	db, err = NewDB(NewDBConfigWithOptions(100, false, dirName, opts))
+	require.NoError(t, err)
+	defer db.Close()
+	check(db)
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	FILETYPEUNKNOWN = iota
+	FILETYPESST
+	FILETYPELOG
+	FILETYPEMANIFEST
+	FILETYPECURRENT
+	FILETYPETEMP
+)
+
+var ErrNoCurrentFile = errors.New("CURRENT file does not exist")
+var ErrInvalidCurrentFile = errors.New("CURRENT file does not point to a valid MANIFEST")
+
+/* All files that belong to the DB are numbered using a single monotonically increasing counter held by the version set */
+func sstFileName(dirName string, number uint64) string {
+	return filepath.Join(dirName, fmt.Sprintf("%06d.%s", number, DEFAULTSSTFILEEXT))
+}
+
+func logFileName(dirName string, number uint64) string {
+	return filepath.Join(dirName, fmt.Sprintf("%06d.%s", number, DEFAULTWALFILEEXT))
+}
+
+func manifestFileName(dirName string, number uint64) string {
+	return filepath.Join(dirName, fmt.Sprintf("%s-%06d", DEFAULTMANIFESTPREFIX, number))
+}
+
+func currentFileName(dirName string) string {
+	return filepath.Join(dirName, DEFAULTCURRENTFILENAME)
+}
+
+/* Parses a file name inside the DB directory into its type and number (if any) */
+func parseFileName(name string) (fileType int, number uint64) {
+	switch {
+	case name == DEFAULTCURRENTFILENAME:
+		return FILETYPECURRENT, 0
+	case strings.HasSuffix(name, DEFAULTTEMPFILEEXT):
+		return FILETYPETEMP, 0
+	case strings.HasPrefix(name, DEFAULTMANIFESTPREFIX+"-"):
+		num, err := strconv.ParseUint(strings.TrimPrefix(name, DEFAULTMANIFESTPREFIX+"-"), 10, 64)
+		if err != nil {
+			return FILETYPEUNKNOWN, 0
+		}
+		return FILETYPEMANIFEST, num
+	case strings.HasSuffix(name, "."+DEFAULTSSTFILEEXT):
+		num, err := strconv.ParseUint(strings.TrimSuffix(name, "."+DEFAULTSSTFILEEXT), 10, 64)
+		if err != nil {
+			return FILETYPEUNKNOWN, 0
+		}
+		return FILETYPESST, num
+	case strings.HasSuffix(name, "."+DEFAULTWALFILEEXT):
+		num, err := strconv.ParseUint(strings.TrimSuffix(name, "."+DEFAULTWALFILEEXT), 10, 64)
+		if err != nil {
+			return FILETYPEUNKNOWN, 0
+		}
+		return FILETYPELOG, num
+	}
+	return FILETYPEUNKNOWN, 0
+}
+
+/* Points CURRENT to the given manifest - written to a temp file first and renamed so the switch is atomic */
+func setCurrentFile(dirName string, manifestNumber uint64) error {
+	tempPath := filepath.Join(dirName, DEFAULTCURRENTFILENAME+DEFAULTTEMPFILEEXT)
+	contents := filepath.Base(manifestFileName(dirName, manifestNumber)) + "\n"
+
+	f, err := os.OpenFile(tempPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(contents); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tempPath, currentFileName(dirName)); err != nil {
+		return err
+	}
+	/* Persists the rename, along with the entry of the manifest CURRENT now points to */
+	return syncDir(dirName)
+}
+
+/* Syncs the directory itself, so that files created in (or renamed into) it survive a crash */
+func syncDir(dirName string) error {
+	dir, err := os.Open(dirName)
+	if err != nil {
+		return err
+	}
+	return errors.Join(dir.Sync(), dir.Close())
+}
+
+/* Reads CURRENT and returns the number of the manifest it points to */
+func readCurrentFile(dirName string) (manifestNumber uint64, err error) {
+	data, err := os.ReadFile(currentFileName(dirName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, ErrNoCurrentFile
+		}
+		return 0, err
+	}
+
+	name := strings.TrimSuffix(string(data), "\n")
+	fileType, number := parseFileName(name)
+	if fileType != FILETYPEMANIFEST {
+		return 0, ErrInvalidCurrentFile
+	}
+	return number, nil
+}
@@ -1,34 +1,34 @@
 package db
 
 import (
-	"bytes"
+	"github.com/chettriyuvraj/leveldb-clone/common"
 )
 
-type Record struct {
-	key, value []byte
+/* Iterators keyed by internal keys, ordered by their current key using icmp - exhausted iterators are never pushed */
+type IterHeap struct {
+	iters []common.Iterator
+	icmp  *common.InternalKeyComparator
 }
 
-type RecordHeap []*Record
+func (h IterHeap) Len() int { return len(h.iters) }
 
-func (h RecordHeap) Len() int { return len(h) }
+func (h IterHeap) Less(i, j int) bool { return h.icmp.Compare(h.iters[i].Key(), h.iters[j].Key()) < 0 }
 
-func (h RecordHeap) Less(i, j int) bool { return bytes.Compare(h[i].key, h[j].key) < 0 }
+func (h IterHeap) Swap(i, j int) { h.iters[i], h.iters[j] = h.iters[j], h.iters[i] }
 
-func (h RecordHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
-
-func (h RecordHeap) Elem(i int) Record {
-	return *h[i]
+func (h IterHeap) Elem(i int) common.Iterator {
+	return h.iters[i]
 }
 
-func (h *RecordHeap) Push(x any) {
-	record := x.(Record)
-	*h = append(*h, &record)
+func (h *IterHeap) Push(x any) {
+	iter := x.(common.Iterator)
+	h.iters = append(h.iters, iter)
 }
 
-func (h *RecordHeap) Pop() any {
-	old := *h
+func (h *IterHeap) Pop() any {
+	old := h.iters
 	n := len(old)
 	x := old[n-1]
-	*h = old[0 : n-1]
+	h.iters = old[0 : n-1]
 	return x
 }
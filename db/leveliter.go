@@ -0,0 +1,140 @@
+package db
+
+import (
+	"sort"
+
+	"github.com/chettriyuvraj/leveldb-clone/common"
+	"github.com/chettriyuvraj/leveldb-clone/sstable"
+)
+
+/*
+- Iterates the tables of a level > 0 one after the other, tables in these levels don't overlap and are sorted by key so this yields the level in order
+- Only the table currently being read is held open, the next one is fetched from the table cache once it is exhausted
+- A nil startKey/limitKey (user keys) leaves that end of the range open
+*/
+type levelIterator struct {
+	tc                 *tableCache
+	cf                 *columnFamily
+	ucmp               common.Comparator
+	files              []*FileMetadata
+	startKey, limitKey []byte
+	ro                 sstable.ReadOptions
+	idx                int /* Index of the file being read, len(files) once exhausted */
+	cur                *tableIterator
+	err                error
+}
+
+func newLevelIterator(tc *tableCache, cf *columnFamily, files []*FileMetadata, startKey, limitKey []byte, ro sstable.ReadOptions) (*levelIterator, error) {
+	/* First table which may contain keys >= startKey */
+	ucmp := cf.opts.Comparator
+	idx := 0
+	if startKey != nil {
+		idx = sort.Search(len(files), func(i int) bool { return ucmp.Compare(common.ExtractUserKey(files[i].largest), startKey) >= 0 })
+	}
+
+	iter := &levelIterator{tc: tc, cf: cf, ucmp: ucmp, files: files, startKey: startKey, limitKey: limitKey, ro: ro, idx: idx}
+	if err := iter.openTable(); err != nil {
+		return nil, err
+	}
+	return iter, nil
+}
+
+/* Opens an iterator on the table at idx, moving on to the following tables until one has an entry in range */
+func (iter *levelIterator) openTable() error {
+	for ; iter.idx < len(iter.files); iter.idx++ {
+		file := iter.files[iter.idx]
+		if iter.limitKey != nil && iter.ucmp.Compare(common.ExtractUserKey(file.smallest), iter.limitKey) > 0 {
+			break
+		}
+
+		handle, err := iter.tc.get(file.number, iter.cf)
+		if err != nil {
+			iter.err = err
+			return err
+		}
+
+		startIKey, limitIKey := tableRange(file, iter.startKey, iter.limitKey)
+		iter.cur, err = newTableIterator(iter.tc, handle, startIKey, limitIKey, iter.ro)
+		if err != nil {
+			iter.err = err
+			return err
+		}
+		if err := iter.cur.Error(); err != nil {
+			iter.cur.Close()
+			iter.err = err
+			return err
+		}
+		if iter.cur.Key() != nil {
+			return nil
+		}
+	}
+
+	iter.idx, iter.cur = len(iter.files), nil
+	return nil
+}
+
+func (iter *levelIterator) Next() bool {
+	if iter.cur == nil || iter.err != nil {
+		return false
+	}
+	if iter.cur.Next() {
+		return true
+	}
+	if err := iter.cur.Error(); err != nil {
+		iter.err = err
+		return false
+	}
+
+	iter.idx++
+	if err := iter.openTable(); err != nil {
+		return false
+	}
+	return iter.cur != nil
+}
+
+func (iter *levelIterator) Key() []byte {
+	if iter.cur == nil || iter.err != nil {
+		return nil
+	}
+	return iter.cur.Key()
+}
+
+func (iter *levelIterator) Value() []byte {
+	if iter.cur == nil || iter.err != nil {
+		return nil
+	}
+	return iter.cur.Value()
+}
+
+func (iter *levelIterator) Error() error {
+	return iter.err
+}
+
+/* Releases the table being read */
+func (iter *levelIterator) Close() error {
+	if iter.cur != nil {
+		iter.cur.Close()
+		iter.cur = nil
+	}
+	iter.idx = len(iter.files)
+	return nil
+}
+
+/*
+- Internal key range of the table 'file' covering user keys [startKey, limitKey], nil + nil if both are nil i.e. the whole table
+- Every version of startKey sorts after the first internal key and every version of limitKey before the last one
+- An open end is bounded by the table's own smallest/largest key, since no user key is known to sort before/after every other under the comparator
+*/
+func tableRange(file *FileMetadata, startKey, limitKey []byte) (startIKey, limitIKey []byte) {
+	if startKey == nil && limitKey == nil {
+		return nil, nil
+	}
+	startIKey, limitIKey = file.smallest, file.largest
+	if startKey != nil {
+		startIKey = common.MakeInternalKey(startKey, common.MaxSequenceNumber, common.ValueTypeForSeek)
+	}
+	if limitKey != nil {
+		limitIKey = common.MakeInternalKey(limitKey, 0, common.TypeDeletion)
+	}
+	return startIKey, limitIKey
+}
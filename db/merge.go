@@ -0,0 +1,90 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/chettriyuvraj/leveldb-clone/common"
+)
+
+var ErrNoMergeOperator = errors.New("merge requires Options.MergeOperator to be set")
+var ErrMerge = errors.New("error merging operands")
+
+/*
+- Combines merge operands written with DB.Merge into a value, so a read-modify-write (e.g. incrementing a counter, appending to a list) is a single blind write
+- FullMerge merges the operands into the value they were written over, existing is nil if there is none (the key was never written, or was deleted) - an empty value is passed as a non-nil empty slice
+- PartialMerge combines two consecutive operands into one without knowing the value below them, left being the older one - it returns false if they can't be combined
+- Operands are passed oldest first and are only merged when the key is read or compacted, so the operator must stay the same every time the DB is opened
+- Neither method may modify or hold on to the slices passed in, an error from FullMerge fails the read/compaction which needed the value
+*/
+type MergeOperator interface {
+	FullMerge(key, existing []byte, operands [][]byte) ([]byte, error)
+	PartialMerge(key, left, right []byte) ([]byte, bool)
+}
+
+/* A merge operand along with its internal key */
+type mergeOperand struct {
+	key, val []byte
+}
+
+/*
+- Collects the merge operands of userKey newest first, from the entries peek returns until a value, a deletion or another user key is reached
+- advance moves past the entry peek returned, entries with a sequence number larger than seq are skipped
+- base is the value or deletion which ended the operands as it is stored, nil if they ended at another key or the end of the entries
+*/
+func collectOperands(peek func() (key, val []byte), advance func(), ucmp common.Comparator, userKey []byte, seq uint64) (operands []mergeOperand, base *mergeOperand, err error) {
+	for {
+		key, val := peek()
+		if key == nil {
+			return operands, nil, nil
+		}
+		entryKey, entrySeq, valueType, err := common.ParseInternalKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ucmp.Compare(entryKey, userKey) != 0 {
+			return operands, nil, nil
+		}
+		advance()
+		if entrySeq > seq {
+			continue
+		}
+
+		if valueType == common.TypeMerge {
+			operands = append(operands, mergeOperand{key: key, val: val})
+			continue
+		}
+		return operands, &mergeOperand{key: key, val: val}, nil
+	}
+}
+
+/* The value operands are merged into given the base below them at time now, nil if there is none, it is a deletion or it has expired */
+func baseValue(base *mergeOperand, now int64) ([]byte, error) {
+	if base == nil {
+		return nil, nil
+	}
+	_, _, valueType, err := common.ParseInternalKey(base.key)
+	if err != nil {
+		return nil, err
+	}
+	if valueType == common.TypeDeletion {
+		return nil, nil
+	}
+	val, expired, err := resolveExpiry(valueType, base.val, now)
+	if err != nil || expired {
+		return nil, err
+	}
+	return append([]byte{}, val...), nil
+}
+
+/* Merges operands (newest first, as they are read) into existing */
+func fullMerge(op MergeOperator, key, existing []byte, operands []mergeOperand) ([]byte, error) {
+	oldestFirst := make([][]byte, len(operands))
+	for i, operand := range operands {
+		oldestFirst[len(operands)-1-i] = operand.val
+	}
+	val, err := op.FullMerge(key, existing, oldestFirst)
+	if err != nil {
+		return nil, errors.Join(ErrMerge, err)
+	}
+	return val, nil
+}
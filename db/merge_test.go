@@ -0,0 +1,197 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/chettriyuvraj/leveldb-clone/common"
+	"github.com/chettriyuvraj/leveldb-clone/memdb"
+	"github.com/stretchr/testify/require"
+)
+
+/* Values + operands are 8 byte counters, operands are added to the value */
+type counterOperator struct{}
+
+func (counterOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	sum := uint64(0)
+	if existing != nil {
+		if len(existing) != 8 {
+			return nil, errors.New("not a counter")
+		}
+		sum = binary.BigEndian.Uint64(existing)
+	}
+	for _, operand := range operands {
+		sum += binary.BigEndian.Uint64(operand)
+	}
+	return binary.BigEndian.AppendUint64(nil, sum), nil
+}
+
+func (counterOperator) PartialMerge(key, left, right []byte) ([]byte, bool) {
+	return binary.BigEndian.AppendUint64(nil, binary.BigEndian.Uint64(left)+binary.BigEndian.Uint64(right)), true
+}
+
+/* Operands are appended to the value, they can't be combined without it */
+type appendOperator struct{}
+
+func (appendOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	val := append([]byte{}, existing...)
+	for _, operand := range operands {
+		val = append(val, operand...)
+	}
+	return val, nil
+}
+
+func (appendOperator) PartialMerge(key, left, right []byte) ([]byte, bool) {
+	return nil, false
+}
+
+func counter(n uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, n)
+}
+
+func TestMerge(t *testing.T) {
+	dirName := t.TempDir()
+	key := func(i int) []byte { return []byte(fmt.Sprintf("counter%03d", i)) }
+
+	/* Merges are rejected without a merge operator */
+	db, err := NewDB(NewDBConfigWithOptions(100, true, dirName, TESTLEVELEDOPTIONS))
+	require.NoError(t, err)
+	require.ErrorIs(t, db.Merge(key(0), counter(1)), ErrNoMergeOperator)
+	require.NoError(t, db.Close())
+
+	/* Every counter i is incremented i times, counters divisible by 3 start from a value of 100 and those divisible by 5 are deleted halfway through */
+	const keys = 60
+	want := func(i int) uint64 {
+		switch {
+		case i%5 == 0:
+			return uint64(i - i/2)
+		case i%3 == 0:
+			return uint64(i + 100)
+		}
+		return uint64(i)
+	}
+	check := func(db *DB) {
+		for i := 1; i < keys; i++ {
+			v, err := db.Get(key(i))
+			require.NoError(t, err)
+			require.Equal(t, counter(want(i)), v, "counter %d", i)
+		}
+
+		iter, err := db.RangeScan(key(0), key(keys))
+		require.NoError(t, err)
+		for i := 1; i < keys; i++ {
+			require.Equal(t, key(i), iter.Key())
+			require.Equal(t, counter(want(i)), iter.Value())
+			iter.Next()
+		}
+		require.Nil(t, iter.Key())
+		require.NoError(t, iter.Error())
+	}
+
+	opts := TESTLEVELEDOPTIONS
+	opts.MergeOperator = counterOperator{}
+	db, err = NewDB(NewDBConfigWithOptions(100, false, dirName, opts))
+	require.NoError(t, err)
+	for i := 3; i < keys; i += 3 {
+		require.NoError(t, db.Put(key(i), counter(100)))
+	}
+	var snapshot *Snapshot
+	for round := 0; round < keys; round++ {
+		for i := round + 1; i < keys; i++ {
+			require.NoError(t, db.Merge(key(i), counter(1)))
+			if i%5 == 0 && round == i/2-1 {
+				require.NoError(t, db.Delete(key(i)))
+			}
+		}
+		if round == 10 {
+			snapshot, err = db.GetSnapshot()
+			require.NoError(t, err)
+		}
+	}
+	check(db)
+
+	/* The snapshot still sees counter 30 as it was after 11 increments */
+	v, err := db.GetWithOptions(key(30), ReadOptions{Snapshot: snapshot})
+	require.NoError(t, err)
+	require.Equal(t, counter(111), v)
+	db.ReleaseSnapshot(snapshot)
+
+	/* Operands are merged by compactions, reads see the same values */
+	require.NoError(t, db.waitForBackgroundWork())
+	check(db)
+	require.NoError(t, db.Close())
+
+	/* And after recovery */
+	db, err = NewDB(NewDBConfigWithOptions(100, false, dirName, opts))
+	require.NoError(t, err)
+	defer db.Close()
+	check(db)
+
+	/* Errors from the merge operator fail the read */
+	require.NoError(t, db.Put(key(keys), []byte("not a counter")))
+	require.NoError(t, db.Merge(key(keys), counter(1)))
+	_, err = db.Get(key(keys))
+	require.ErrorIs(t, err, ErrMerge)
+}
+
+func TestCompactionMergesOperands(t *testing.T) {
+	/* Operands at 3, 5, 7 and 9 on top of a value at 2 */
+	entries := func(withValue bool) *memdb.MemDB {
+		mem, err := memdb.NewMemDB()
+		require.NoError(t, err)
+		k := []byte("key")
+		if withValue {
+			require.NoError(t, mem.Add(2, common.TypeValue, k, []byte("v")))
+		}
+		for _, seq := range []uint64{3, 5, 7, 9} {
+			require.NoError(t, mem.Add(seq, common.TypeMerge, k, []byte(fmt.Sprintf("%d", seq))))
+		}
+		return mem
+	}
+
+	type entry struct {
+		seq       uint64
+		valueType common.ValueType
+		val       string
+	}
+	tcs := []struct {
+		name             string
+		withValue        bool
+		isBaseLevel      bool
+		smallestSnapshot uint64
+		op               MergeOperator
+		want             []entry
+	}{
+		{name: "merged into the value", withValue: true, smallestSnapshot: 9, op: appendOperator{}, want: []entry{{9, common.TypeValue, "v3579"}}},
+		{name: "operands newer than a snapshot are kept", withValue: true, smallestSnapshot: 5, op: appendOperator{}, want: []entry{{9, common.TypeMerge, "9"}, {7, common.TypeMerge, "7"}, {5, common.TypeValue, "v35"}}},
+		{name: "nothing below the operands", isBaseLevel: true, smallestSnapshot: 9, op: appendOperator{}, want: []entry{{9, common.TypeValue, "3579"}}},
+		{name: "value may be in a deeper level", smallestSnapshot: 9, op: appendOperator{}, want: []entry{{9, common.TypeMerge, "9"}, {7, common.TypeMerge, "7"}, {5, common.TypeMerge, "5"}, {3, common.TypeMerge, "3"}}},
+		{name: "operands combined by partial merges", smallestSnapshot: 9, op: concatOperator{}, want: []entry{{9, common.TypeMerge, "3579"}}},
+		{name: "no merge operator", withValue: true, smallestSnapshot: 9, want: []entry{{9, common.TypeMerge, "9"}, {7, common.TypeMerge, "7"}, {5, common.TypeMerge, "5"}, {3, common.TypeMerge, "3"}, {2, common.TypeValue, "v"}}},
+	}
+	for _, tc := range tcs {
+		internalIter, err := entries(tc.withValue).InternalScan(nil, nil)
+		require.NoError(t, err)
+		iter := newDroppingIterator(internalIter, common.BytewiseComparator, tc.op, tc.smallestSnapshot, 0, func(key []byte) bool { return tc.isBaseLevel })
+
+		got := []entry{}
+		for ; iter.Key() != nil; iter.Next() {
+			_, seq, valueType, err := common.ParseInternalKey(iter.Key())
+			require.NoError(t, err)
+			got = append(got, entry{seq, valueType, string(iter.Value())})
+		}
+		require.NoError(t, iter.Error())
+		require.Equal(t, tc.want, got, tc.name)
+	}
+}
+
+/* Operands are concatenated, so they can be combined before the value is known */
+type concatOperator struct {
+	appendOperator
+}
+
+func (concatOperator) PartialMerge(key, left, right []byte) ([]byte, bool) {
+	return append(append([]byte{}, left...), right...), true
+}
@@ -3,266 +3,319 @@ package db
 import (
 	"container/heap"
 	"errors"
+
+	"github.com/chettriyuvraj/leveldb-clone/common"
+	"github.com/chettriyuvraj/leveldb-clone/memdb"
+	"github.com/chettriyuvraj/leveldb-clone/sstable"
 )
 
 var ErrCreateDBIter = errors.New("error creating DB iterator")
 
+/*
+- Lazily merges child iterators keyed by internal keys, only the current entry of each child is held in memory
+- Entries are ordered by internal key, so the newest version of a user key always comes first regardless of which memdb/table it came from
+- A user iterator yields the newest version of each user key and skips keys whose newest version is a deletion or a value which has expired as of now, an internal iterator yields every entry with its internal key
+- If the newest version is a merge operand, a user iterator merges it with the older versions of the key using the merge operator of its column family
+- Versions with a sequence number larger than seq are left out
+- The memdbs and tables being read are released once the iterator is exhausted or closed, so an iterator which is abandoned halfway should be closed
+*/
 type MergeIterator struct {
 	startKey, limitKey []byte
-	heap               RecordHeap
+	heap               IterHeap
 	fullScan           bool
+	internal           bool
+	seq                uint64
+	now                int64             /* Unix time in nanoseconds which a user iterator checks expiring values against */
+	merge              MergeOperator     /* Merges operands for a user iterator, nil if the column family has none */
+	curKey, curVal     []byte            /* Internal key + value of the current entry, nil once exhausted */
+	lastUserKey        []byte            /* User key of the newest visible version seen so far, every other version of it is skipped */
+	children           []common.Iterator /* Closed along with the iterator, so that the tables they read are released */
+	release            func()            /* Called once, when the iterator is exhausted or closed */
 	err                error
 }
 
+/* Iterates every key of the default column family */
 func NewFullMergeIterator(db *DB) (*MergeIterator, error) {
-	iter := MergeIterator{heap: RecordHeap{}, fullScan: true}
-	seenKeys := map[string]bool{}
+	state, err := db.acquireReadState(DEFAULTCOLUMNFAMILYID, ReadOptions{})
+	if err != nil {
+		return nil, errors.Join(ErrCreateDBIter, err)
+	}
 
-	heap.Init(&iter.heap)
-	/* Put all elements from memdb into heap, mark the ones which have been seen */
-	memdbIter, err := db.memdb.FullScan()
+	children, err := db.readStateIterators(state, nil, nil)
 	if err != nil {
+		db.releaseReadState(state)
 		return nil, errors.Join(ErrCreateDBIter, err)
 	}
-	for memdbIter.Key() != nil {
-		k, v := memdbIter.Key(), memdbIter.Value()
-		heap.Push(&iter.heap, Record{k, v})
-		seenKeys[string(k)] = true
-		memdbIter.Next()
+
+	iter := &MergeIterator{fullScan: true, seq: state.seq, now: state.now, heap: IterHeap{icmp: state.cf.icmp}, merge: state.cf.opts.MergeOperator, release: func() { db.releaseReadState(state) }}
+	if err := iter.init(children); err != nil {
+		return nil, errors.Join(ErrCreateDBIter, err)
 	}
+	return iter, nil
+}
 
-	/* Put all elements from sstables into heap, mark the ones which have been seen */
-	for _, sst := range db.sstables {
-		sstIter, err := sst.FullScan()
+/*
+- Merges the full contents of the tables of 'files' of column family cf, yielding every version of every key - the caller must keep the files from being deleted
+- Checksums are always verified, so that compaction never carries a corrupt block over into a new table
+*/
+func newTablesMergeIterator(tc *tableCache, cf *columnFamily, files []*FileMetadata) (*MergeIterator, error) {
+	children := []common.Iterator{}
+	for _, file := range files {
+		handle, err := tc.get(file.number, cf)
 		if err != nil {
+			closeIterators(children)
 			return nil, errors.Join(ErrCreateDBIter, err)
 		}
-		for sstIter.Key() != nil {
-			k, v := sstIter.Key(), sstIter.Value()
-			if seen := seenKeys[string(k)]; !seen {
-				heap.Push(&iter.heap, Record{k, v})
-				seenKeys[string(k)] = true
-			}
-			sstIter.Next()
+		tableIter, err := newTableIterator(tc, handle, nil, nil, sstable.ReadOptions{VerifyChecksums: true})
+		if err != nil {
+			closeIterators(children)
+			return nil, errors.Join(ErrCreateDBIter, err)
 		}
+		children = append(children, tableIter)
 	}
 
-	return &iter, err
+	iter := &MergeIterator{fullScan: true, internal: true, seq: common.MaxSequenceNumber, heap: IterHeap{icmp: cf.icmp}}
+	if err := iter.init(children); err != nil {
+		return nil, errors.Join(ErrCreateDBIter, err)
+	}
+	return iter, nil
 }
 
 func NewMergeIterator(db *DB, startKey, limitKey []byte) (*MergeIterator, error) {
-	iter := MergeIterator{startKey: startKey, limitKey: limitKey, heap: RecordHeap{}}
-	seenKeys := map[string]bool{}
+	return NewMergeIteratorWithOptions(db, startKey, limitKey, ReadOptions{})
+}
 
-	heap.Init(&iter.heap)
-	/* Put all elements from memdb into heap, mark the ones which have been seen */
-	memdbIter, err := db.memdb.RangeScan(startKey, limitKey)
+/* Iterates [startKey, limitKey] of the default column family */
+func NewMergeIteratorWithOptions(db *DB, startKey, limitKey []byte, opts ReadOptions) (*MergeIterator, error) {
+	return newMergeIterator(db, DEFAULTCOLUMNFAMILYID, startKey, limitKey, opts)
+}
+
+func newMergeIterator(db *DB, id uint32, startKey, limitKey []byte, opts ReadOptions) (*MergeIterator, error) {
+	/* The read state stays referenced until the iterator is exhausted or closed, so the files it reads from are not deleted */
+	state, err := db.acquireReadState(id, opts)
 	if err != nil {
 		return nil, errors.Join(ErrCreateDBIter, err)
 	}
-	for memdbIter.Key() != nil {
-		k, v := memdbIter.Key(), memdbIter.Value()
-		heap.Push(&iter.heap, Record{k, v})
-		seenKeys[string(k)] = true
-		memdbIter.Next()
+
+	children, err := db.readStateIterators(state, startKey, limitKey)
+	if err != nil {
+		db.releaseReadState(state)
+		return nil, errors.Join(ErrCreateDBIter, err)
+	}
+
+	iter := &MergeIterator{startKey: startKey, limitKey: limitKey, seq: state.seq, now: state.now, heap: IterHeap{icmp: state.cf.icmp}, merge: state.cf.opts.MergeOperator, release: func() { db.releaseReadState(state) }}
+	if err := iter.init(children); err != nil {
+		return nil, errors.Join(ErrCreateDBIter, err)
+	}
+	return iter, nil
+}
+
+/*
+- Iterators over the memdbs and every level of the read state, covering user keys in [startKey, limitKey] or everything if both are nil
+- Level 0 tables may overlap so each gets its own iterator, every deeper level is read by a single iterator moving from table to table
+- Tables are taken from the table cache, the read state keeps their files from being deleted
+*/
+func (db *DB) readStateIterators(state *readState, startKey, limitKey []byte) (children []common.Iterator, err error) {
+	defer func() {
+		if err != nil {
+			closeIterators(children)
+		}
+	}()
+
+	for _, mem := range []*memdb.MemDB{state.mem, state.imm} {
+		if mem == nil {
+			continue
+		}
+		memIter, err := mem.InternalScan(startKey, limitKey)
+		if err != nil {
+			return children, err
+		}
+		children = append(children, memIter)
+	}
+
+	ucmp := state.cf.opts.Comparator
+	for _, file := range state.version.Files(0) {
+		if (startKey != nil && ucmp.Compare(common.ExtractUserKey(file.largest), startKey) < 0) || (limitKey != nil && ucmp.Compare(common.ExtractUserKey(file.smallest), limitKey) > 0) {
+			continue
+		}
+		handle, err := db.tableCache.get(file.number, state.cf)
+		if err != nil {
+			return children, err
+		}
+		startIKey, limitIKey := tableRange(file, startKey, limitKey)
+		tableIter, err := newTableIterator(db.tableCache, handle, startIKey, limitIKey, state.ro)
+		if err != nil {
+			return children, err
+		}
+		children = append(children, tableIter)
 	}
 
-	/* Put all elements from sstables into heap, mark the ones which have been seen */
-	for _, sst := range db.sstables {
-		sstIter, err := sst.RangeScan(startKey, limitKey)
+	for level := 1; level < state.version.NumLevels(); level++ {
+		if len(state.version.Files(level)) == 0 {
+			continue
+		}
+		levelIter, err := newLevelIterator(db.tableCache, state.cf, state.version.Files(level), startKey, limitKey, state.ro)
 		if err != nil {
-			return nil, errors.Join(ErrCreateDBIter, err)
+			return children, err
+		}
+		children = append(children, levelIter)
+	}
+	return children, nil
+}
+
+/* Closes the iterators which hold on to resources, e.g. tables */
+func closeIterators(iters []common.Iterator) {
+	for _, iter := range iters {
+		if closer, ok := iter.(interface{ Close() error }); ok {
+			closer.Close()
+		}
+	}
+}
+
+/* Pushes the children which are not exhausted into the heap and moves to the first entry to be yielded */
+func (iter *MergeIterator) init(children []common.Iterator) error {
+	iter.children = children
+	heap.Init(&iter.heap)
+	for _, child := range children {
+		if err := child.Error(); err != nil {
+			iter.Close()
+			return err
+		}
+		if child.Key() != nil {
+			heap.Push(&iter.heap, child)
+		}
+	}
+
+	iter.findNext()
+	if iter.err != nil {
+		return iter.err
+	}
+	return nil
+}
+
+/* Advances the child at the top of the heap, dropping it once exhausted */
+func (iter *MergeIterator) advanceTop() {
+	child := iter.heap.Elem(0)
+	if child.Next() {
+		heap.Fix(&iter.heap, 0)
+		return
+	}
+	if err := child.Error(); err != nil {
+		iter.err = err
+		return
+	}
+	heap.Pop(&iter.heap)
+}
+
+/* Consumes entries from the children until one which is to be yielded is found */
+func (iter *MergeIterator) findNext() {
+	for iter.heap.Len() > 0 && iter.err == nil {
+		child := iter.heap.Elem(0)
+		key, val := child.Key(), child.Value()
+		userKey, seq, valueType, err := common.ParseInternalKey(key)
+		if err != nil {
+			iter.err = err
+			break
+		}
+		iter.advanceTop()
+
+		if seq > iter.seq {
+			continue
+		}
+		if iter.internal {
+			iter.curKey, iter.curVal = key, val
+			return
 		}
-		for sstIter.Key() != nil {
-			k, v := sstIter.Key(), sstIter.Value()
-			if seen := seenKeys[string(k)]; !seen {
-				heap.Push(&iter.heap, Record{k, v})
-				seenKeys[string(k)] = true
+
+		/* Older versions of a user key follow the newest one */
+		if iter.lastUserKey != nil && iter.heap.icmp.UserComparator().Compare(userKey, iter.lastUserKey) == 0 {
+			continue
+		}
+		iter.lastUserKey = userKey
+		if valueType == common.TypeDeletion {
+			continue
+		}
+		if valueType == common.TypeMerge {
+			if val, err = iter.mergeOperands(userKey, val); err != nil {
+				iter.err = err
+				break
 			}
-			sstIter.Next()
 		}
+		val, expired, err := resolveExpiry(valueType, val, iter.now)
+		if err != nil {
+			iter.err = err
+			break
+		}
+		if expired {
+			continue
+		}
+		iter.curKey, iter.curVal = key, val
+		return
+	}
+
+	iter.curKey, iter.curVal = nil, nil
+	iter.Close()
+}
 
+/* Merges the operand just read with the older versions of userKey, which are consumed from the heap */
+func (iter *MergeIterator) mergeOperands(userKey, operand []byte) ([]byte, error) {
+	if iter.merge == nil {
+		return nil, ErrNoMergeOperator
 	}
 
-	return &iter, err
+	peek := func() (key, val []byte) {
+		if iter.heap.Len() == 0 || iter.err != nil {
+			return nil, nil
+		}
+		child := iter.heap.Elem(0)
+		return child.Key(), child.Value()
+	}
+	operands, base, err := collectOperands(peek, iter.advanceTop, iter.heap.icmp.UserComparator(), userKey, iter.seq)
+	if err == nil {
+		err = iter.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	existing, err := baseValue(base, iter.now)
+	if err != nil {
+		return nil, err
+	}
+	return fullMerge(iter.merge, userKey, existing, append([]mergeOperand{{val: operand}}, operands...))
 }
 
 func (iter *MergeIterator) Next() bool {
-	if len(iter.heap) == 0 {
+	if iter.curKey == nil {
 		return false
 	}
 
-	heap.Pop(&iter.heap)
-	return len(iter.heap) > 0
+	iter.findNext()
+	return iter.curKey != nil
 }
 
 func (iter *MergeIterator) Key() []byte {
-	if len(iter.heap) == 0 {
-		return nil
+	if iter.curKey == nil || iter.internal {
+		return iter.curKey
 	}
-
-	smallestRecord := iter.heap.Elem(0)
-	return smallestRecord.key
+	return common.ExtractUserKey(iter.curKey)
 }
 
 func (iter *MergeIterator) Value() []byte {
-	if len(iter.heap) == 0 {
-		return nil
-	}
-
-	smallestRecord := iter.heap.Elem(0)
-	return smallestRecord.value
+	return iter.curVal
 }
 
 func (iter *MergeIterator) Error() error {
 	return iter.err
 }
 
-// type MergeIterator struct {
-// 	startKey, limitKey []byte
-// 	iters              []common.Iterator
-// 	heap               sstable.SSTIterHeap
-// 	memdbIter          common.Iterator
-// 	fullScan           bool
-// }
-
-// func NewFullMergeIterator(db *DB) (*MergeIterator, error) {
-// 	iter := MergeIterator{heap: sstable.SSTIterHeap{}}
-
-// 	/* Get iterator from memdb */
-// 	memdbIter, err := db.memdb.FullScan()
-// 	if err != nil {
-// 		return nil, errors.Join(ErrCreateDBIter, err)
-// 	}
-// 	if memdbIter.Key() != nil {
-// 		iter.memdbIter = memdbIter
-// 	}
-
-// 	/* Get iterator from all sstables */
-// 	for _, sst := range db.sstables {
-// 		sstIter, err := sst.FullScan()
-// 		if err != nil {
-// 			return nil, errors.Join(ErrCreateDBIter, err)
-// 		}
-// 		if sstIter.Key() != nil {
-// 			iter.iters = append(iter.iters, sstIter)
-// 		}
-// 	}
-
-// 	/* Initialize heap */
-// 	heap.Init(&iter.heap)
-// 	for _, validIters := range iter.iters {
-// 		heap.Push(&iter.heap, validIters)
-// 	}
-
-// 	return &iter, err
-// }
-
-// /*
-// - Tombstones are to be skipped
-// - Grab all range-matching sstables iterators + memdb iterator
-// */
-// func NewMergeIterator(db *DB, startKey, limitKey []byte) (*MergeIterator, error) {
-// 	iter := MergeIterator{startKey: startKey, limitKey: limitKey, heap: sstable.SSTIterHeap{}}
-
-// 	/* Get iterator if it matches range, from memdb */
-// 	memdbIter, err := db.memdb.RangeScan(startKey, limitKey)
-// 	if err != nil {
-// 		return nil, errors.Join(ErrCreateDBIter, err)
-// 	}
-// 	if memdbIter.Key() != nil {
-// 		iter.memdbIter = memdbIter
-// 	}
-
-// 	/* Get iterator which match range from all sstables */
-// 	for _, sst := range db.sstables {
-// 		sstIter, err := sst.RangeScan(startKey, limitKey)
-// 		if err != nil {
-// 			return nil, errors.Join(ErrCreateDBIter, err)
-// 		}
-// 		if sstIter.Key() != nil {
-// 			iter.iters = append(iter.iters, sstIter)
-// 		}
-// 	}
-
-// 	/* Initialize heap */
-// 	heap.Init(&iter.heap)
-// 	for _, validIters := range iter.iters {
-// 		heap.Push(&iter.heap, validIters)
-// 	}
-
-// 	return &iter, err
-// }
-
-// func (iter *MergeIterator) Next() bool {
-// 	minIter := MinIter(iter.memdbIter, iter.heap)
-
-// 	if minIter == nil {
-// 		return false
-// 	}
-
-// 	/* Move minIter to next smallest Key */
-// 	if minIter == iter.memdbIter {
-// 		iter.memdbIter.Next()
-// 	} else {
-// 		poppedIter := heap.Pop(&iter.heap).(*sstable.SSTableIterator)
-// 		if poppedIter.Next() {
-// 			heap.Push(&iter.heap, poppedIter)
-// 		}
-// 	}
-
-// 	/* Check if at least one of the iterators is alive */
-// 	return iter.memdbIter.Key() != nil || iter.heap.Len() > 0
-// }
-
-// func (iter *MergeIterator) Key() []byte {
-// 	minIter := MinIter(iter.memdbIter, iter.heap)
-
-// 	if minIter == nil {
-// 		return nil
-// 	}
-
-// 	return minIter.Key()
-// }
-
-// func (iter *MergeIterator) Value() []byte {
-// 	minIter := MinIter(iter.memdbIter, iter.heap)
-
-// 	if minIter == nil {
-// 		return nil
-// 	}
-
-// 	return minIter.Value()
-// }
-
-// func (iter *MergeIterator) Error() error {
-// 	minIter := MinIter(iter.memdbIter, iter.heap)
-
-// 	if minIter == nil {
-// 		return nil
-// 	}
-
-// 	return minIter.Error()
-// }
-
-// func MinIter(memdbIter common.Iterator, heap sstable.SSTIterHeap) common.Iterator {
-// 	if memdbIter.Key() == nil && heap.Len() == 0 {
-// 		return nil
-// 	}
-
-// 	var minIter common.Iterator = memdbIter
-// 	if heap.Len() > 0 {
-// 		i1, i2 := memdbIter, heap[0]
-// 		if i1.Key() == nil && i2.Key() == nil {
-// 			return nil
-// 		}
-
-// 		if i1.Key() == nil {
-// 			minIter = i2
-// 		} else if bytes.Compare(i2.Key(), i1.Key()) < 0 {
-// 			minIter = heap[0]
-// 		}
-// 	}
-
-// 	return minIter
-// }
+/* Releases the memdbs and tables being read, the iterator is exhausted after this */
+func (iter *MergeIterator) Close() error {
+	iter.heap.iters, iter.curKey, iter.curVal = nil, nil, nil
+	closeIterators(iter.children)
+	iter.children = nil
+	if iter.release != nil {
+		iter.release()
+		iter.release = nil
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/chettriyuvraj/leveldb-clone/common"
+	"github.com/chettriyuvraj/leveldb-clone/memdb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeIterator(t *testing.T) {
+	type entry struct {
+		seq       uint64
+		valueType common.ValueType
+		key, val  string
+	}
+	/* Versions of the same key are spread across children, in no particular order */
+	childEntries := [][]entry{
+		{{1, common.TypeValue, "a", "a1"}, {5, common.TypeValue, "b", "b5"}, {7, common.TypeDeletion, "c", ""}},
+		{{4, common.TypeValue, "a", "a4"}, {2, common.TypeValue, "c", "c2"}, {3, common.TypeValue, "d", "d3"}},
+		{{6, common.TypeDeletion, "a", ""}, {8, common.TypeValue, "a", "a8"}, {9, common.TypeValue, "e", "e9"}},
+	}
+	newIter := func(seq uint64, internal bool) *MergeIterator {
+		children := []common.Iterator{}
+		for _, entries := range childEntries {
+			mem, err := memdb.NewMemDB()
+			require.NoError(t, err)
+			for _, e := range entries {
+				require.NoError(t, mem.Add(e.seq, e.valueType, []byte(e.key), []byte(e.val)))
+			}
+			child, err := mem.InternalScan(nil, nil)
+			require.NoError(t, err)
+			children = append(children, child)
+		}
+
+		iter := &MergeIterator{seq: seq, internal: internal, heap: IterHeap{icmp: common.NewInternalKeyComparator(common.BytewiseComparator)}}
+		require.NoError(t, iter.init(children))
+		return iter
+	}
+
+	tcs := []struct {
+		name     string
+		seq      uint64
+		internal bool
+		want     []string /* key:val for user iterators, key:seq for internal ones */
+	}{
+		{name: "newest version wins, deleted keys are skipped", seq: common.MaxSequenceNumber, want: []string{"a:a8", "b:b5", "d:d3", "e:e9"}},
+		{name: "versions newer than seq are invisible", seq: 6, want: []string{"b:b5", "c:c2", "d:d3"}},
+		{name: "internal iterators yield every version", seq: common.MaxSequenceNumber, internal: true, want: []string{"a:8", "a:6", "a:4", "a:1", "b:5", "c:7", "c:2", "d:3", "e:9"}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			iter := newIter(tc.seq, tc.internal)
+			got := []string{}
+			for ; iter.Key() != nil; iter.Next() {
+				if tc.internal {
+					userKey, seq, _, err := common.ParseInternalKey(iter.Key())
+					require.NoError(t, err)
+					got = append(got, string(userKey)+":"+string(rune('0'+seq)))
+					continue
+				}
+				got = append(got, string(iter.Key())+":"+string(iter.Value()))
+			}
+			require.NoError(t, iter.Error())
+			require.Equal(t, tc.want, got)
+			require.False(t, iter.Next())
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package db
+
+import (
+	"time"
+
+	"github.com/chettriyuvraj/leveldb-clone/cache"
+	"github.com/chettriyuvraj/leveldb-clone/common"
+	"github.com/chettriyuvraj/leveldb-clone/sstable"
+)
+
+const (
+	DEFAULTNUMLEVELS           = 7
+	DEFAULTBASELEVELSIZE       = 10 * 1024 * 1024 /* In bytes */
+	DEFAULTLEVELSIZEMULTIPLIER = 10
+	DEFAULTTARGETFILESIZE      = 2 * 1024 * 1024 /* In bytes */
+	DEFAULTBLOCKCACHESIZE      = 8 * 1024 * 1024 /* In bytes */
+	DEFAULTMAXOPENFILES        = 1000
+)
+
+/* How recovery deals with a WAL which is not what was written */
+type RecoveryMode int
+
+const (
+	TolerateCorruptedTailRecords RecoveryMode = iota /* Drop a write torn by a crash at the tail of a WAL, fail on damage anywhere else */
+	AbsoluteConsistency                              /* Fail on any damage, even a torn write at the tail */
+	SkipAnyCorruptedRecords                          /* Drop every damaged record and recover the rest, at the cost of losing writes in the middle of a WAL */
+)
+
+/* Tunables for the DB, any field left as zero takes its default value */
+type Options struct {
+	Comparator              common.Comparator       /* Order of the user keys, common.BytewiseComparator if nil - a DB can only be reopened with a comparator of the same name */
+	MergeOperator           MergeOperator           /* Merges the operands written by DB.Merge, merges are rejected if nil */
+	NumLevels               int                     /* Number of levels in the LSM tree including level 0 */
+	Level0CompactionTrigger int                     /* Level 0 is compacted once it holds more than these many files */
+	Level0StopWritesTrigger int                     /* Writes wait for compaction once level 0 holds these many files */
+	BaseLevelSize           uint64                  /* Max total size of level 1 in bytes */
+	LevelSizeMultiplier     int                     /* Each level after level 1 can hold these many times the bytes of the previous one */
+	TargetFileSize          uint64                  /* Size of the SSTables produced by compaction in bytes */
+	BlockSize               int                     /* Data blocks of SSTables are cut once they reach this size in bytes */
+	Compression             sstable.CompressionType /* Compression of SSTable blocks, sstable.NoCompression if zero */
+	BlockRestartInterval    int                     /* Keys between restart points of a data block, keys in between only store what they don't share with the previous key */
+	FilterBitsPerKey        int                     /* Bits per key of the bloom filter written with every SSTable, a negative value disables filters */
+	BlockCacheSize          int                     /* Capacity of the block cache in bytes, unused if BlockCache is set */
+	BlockCache              *cache.Cache            /* Block cache to use instead of creating one, lets DBs in the same process share a cache */
+	MaxOpenFiles            int                     /* Max number of SSTables kept open by the table cache */
+	Sync                    bool                    /* Sync the WAL before every write returns, as if every write was made with WriteOptions.Sync */
+	SyncInterval            time.Duration           /* Sync the WAL in the background this often, which bounds how much a power loss can erase of writes which aren't synced - 0 disables */
+	RecoveryMode            RecoveryMode            /* How a damaged WAL is dealt with when the DB is opened, TolerateCorruptedTailRecords if zero */
+	ColumnFamilies          map[string]Options      /* Options of the column families other than the default one by name, used when they are reopened - a family left out takes the options of the DB */
+	Clock                   func() time.Time        /* Current time, which TTLs are set from and checked against - time.Now if nil */
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Comparator:              common.BytewiseComparator,
+		NumLevels:               DEFAULTNUMLEVELS,
+		Level0CompactionTrigger: LEVEL0SSTLIMIT,
+		Level0StopWritesTrigger: 3 * LEVEL0SSTLIMIT,
+		BaseLevelSize:           DEFAULTBASELEVELSIZE,
+		LevelSizeMultiplier:     DEFAULTLEVELSIZEMULTIPLIER,
+		TargetFileSize:          DEFAULTTARGETFILESIZE,
+		BlockSize:               sstable.DEFAULTBLOCKSIZE,
+		BlockRestartInterval:    sstable.DEFAULTBLOCKRESTARTINTERVAL,
+		FilterBitsPerKey:        sstable.DEFAULTFILTERBITSPERKEY,
+		BlockCacheSize:          DEFAULTBLOCKCACHESIZE,
+		MaxOpenFiles:            DEFAULTMAXOPENFILES,
+		Clock:                   time.Now,
+	}
+}
+
+/* Replaces zero values with defaults */
+func (opts Options) withDefaults() Options {
+	defaults := DefaultOptions()
+	if opts.Comparator == nil {
+		opts.Comparator = defaults.Comparator
+	}
+	if opts.NumLevels < 2 {
+		opts.NumLevels = defaults.NumLevels
+	}
+	if opts.Level0CompactionTrigger <= 0 {
+		opts.Level0CompactionTrigger = defaults.Level0CompactionTrigger
+	}
+	if opts.Level0StopWritesTrigger <= opts.Level0CompactionTrigger {
+		opts.Level0StopWritesTrigger = 3 * opts.Level0CompactionTrigger
+	}
+	if opts.BaseLevelSize == 0 {
+		opts.BaseLevelSize = defaults.BaseLevelSize
+	}
+	if opts.LevelSizeMultiplier <= 1 {
+		opts.LevelSizeMultiplier = defaults.LevelSizeMultiplier
+	}
+	if opts.TargetFileSize == 0 {
+		opts.TargetFileSize = defaults.TargetFileSize
+	}
+	if opts.BlockSize <= 0 {
+		opts.BlockSize = defaults.BlockSize
+	}
+	if opts.BlockRestartInterval <= 0 {
+		opts.BlockRestartInterval = defaults.BlockRestartInterval
+	}
+	if opts.FilterBitsPerKey == 0 {
+		opts.FilterBitsPerKey = defaults.FilterBitsPerKey
+	}
+	if opts.BlockCacheSize <= 0 {
+		opts.BlockCacheSize = defaults.BlockCacheSize
+	}
+	if opts.MaxOpenFiles <= 0 {
+		opts.MaxOpenFiles = defaults.MaxOpenFiles
+	}
+	if opts.Clock == nil {
+		opts.Clock = defaults.Clock
+	}
+	return opts
+}
+
+/*
+- Options of the column family with the given name, which is either listed in ColumnFamilies or takes the options of the DB
+- Only the comparator, merge operator, compaction, SSTable and compression options apply per family, the others are always those of the DB
+*/
+func (opts Options) columnFamilyOptions(name string) Options {
+	if cfOpts, ok := opts.ColumnFamilies[name]; ok && name != DEFAULTCOLUMNFAMILYNAME {
+		return cfOpts.withDefaults()
+	}
+	return opts
+}
+
+/* Max total size of a level in bytes, level 0 is bounded by number of files instead */
+func (opts Options) maxBytesForLevel(level int) uint64 {
+	size := opts.BaseLevelSize
+	for l := 1; l < level; l++ {
+		size *= uint64(opts.LevelSizeMultiplier)
+	}
+	return size
+}
+
+/* Options for a single read */
+type ReadOptions struct {
+	Snapshot        *Snapshot /* Read the DB as of this snapshot, nil implies as of now */
+	VerifyChecksums bool      /* Check the checksum of every SSTable block read from disk, a mismatch fails the read with sstable.ErrCorruption */
+}
+
+/*
+- Options for a single write
+- Without Sync a write returns once it is in the OS's buffers, it survives a crash of the process but not a power loss or OS crash until the log is synced
+*/
+type WriteOptions struct {
+	Sync bool /* Sync the WAL before the write returns, also makes every earlier write durable */
+}
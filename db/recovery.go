@@ -0,0 +1,153 @@
+package db
+
+import (
+	"errors"
+	"io"
+
+	"github.com/chettriyuvraj/leveldb-clone/memdb"
+	"github.com/chettriyuvraj/leveldb-clone/wal"
+)
+
+/*
+- Replays the logs left over from the previous run, oldest first, straight into a memdb per column family - nothing is logged again
+- An entry is skipped if its family was dropped, or if the log is older than the family's log number i.e. the family flushed it before the crash
+- A memdb which grows past memdbLimit is written out as a level 0 table, as is whatever is left once every log is replayed
+- An edit per family then records those tables along with the new log, the old logs are deleted only after that - a crash midway leaves them in place to be replayed again for the families whose edits are missing
+- Must be called from NewDB, before any background work is started
+*/
+func (db *DB) recover() error {
+	logNumbers, err := db.getLogsToReplay()
+	if err != nil {
+		return err
+	}
+
+	families := db.versions.columnFamilies()
+	edits, mems := map[uint32]*VersionEdit{}, map[uint32]*memdb.MemDB{}
+	for _, cf := range families {
+		if mems[cf.id], err = memdb.NewMemDBWithComparator(cf.opts.Comparator); err != nil {
+			return err
+		}
+		edits[cf.id] = &VersionEdit{}
+	}
+	lastSeq := db.versions.LastSequence()
+	for _, logNumber := range logNumbers {
+		err := db.recoverLog(logNumber, func(batch *WriteBatch, seq uint64) error {
+			for i, entry := range batch.entries {
+				cf, ok := db.versions.families[entry.columnFamily]
+				if !ok || logNumber < cf.logNumber {
+					continue
+				}
+				if err := mems[cf.id].Add(seq+uint64(i), entry.valueType, entry.key, entry.val); err != nil {
+					return errors.Join(ErrMemDB, err)
+				}
+			}
+			if last := seq + uint64(batch.Len()) - 1; last > lastSeq {
+				lastSeq = last
+			}
+
+			for _, cf := range families {
+				if mems[cf.id].Size() <= db.memdbLimit {
+					continue
+				}
+				if err := db.writeLevel0Table(cf, mems[cf.id], edits[cf.id]); err != nil {
+					return err
+				}
+				next, err := memdb.NewMemDBWithComparator(cf.opts.Comparator)
+				if err != nil {
+					return err
+				}
+				mems[cf.id] = next
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, cf := range families {
+		if mems[cf.id].Size() > 0 {
+			if err := db.writeLevel0Table(cf, mems[cf.id], edits[cf.id]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := db.newLog(); err != nil {
+		return err
+	}
+	db.versions.SetLastSequence(lastSeq)
+	for _, cf := range families {
+		if cf.memdb, err = memdb.NewMemDBWithComparator(cf.opts.Comparator); err != nil {
+			return err
+		}
+		cf.memLogNumber = db.logNumber
+
+		edit := edits[cf.id]
+		edit.SetColumnFamily(cf.id)
+		edit.SetLogNumber(db.logNumber)
+		if err := db.versions.LogAndApply(edit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Hands every write logged in the log to apply along with its first sequence number, damage to the log is dealt with as Options.RecoveryMode says */
+func (db *DB) recoverLog(logNumber uint64, apply func(batch *WriteBatch, seq uint64) error) error {
+	log, err := wal.Open(logFileName(db.dirName, logNumber))
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+	reader, err := log.NewReader()
+	if err != nil {
+		return err
+	}
+
+	mode := db.opts.RecoveryMode
+	for {
+		record, err := reader.Next()
+		corruption := &wal.ErrCorruption{}
+		switch {
+		case err == io.EOF:
+			return nil
+		case errors.Is(err, wal.ErrTornWrite) && mode != AbsoluteConsistency:
+			return nil
+		case errors.As(err, &corruption) && mode == SkipAnyCorruptedRecords:
+			continue
+		case err != nil:
+			return err
+		}
+
+		batch := NewWriteBatch()
+		switch record.Op() {
+		case wal.PUT:
+			batch.Put(record.Key(), record.Val())
+		case wal.DELETE:
+			batch.Delete(record.Key())
+		case wal.BATCH:
+			if err := batch.UnmarshalBinary(record.Val()); err != nil {
+				if mode == SkipAnyCorruptedRecords {
+					continue
+				}
+				return errors.Join(ErrWALBATCH, err)
+			}
+		}
+		if batch.Len() == 0 {
+			continue
+		}
+		if err := apply(batch, record.Seq()); err != nil {
+			return err
+		}
+	}
+}
+
+/* Writes out a memdb of cf filled by recovery as a level 0 table, which is only recorded in edit */
+func (db *DB) writeLevel0Table(cf *columnFamily, mem *memdb.MemDB, edit *VersionEdit) error {
+	meta, err := db.writeMemDBToSSTable(cf, mem, db.versions.NewFileNumber())
+	if err != nil {
+		return err
+	}
+	edit.AddFile(0, meta)
+	return nil
+}
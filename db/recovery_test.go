@@ -0,0 +1,93 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/chettriyuvraj/leveldb-clone/common"
+	"github.com/chettriyuvraj/leveldb-clone/wal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoveryModes(t *testing.T) {
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	val := func(i int) []byte {
+		return append([]byte(fmt.Sprintf("val%03d", i)), bytes.Repeat([]byte("v"), 10000)...)
+	}
+
+	/* Values are large enough for records to span WAL blocks, and for recovery to flush a few memdbs along the way */
+	const keys, memdbLimit = 10, 25000
+	writeLog := func(dirName string) string {
+		db, err := NewDB(NewDBConfigWithOptions(1<<20, true, dirName, Options{}))
+		require.NoError(t, err)
+		for i := 0; i < keys; i++ {
+			require.NoError(t, db.Put(key(i), val(i)))
+		}
+		filename := logFileName(dirName, db.logNumber)
+		require.NoError(t, db.Close())
+		return filename
+	}
+	/* The last write is torn by a crash, and key003 is corrupted if 'corrupt' is set */
+	damageLog := func(filename string, corrupt bool) {
+		data, err := os.ReadFile(filename)
+		require.NoError(t, err)
+		if corrupt {
+			data[bytes.Index(data, []byte("val003"))] ^= 1
+		}
+		require.NoError(t, os.WriteFile(filename, data[:len(data)-10], 0644))
+	}
+
+	tcs := []struct {
+		name    string
+		mode    RecoveryMode
+		corrupt bool
+		wantErr error
+		missing map[int]bool
+	}{
+		{name: "torn tail is tolerated", mode: TolerateCorruptedTailRecords, missing: map[int]bool{9: true}},
+		{name: "corruption is not tolerated", mode: TolerateCorruptedTailRecords, corrupt: true, wantErr: wal.ErrChecksumMismatch},
+		{name: "absolute consistency fails on torn tail", mode: AbsoluteConsistency, wantErr: wal.ErrTornWrite},
+		{name: "absolute consistency fails on corruption", mode: AbsoluteConsistency, corrupt: true, wantErr: wal.ErrChecksumMismatch},
+		{name: "corrupted records are skipped", mode: SkipAnyCorruptedRecords, corrupt: true, missing: map[int]bool{3: true, 9: true}},
+	}
+
+	for _, tc := range tcs {
+		dirName := t.TempDir()
+		filename := writeLog(dirName)
+		damageLog(filename, tc.corrupt)
+
+		db, err := NewDB(NewDBConfigWithOptions(memdbLimit, false, dirName, Options{RecoveryMode: tc.mode}))
+		if tc.wantErr != nil {
+			require.ErrorIs(t, err, ErrWALReplay, tc.name)
+			require.ErrorIs(t, err, tc.wantErr, tc.name)
+			corruption := &wal.ErrCorruption{}
+			require.ErrorAs(t, err, &corruption, tc.name)
+			require.Equal(t, filename, corruption.File, tc.name)
+
+			/* A failed recovery leaves the log in place, so it can be recovered in another mode */
+			_, err := os.Stat(filename)
+			require.NoError(t, err, tc.name)
+			continue
+		}
+		require.NoError(t, err, tc.name)
+
+		for i := 0; i < keys; i++ {
+			v, err := db.Get(key(i))
+			if tc.missing[i] {
+				require.ErrorIs(t, err, common.ErrKeyDoesNotExist, tc.name)
+				continue
+			}
+			require.NoError(t, err, tc.name)
+			require.Equal(t, val(i), v, tc.name)
+		}
+
+		/* Recovered data went straight to level 0, the damaged log is gone */
+		require.Greater(t, len(db.versions.defaultColumnFamily().current.Files(0)), 1, tc.name)
+		require.Zero(t, db.versions.defaultColumnFamily().memdb.Size(), tc.name)
+		_, err = os.Stat(filename)
+		require.ErrorIs(t, err, os.ErrNotExist, tc.name)
+		require.NoError(t, db.Close())
+	}
+}
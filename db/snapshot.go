@@ -0,0 +1,53 @@
+package db
+
+import "errors"
+
+var ErrSnapshotReleased = errors.New("snapshot has been released")
+
+/*
+- A snapshot is a point-in-time view of the DB, reads made with it only see writes with a sequence number <= seq
+- Compaction keeps every version of a key which is visible to a live snapshot
+- Must be released using ReleaseSnapshot once it is no longer needed, it can't be used after that
+*/
+type Snapshot struct {
+	seq      uint64
+	released bool
+}
+
+/* Returns a snapshot of the DB as of now, it sees every write which has returned before this call */
+func (db *DB) GetSnapshot() (*Snapshot, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+
+	/* Sequence numbers only grow, so appending keeps snapshots sorted oldest first */
+	snapshot := &Snapshot{seq: db.versions.LastSequence()}
+	db.snapshots = append(db.snapshots, snapshot)
+	return snapshot, nil
+}
+
+func (db *DB) ReleaseSnapshot(snapshot *Snapshot) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if snapshot.released {
+		return
+	}
+
+	snapshot.released = true
+	for i, s := range db.snapshots {
+		if s == snapshot {
+			db.snapshots = append(db.snapshots[:i], db.snapshots[i+1:]...)
+			break
+		}
+	}
+}
+
+/* Versions with a sequence number <= this are visible to every snapshot and future read - must be called with mu held */
+func (db *DB) smallestSnapshot() uint64 {
+	if len(db.snapshots) > 0 {
+		return db.snapshots[0].seq
+	}
+	return db.versions.LastSequence()
+}
@@ -0,0 +1,113 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/chettriyuvraj/leveldb-clone/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	defer cleanupTestDB(t)
+
+	config := NewDBConfigWithOptions(30, true, TESTDBCONFIG.dirName, TESTLEVELEDOPTIONS)
+	db, err := NewDB(config)
+	require.NoError(t, err)
+	defer db.Close()
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	val := func(i, round int) []byte { return []byte(fmt.Sprintf("val%03d-%d", i, round)) }
+	const keys = 50
+	for i := 0; i < keys; i++ {
+		require.NoError(t, db.Put(key(i), val(i, 0)))
+	}
+	snapshot, err := db.GetSnapshot()
+	require.NoError(t, err)
+
+	/* Overwrite + delete everything enough times for the old versions to be flushed and compacted down */
+	for round := 1; round <= 5; round++ {
+		for i := 0; i < keys; i++ {
+			require.NoError(t, db.Put(key(i), val(i, round)))
+		}
+	}
+	for i := 0; i < keys; i += 2 {
+		require.NoError(t, db.Delete(key(i)))
+	}
+	require.NoError(t, db.Put(key(keys), val(keys, 5)))
+	require.NoError(t, db.waitForBackgroundWork())
+	current := db.versions.defaultColumnFamily().current
+	require.NotEmpty(t, current.Files(current.NumLevels()-1), "old versions should have been compacted down")
+
+	/* The snapshot still sees the first round, the DB itself sees the latest one */
+	readOpts := ReadOptions{Snapshot: snapshot}
+	for i := 0; i < keys; i++ {
+		v, err := db.GetWithOptions(key(i), readOpts)
+		require.NoError(t, err)
+		require.Equal(t, val(i, 0), v)
+
+		v, err = db.Get(key(i))
+		if i%2 == 0 {
+			require.ErrorIs(t, err, common.ErrKeyDoesNotExist)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, val(i, 5), v)
+	}
+	has, err := db.HasWithOptions(key(keys), readOpts)
+	require.NoError(t, err)
+	require.False(t, has)
+
+	/* Range scans read the versions kept for the snapshot from the compacted levels too */
+	iter, err := db.RangeScanWithOptions(key(0), key(keys), readOpts)
+	require.NoError(t, err)
+	for i := 0; i < keys; i++ {
+		require.Equal(t, key(i), iter.Key())
+		require.Equal(t, val(i, 0), iter.Value())
+		iter.Next()
+	}
+	require.Nil(t, iter.Key())
+
+	/* Released snapshots can't be read from */
+	db.ReleaseSnapshot(snapshot)
+	_, err = db.GetWithOptions(key(0), readOpts)
+	require.ErrorIs(t, err, ErrSnapshotReleased)
+	require.Empty(t, db.snapshots)
+}
+
+func TestSnapshotRangeScan(t *testing.T) {
+	defer cleanupTestDB(t)
+
+	/* Keep every flush in level 0 */
+	opts := Options{Level0CompactionTrigger: 100, Level0StopWritesTrigger: 200}
+	db, err := NewDB(NewDBConfigWithOptions(30, true, TESTDBCONFIG.dirName, opts))
+	require.NoError(t, err)
+	defer db.Close()
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%02d", i)) }
+	val := func(i, round int) []byte { return []byte(fmt.Sprintf("val%02d-%d", i, round)) }
+	const keys = 10
+	for i := 0; i < keys; i++ {
+		require.NoError(t, db.Put(key(i), val(i, 0)))
+	}
+	snapshot, err := db.GetSnapshot()
+	require.NoError(t, err)
+	defer db.ReleaseSnapshot(snapshot)
+
+	/* Changes made after the snapshot, some of them flushed while others stay in memdb */
+	for i := 0; i < keys; i++ {
+		require.NoError(t, db.Put(key(i), val(i, 1)))
+	}
+	require.NoError(t, db.Delete(key(3)))
+	require.NoError(t, db.Put(key(keys), val(keys, 1)))
+	require.NoError(t, db.waitForBackgroundWork())
+
+	iter, err := db.RangeScanWithOptions(key(0), key(keys), ReadOptions{Snapshot: snapshot})
+	require.NoError(t, err)
+	for i := 0; i < keys; i++ {
+		require.Equal(t, key(i), iter.Key())
+		require.Equal(t, val(i, 0), iter.Value())
+		iter.Next()
+	}
+	require.Nil(t, iter.Key())
+}
@@ -0,0 +1,182 @@
+package db
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/chettriyuvraj/leveldb-clone/common"
+	"github.com/chettriyuvraj/leveldb-clone/sstable"
+)
+
+/*
+- Keeps up to 'capacity' SSTables open, tables are opened on first use and the least recently used one is closed to make room for another
+- A table handed out by get stays open until it is released, even if it is evicted in the meantime - so the cap may be exceeded while evicted tables are still being read
+- Safe for concurrent use
+*/
+type tableCache struct {
+	mu       sync.Mutex
+	capacity int
+	open     func(number uint64, cf *columnFamily) (sstable.SSTableDB, error)
+	tables   map[uint64]*list.Element /* Cached handles, by file number */
+	lru      *list.List               /* Most recently used at the front */
+}
+
+/* An open SSTable, its file is closed once it is out of the cache and no reader references it */
+type tableHandle struct {
+	number uint64
+	sst    sstable.SSTableDB
+	refs   int /* References held by readers, +1 while the handle is in the cache */
+}
+
+func newTableCache(capacity int, open func(number uint64, cf *columnFamily) (sstable.SSTableDB, error)) *tableCache {
+	return &tableCache{capacity: capacity, open: open, tables: map[uint64]*list.Element{}, lru: list.New()}
+}
+
+/* Returns the table with the given file number, opening it with the options of its column family cf if needed - it must be released once it is no longer read */
+func (tc *tableCache) get(number uint64, cf *columnFamily) (*tableHandle, error) {
+	tc.mu.Lock()
+	if elem, ok := tc.tables[number]; ok {
+		tc.lru.MoveToFront(elem)
+		handle := elem.Value.(*tableHandle)
+		handle.refs++
+		tc.mu.Unlock()
+		return handle, nil
+	}
+	tc.mu.Unlock()
+
+	/* Opened without holding mu so that reads of cached tables don't wait for the file to be read */
+	sst, err := tc.open(number, cf)
+	if err != nil {
+		return nil, err
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	/* Someone else may have opened the same table in the meantime, use theirs */
+	if elem, ok := tc.tables[number]; ok {
+		sst.Close()
+		tc.lru.MoveToFront(elem)
+		handle := elem.Value.(*tableHandle)
+		handle.refs++
+		return handle, nil
+	}
+
+	handle := &tableHandle{number: number, sst: sst, refs: 2}
+	tc.tables[number] = tc.lru.PushFront(handle)
+	for tc.lru.Len() > tc.capacity {
+		tc.remove(tc.lru.Back())
+	}
+	return handle, nil
+}
+
+func (tc *tableCache) release(handle *tableHandle) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.unref(handle)
+}
+
+/* Drops the table from the cache, e.g. once its file is deleted - it is closed once its last reader releases it */
+func (tc *tableCache) evict(number uint64) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if elem, ok := tc.tables[number]; ok {
+		tc.remove(elem)
+	}
+}
+
+/* Evicts every table */
+func (tc *tableCache) close() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	for tc.lru.Len() > 0 {
+		tc.remove(tc.lru.Back())
+	}
+}
+
+/* Number of tables in the cache */
+func (tc *tableCache) len() int {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.lru.Len()
+}
+
+/* Must be called with mu held */
+func (tc *tableCache) remove(elem *list.Element) {
+	handle := tc.lru.Remove(elem).(*tableHandle)
+	delete(tc.tables, handle.number)
+	tc.unref(handle)
+}
+
+/* Must be called with mu held */
+func (tc *tableCache) unref(handle *tableHandle) {
+	handle.refs--
+	if handle.refs == 0 {
+		handle.sst.Close()
+	}
+}
+
+/*
+- Iterates a single table, releasing it once exhausted or closed
+- An iterator which is abandoned before it is exhausted must be closed, so that the table can be closed once evicted
+*/
+type tableIterator struct {
+	common.Iterator
+	tc     *tableCache
+	handle *tableHandle
+}
+
+/* Iterates [start, limit] of the table, or all of it if both are nil */
+func newTableIterator(tc *tableCache, handle *tableHandle, start, limit []byte, ro sstable.ReadOptions) (*tableIterator, error) {
+	var iter common.Iterator
+	var err error
+	if start == nil && limit == nil {
+		iter, err = handle.sst.FullScanWithOptions(ro)
+	} else {
+		iter, err = handle.sst.RangeScanWithOptions(start, limit, ro)
+	}
+	if err != nil {
+		tc.release(handle)
+		return nil, err
+	}
+
+	tableIter := &tableIterator{Iterator: iter, tc: tc, handle: handle}
+	if iter.Key() == nil && iter.Error() == nil {
+		tableIter.Close()
+	}
+	return tableIter, nil
+}
+
+func (iter *tableIterator) Next() bool {
+	if iter.handle == nil {
+		return false
+	}
+	if iter.Iterator.Next() {
+		return true
+	}
+	if iter.Iterator.Error() == nil {
+		iter.Close()
+	}
+	return false
+}
+
+func (iter *tableIterator) Key() []byte {
+	if iter.handle == nil {
+		return nil
+	}
+	return iter.Iterator.Key()
+}
+
+func (iter *tableIterator) Value() []byte {
+	if iter.handle == nil {
+		return nil
+	}
+	return iter.Iterator.Value()
+}
+
+func (iter *tableIterator) Close() error {
+	if iter.handle != nil {
+		iter.tc.release(iter.handle)
+		iter.handle = nil
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTableCache(t *testing.T) {
+	defer cleanupTestDB(t)
+
+	/* Many more tables than may be open at once */
+	const maxOpenFiles = 3
+	opts := TESTLEVELEDOPTIONS
+	opts.MaxOpenFiles = maxOpenFiles
+	db, err := NewDB(NewDBConfigWithOptions(30, true, TESTDBCONFIG.dirName, opts))
+	require.NoError(t, err)
+	defer db.Close()
+
+	const keys = 100
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	val := func(i int) []byte { return []byte(fmt.Sprintf("val%03d", i)) }
+	for i := 0; i < keys; i++ {
+		require.NoError(t, db.Put(key(i), val(i)))
+	}
+	require.NoError(t, db.waitForBackgroundWork())
+	require.Greater(t, len(db.versions.defaultColumnFamily().current.liveFiles()), 2*maxOpenFiles)
+
+	for i := 0; i < keys; i++ {
+		v, err := db.Get(key(i))
+		require.NoError(t, err)
+		require.Equal(t, val(i), v)
+		require.LessOrEqual(t, db.tableCache.len(), maxOpenFiles)
+	}
+
+	/* Gets in the middle of a scan evict the table being scanned, it must stay readable until the scan moves past it */
+	iter, err := db.RangeScan(key(0), key(keys))
+	require.NoError(t, err)
+	for i := 0; i < keys; i++ {
+		require.Equal(t, key(i), iter.Key())
+		require.Equal(t, val(i), iter.Value())
+		_, err := db.Get(key(keys - 1 - i))
+		require.NoError(t, err)
+		iter.Next()
+	}
+	require.Nil(t, iter.Key())
+	require.NoError(t, iter.Error())
+
+	/* A scan which is closed halfway releases its tables */
+	mergeIter, err := NewMergeIterator(db, key(0), key(keys))
+	require.NoError(t, err)
+	for i := 0; i < keys/2; i++ {
+		mergeIter.Next()
+	}
+	require.NoError(t, mergeIter.Close())
+	requireTablesReleased(t, db)
+}
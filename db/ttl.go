@@ -0,0 +1,47 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/chettriyuvraj/leveldb-clone/common"
+)
+
+/*
+- A value written with a TTL is stored with type common.TypeValueWithExpiry as [expiry(8 bytes):value], the expiry being the Unix time in nanoseconds at which it expires, in Big-Endian
+- Once expired it reads exactly as a deletion written in its place would, hiding the older versions of its key too
+- Expiry is checked against Options.Clock, as of when a read starts (an iterator keeps that time throughout) or when a compaction runs
+*/
+
+const EXPIRYLEN = 8
+
+var ErrInvalidTTL = errors.New("TTL must be positive")
+var ErrInvalidExpiringValue = errors.New("value with an expiry is too short to hold it")
+
+func encodeExpiringValue(expiresAt time.Time, val []byte) []byte {
+	data := binary.BigEndian.AppendUint64(make([]byte, 0, EXPIRYLEN+len(val)), uint64(expiresAt.UnixNano()))
+	return append(data, val...)
+}
+
+func decodeExpiringValue(data []byte) (expiresAt int64, val []byte, err error) {
+	if len(data) < EXPIRYLEN {
+		return 0, nil, ErrInvalidExpiringValue
+	}
+	return int64(binary.BigEndian.Uint64(data)), data[EXPIRYLEN:], nil
+}
+
+/* Value of a version of type valueType as the user sees it at time now (Unix nanoseconds), expired is true if it is a value whose expiry has passed */
+func resolveExpiry(valueType common.ValueType, data []byte, now int64) (val []byte, expired bool, err error) {
+	if valueType != common.TypeValueWithExpiry {
+		return data, false, nil
+	}
+	expiresAt, val, err := decodeExpiringValue(data)
+	if err != nil {
+		return nil, false, err
+	}
+	if now >= expiresAt {
+		return nil, true, nil
+	}
+	return val, false, nil
+}
@@ -0,0 +1,196 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chettriyuvraj/leveldb-clone/common"
+	"github.com/chettriyuvraj/leveldb-clone/memdb"
+	"github.com/stretchr/testify/require"
+)
+
+/* Clock which only moves when the test advances it, background compactions read it too */
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestTTL(t *testing.T) {
+	dirName := t.TempDir()
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	opts := TESTLEVELEDOPTIONS
+	opts.Clock = clock.Now
+
+	/* Even keys expire in a minute and odd keys in an hour, every fourth key has an older value without a TTL below */
+	const keys = 60
+	db, err := NewDB(NewDBConfigWithOptions(1<<20, true, dirName, opts))
+	require.NoError(t, err)
+	require.ErrorIs(t, db.PutWithTTL(key(0), key(0), 0), ErrInvalidTTL)
+	for i := 0; i < keys; i += 4 {
+		require.NoError(t, db.Put(key(i), []byte("old")))
+	}
+	for i := 0; i < keys; i++ {
+		ttl := time.Hour
+		if i%2 == 0 {
+			ttl = time.Minute
+		}
+		require.NoError(t, db.PutWithTTL(key(i), key(i), ttl))
+	}
+
+	check := func(db *DB, expired bool) {
+		for i := 0; i < keys; i++ {
+			v, err := db.Get(key(i))
+			if expired && i%2 == 0 {
+				require.ErrorIs(t, err, common.ErrKeyDoesNotExist, "key %d", i)
+				continue
+			}
+			require.NoError(t, err)
+			require.Equal(t, key(i), v)
+		}
+
+		iter, err := db.RangeScan(nil, nil)
+		require.NoError(t, err)
+		for i := 0; i < keys; i++ {
+			if expired && i%2 == 0 {
+				continue
+			}
+			require.Equal(t, key(i), iter.Key())
+			require.Equal(t, key(i), iter.Value())
+			iter.Next()
+		}
+		require.Nil(t, iter.Key())
+		require.NoError(t, iter.Error())
+	}
+	check(db, false)
+
+	/* Expired keys read as deleted, an iterator keeps checking expiry as of when it was opened */
+	iter, err := db.RangeScan(nil, nil)
+	require.NoError(t, err)
+	clock.Advance(2 * time.Minute)
+	check(db, true)
+	for i := 0; i < keys; i++ {
+		require.Equal(t, key(i), iter.Key())
+		iter.Next()
+	}
+	has, err := db.Has(key(0))
+	require.NoError(t, err)
+	require.False(t, has)
+	require.ErrorIs(t, db.Delete(key(0)), common.ErrKeyDoesNotExist)
+	require.NoError(t, db.Close())
+
+	/* Expiries are kept in the WAL, recovery flushes every value to a single level 0 table */
+	db, err = NewDB(NewDBConfigWithOptions(1<<20, false, dirName, opts))
+	require.NoError(t, err)
+	check(db, true)
+	require.Equal(t, keys/2, expiredValues(t, db, clock))
+	require.NoError(t, db.Close())
+
+	db, err = NewDB(NewDBConfigWithOptions(100, false, dirName, opts))
+	require.NoError(t, err)
+	defer db.Close()
+
+	/* Rewriting the odd keys compacts that table, the expired values are dropped from every table */
+	for round := 0; round < 3; round++ {
+		for i := 1; i < keys; i += 2 {
+			require.NoError(t, db.PutWithTTL(key(i), key(i), time.Hour))
+		}
+	}
+	require.NoError(t, db.waitForBackgroundWork())
+	require.Zero(t, expiredValues(t, db, clock))
+	check(db, true)
+}
+
+/* Number of values in the tables of the default column family which have expired */
+func expiredValues(t *testing.T, db *DB, clock *testClock) int {
+	db.mu.Lock()
+	cf := db.versions.defaultColumnFamily()
+	files := []*FileMetadata{}
+	for level := 0; level < cf.current.NumLevels(); level++ {
+		files = append(files, cf.current.Files(level)...)
+	}
+	db.mu.Unlock()
+
+	iter, err := newTablesMergeIterator(db.tableCache, cf, files)
+	require.NoError(t, err)
+	count := 0
+	for ; iter.Key() != nil; iter.Next() {
+		_, _, valueType, err := common.ParseInternalKey(iter.Key())
+		require.NoError(t, err)
+		_, expired, err := resolveExpiry(valueType, iter.Value(), clock.Now().UnixNano())
+		require.NoError(t, err)
+		if expired {
+			count++
+		}
+	}
+	require.NoError(t, iter.Error())
+	return count
+}
+
+func TestCompactionDropsExpiredValues(t *testing.T) {
+	/* A value at 2, below a value expiring at 100 (Unix nanoseconds) written at 4, optionally with operands at 5 and 6 on top */
+	const expiresAt = 100
+	entries := func(withOperands bool) *memdb.MemDB {
+		mem, err := memdb.NewMemDB()
+		require.NoError(t, err)
+		k := []byte("key")
+		require.NoError(t, mem.Add(2, common.TypeValue, k, []byte("old")))
+		require.NoError(t, mem.Add(4, common.TypeValueWithExpiry, k, encodeExpiringValue(time.Unix(0, expiresAt), []byte("v"))))
+		if withOperands {
+			for _, seq := range []uint64{5, 6} {
+				require.NoError(t, mem.Add(seq, common.TypeMerge, k, []byte(fmt.Sprintf("%d", seq))))
+			}
+		}
+		return mem
+	}
+	expiring := string(encodeExpiringValue(time.Unix(0, expiresAt), []byte("v")))
+
+	type entry struct {
+		seq       uint64
+		valueType common.ValueType
+		val       string
+	}
+	tcs := []struct {
+		name             string
+		withOperands     bool
+		isBaseLevel      bool
+		smallestSnapshot uint64
+		now              int64
+		want             []entry
+	}{
+		{name: "not expired", isBaseLevel: true, smallestSnapshot: 9, now: 50, want: []entry{{4, common.TypeValueWithExpiry, expiring}}},
+		{name: "expired", isBaseLevel: true, smallestSnapshot: 9, now: expiresAt, want: []entry{}},
+		{name: "expired with older versions in deeper levels", smallestSnapshot: 9, now: 150, want: []entry{{4, common.TypeDeletion, ""}}},
+		{name: "expired but newer than a snapshot", isBaseLevel: true, smallestSnapshot: 3, now: 150, want: []entry{{4, common.TypeValueWithExpiry, expiring}, {2, common.TypeValue, "old"}}},
+		{name: "operands on a value yet to expire", withOperands: true, isBaseLevel: true, smallestSnapshot: 9, now: 50, want: []entry{{6, common.TypeMerge, "56"}, {4, common.TypeValueWithExpiry, expiring}}},
+		{name: "operands on an expired value", withOperands: true, smallestSnapshot: 9, now: 150, want: []entry{{6, common.TypeValue, "56"}}},
+	}
+	for _, tc := range tcs {
+		internalIter, err := entries(tc.withOperands).InternalScan(nil, nil)
+		require.NoError(t, err)
+		iter := newDroppingIterator(internalIter, common.BytewiseComparator, concatOperator{}, tc.smallestSnapshot, tc.now, func(key []byte) bool { return tc.isBaseLevel })
+
+		got := []entry{}
+		for ; iter.Key() != nil; iter.Next() {
+			_, seq, valueType, err := common.ParseInternalKey(iter.Key())
+			require.NoError(t, err)
+			got = append(got, entry{seq, valueType, string(iter.Value())})
+		}
+		require.NoError(t, iter.Error())
+		require.Equal(t, tc.want, got, tc.name)
+	}
+}
@@ -0,0 +1,424 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/chettriyuvraj/leveldb-clone/common"
+)
+
+var ErrManifestRead = errors.New("error reading MANIFEST")
+var ErrManifestWrite = errors.New("error writing to MANIFEST")
+var ErrInvalidLevel = errors.New("file level exceeds the number of levels of the DB")
+var ErrComparatorMismatch = errors.New("comparator does not match the one the DB was created with")
+
+/* Describes a single SSTable file which is part of a version */
+type FileMetadata struct {
+	number            uint64
+	size              uint64 /* In bytes */
+	smallest, largest []byte /* Internal keys */
+}
+
+func (meta *FileMetadata) Number() uint64 {
+	return meta.number
+}
+
+/*
+- A version is an immutable snapshot of the SSTables that make up a column family, grouped by level
+- Level 0 files are sorted by file number (oldest first) and may overlap, files in other levels are sorted by smallest key and never overlap
+- All versions of a user key within a level other than 0 are kept in a single file
+*/
+type Version struct {
+	levels [][]*FileMetadata
+	icmp   *common.InternalKeyComparator
+	refs   int /* Readers + the version set itself while this is the current version, the files of a version are kept as long as it has references */
+}
+
+func newVersion(numLevels int, icmp *common.InternalKeyComparator) *Version {
+	return &Version{levels: make([][]*FileMetadata, numLevels), icmp: icmp}
+}
+
+func (v *Version) NumLevels() int {
+	return len(v.levels)
+}
+
+func (v *Version) Files(level int) []*FileMetadata {
+	return v.levels[level]
+}
+
+/* Total size of all files in the level in bytes */
+func (v *Version) LevelSize(level int) uint64 {
+	size := uint64(0)
+	for _, f := range v.levels[level] {
+		size += f.size
+	}
+	return size
+}
+
+/* Creates a new version by applying the edit to v, v itself is left untouched */
+func (v *Version) apply(edit *VersionEdit) (*Version, error) {
+	deleted := map[deletedFile]bool{}
+	for _, f := range edit.deletedFiles {
+		deleted[f] = true
+	}
+
+	next := newVersion(v.NumLevels(), v.icmp)
+	for level, files := range v.levels {
+		for _, f := range files {
+			if !deleted[deletedFile{level: level, number: f.number}] {
+				next.levels[level] = append(next.levels[level], f)
+			}
+		}
+	}
+	for _, f := range edit.newFiles {
+		if f.level < 0 || f.level >= next.NumLevels() {
+			return nil, ErrInvalidLevel
+		}
+		next.levels[f.level] = append(next.levels[f.level], f.meta)
+	}
+
+	for level, files := range next.levels {
+		if level == 0 {
+			sort.Slice(files, func(i, j int) bool { return files[i].number < files[j].number })
+			continue
+		}
+		sort.Slice(files, func(i, j int) bool { return v.icmp.Compare(files[i].smallest, files[j].smallest) < 0 })
+	}
+
+	return next, nil
+}
+
+/* Returns all file numbers part of this version */
+func (v *Version) liveFiles() map[uint64]bool {
+	live := map[uint64]bool{}
+	for _, files := range v.levels {
+		for _, f := range files {
+			live[f.number] = true
+		}
+	}
+	return live
+}
+
+/*
+- The version set holds the column families (each with its current version) + counters which must survive restarts
+- Every change is appended as a version edit to the MANIFEST before it is installed, CURRENT names the MANIFEST in use
+*/
+type VersionSet struct {
+	dirName         string
+	opts            Options
+	families        map[uint32]*columnFamily /* Column families by ID, a family is removed once dropped */
+	maxColumnFamily uint32                   /* Largest column family ID handed out, IDs are never reused so that a dropped family's writes in the logs stay ignored */
+	nextFileNumber  uint64
+	lastSequence    uint64
+	manifestNumber  uint64
+	manifest        *os.File
+	versions        map[*Version]bool /* Every version of any family which still has references, including the current ones */
+}
+
+/* Loads the version set from the MANIFEST pointed to by CURRENT (or creates a fresh one), then starts a new MANIFEST containing a snapshot of it */
+func OpenVersionSet(dirName string, opts Options) (*VersionSet, error) {
+	vs := &VersionSet{dirName: dirName, opts: opts, families: map[uint32]*columnFamily{}, nextFileNumber: 1, versions: map[*Version]bool{}}
+	vs.addColumnFamily(DEFAULTCOLUMNFAMILYID, DEFAULTCOLUMNFAMILYNAME, opts)
+
+	manifestNumber, err := readCurrentFile(dirName)
+	if err != nil && !errors.Is(err, ErrNoCurrentFile) {
+		return nil, errors.Join(ErrManifestRead, err)
+	}
+	if err == nil {
+		if err := vs.recover(manifestFileName(dirName, manifestNumber)); err != nil {
+			return nil, errors.Join(ErrManifestRead, err)
+		}
+	}
+
+	if err := vs.writeSnapshotManifest(); err != nil {
+		return nil, errors.Join(ErrManifestWrite, err)
+	}
+
+	return vs, nil
+}
+
+/* Replays every edit in the manifest in order, every column family must be opened with a comparator of the same name as the one it was created with */
+func (vs *VersionSet) recover(manifestPath string) error {
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+
+	for offset := 0; offset+4 <= len(data); {
+		recordLen := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		offset += 4
+		/* An incomplete record at the end was never acknowledged, so we can ignore it */
+		if offset+recordLen > len(data) {
+			break
+		}
+
+		edit := VersionEdit{}
+		if err := edit.UnmarshalBinary(data[offset : offset+recordLen]); err != nil {
+			return err
+		}
+		offset += recordLen
+
+		if err := vs.applyEdit(&edit); err != nil {
+			return err
+		}
+		if edit.hasNextFileNumber {
+			vs.nextFileNumber = edit.nextFileNumber
+		}
+		if edit.hasLastSequence {
+			vs.lastSequence = edit.lastSequence
+		}
+		if edit.hasMaxColumnFamily && edit.maxColumnFamily > vs.maxColumnFamily {
+			vs.maxColumnFamily = edit.maxColumnFamily
+		}
+	}
+
+	return nil
+}
+
+/* Creates a new manifest with an edit describing the current version of each column family, and points CURRENT to it */
+func (vs *VersionSet) writeSnapshotManifest() error {
+	oldManifest, oldManifestNumber := vs.manifest, vs.manifestNumber
+	manifestNumber := vs.NewFileNumber()
+	f, err := os.OpenFile(manifestFileName(vs.dirName, manifestNumber), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	vs.manifest, vs.manifestNumber = f, manifestNumber
+
+	for _, cf := range vs.columnFamilies() {
+		snapshot := VersionEdit{}
+		snapshot.SetColumnFamily(cf.id)
+		if cf.id != DEFAULTCOLUMNFAMILYID {
+			snapshot.AddColumnFamily(cf.name)
+		}
+		snapshot.SetComparatorName(cf.opts.Comparator.Name())
+		for level, key := range cf.compactPointers {
+			if key != nil {
+				snapshot.SetCompactPointer(level, key)
+			}
+		}
+		for level, files := range cf.current.levels {
+			for _, meta := range files {
+				snapshot.AddFile(level, meta)
+			}
+		}
+		if err := vs.writeEdit(&snapshot); err != nil {
+			return err
+		}
+	}
+
+	if err := setCurrentFile(vs.dirName, manifestNumber); err != nil {
+		return err
+	}
+
+	if oldManifest != nil {
+		oldManifest.Close()
+	}
+	if oldManifestNumber != 0 {
+		os.Remove(manifestFileName(vs.dirName, oldManifestNumber))
+	}
+	return nil
+}
+
+/* Fills in the counters + the log number of the edit's column family, appends the edit to the manifest and syncs it */
+func (vs *VersionSet) writeEdit(edit *VersionEdit) error {
+	edit.SetNextFileNumber(vs.nextFileNumber)
+	edit.SetLastSequence(vs.lastSequence)
+	edit.SetMaxColumnFamily(vs.maxColumnFamily)
+	if cf, ok := vs.families[edit.columnFamily]; ok && !edit.hasLogNumber {
+		edit.SetLogNumber(cf.logNumber)
+	}
+
+	data, err := edit.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	record := binary.BigEndian.AppendUint32([]byte{}, uint32(len(data)))
+	record = append(record, data...)
+
+	if _, err := vs.manifest.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	if _, err := vs.manifest.Write(record); err != nil {
+		return err
+	}
+	return vs.manifest.Sync()
+}
+
+/* Persists the edit to the manifest, and only then installs the resulting version as current */
+func (vs *VersionSet) LogAndApply(edit *VersionEdit) error {
+	if err := vs.writeEdit(edit); err != nil {
+		return errors.Join(ErrManifestWrite, err)
+	}
+	return vs.applyEdit(edit)
+}
+
+/*
+- Creates, drops or installs the version resulting from the edit in the edit's column family, along with the compaction pointers + log number it carries
+- A family created by a replayed edit takes its options from Options.ColumnFamilies
+*/
+func (vs *VersionSet) applyEdit(edit *VersionEdit) error {
+	if edit.isColumnFamilyAdd {
+		if _, ok := vs.families[edit.columnFamily]; ok {
+			return ErrColumnFamilyExists
+		}
+		vs.addColumnFamily(edit.columnFamily, edit.columnFamilyName, vs.opts.columnFamilyOptions(edit.columnFamilyName))
+	}
+	cf, ok := vs.families[edit.columnFamily]
+	if !ok {
+		return ErrColumnFamilyNotFound
+	}
+	if edit.isColumnFamilyDrop {
+		cf.dropped = true
+		delete(vs.families, cf.id)
+		vs.Unref(cf.current)
+		return nil
+	}
+	if edit.hasComparatorName && edit.comparatorName != cf.opts.Comparator.Name() {
+		return fmt.Errorf("%w: column family %q uses %q, opened with %q", ErrComparatorMismatch, cf.name, edit.comparatorName, cf.opts.Comparator.Name())
+	}
+
+	next, err := cf.current.apply(edit)
+	if err != nil {
+		return err
+	}
+	for _, pointer := range edit.compactPointers {
+		if pointer.level < 0 || pointer.level >= len(cf.compactPointers) {
+			return ErrInvalidLevel
+		}
+		cf.compactPointers[pointer.level] = pointer.key
+	}
+	if edit.hasLogNumber {
+		cf.logNumber = edit.logNumber
+	}
+	vs.setCurrent(cf, next)
+	return nil
+}
+
+/* Sets up an empty column family, without recording it in the MANIFEST */
+func (vs *VersionSet) addColumnFamily(id uint32, name string, opts Options) *columnFamily {
+	cf := &columnFamily{id: id, name: name, opts: opts, icmp: common.NewInternalKeyComparator(opts.Comparator), compactPointers: make([][]byte, opts.NumLevels)}
+	vs.setCurrent(cf, newVersion(opts.NumLevels, cf.icmp))
+	vs.families[id] = cf
+	if id > vs.maxColumnFamily {
+		vs.maxColumnFamily = id
+	}
+	return cf
+}
+
+/* Records a new column family in the MANIFEST and sets it up, logs older than logNumber hold none of its writes */
+func (vs *VersionSet) CreateColumnFamily(name string, opts Options, logNumber uint64) (*columnFamily, error) {
+	id := vs.maxColumnFamily + 1
+	vs.maxColumnFamily = id
+
+	edit := VersionEdit{}
+	edit.SetColumnFamily(id)
+	edit.AddColumnFamily(name)
+	edit.SetComparatorName(opts.Comparator.Name())
+	edit.SetLogNumber(logNumber)
+	if err := vs.writeEdit(&edit); err != nil {
+		return nil, errors.Join(ErrManifestWrite, err)
+	}
+
+	cf := vs.addColumnFamily(id, name, opts)
+	cf.logNumber = logNumber
+	return cf, nil
+}
+
+/* Records the drop in the MANIFEST and removes the family, its files stay live as long as readers reference its versions */
+func (vs *VersionSet) DropColumnFamily(cf *columnFamily) error {
+	edit := VersionEdit{}
+	edit.SetColumnFamily(cf.id)
+	edit.DropColumnFamily()
+	return vs.LogAndApply(&edit)
+}
+
+/* Every column family ordered by ID, i.e. the default family first and the others in the order they were created */
+func (vs *VersionSet) columnFamilies() []*columnFamily {
+	families := make([]*columnFamily, 0, len(vs.families))
+	for _, cf := range vs.families {
+		families = append(families, cf)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].id < families[j].id })
+	return families
+}
+
+func (vs *VersionSet) defaultColumnFamily() *columnFamily {
+	return vs.families[DEFAULTCOLUMNFAMILYID]
+}
+
+func (vs *VersionSet) setCurrent(cf *columnFamily, v *Version) {
+	vs.Ref(v)
+	if cf.current != nil {
+		vs.Unref(cf.current)
+	}
+	cf.current = v
+}
+
+/* Keeps the files of v around until the matching Unref, even after it stops being the current version */
+func (vs *VersionSet) Ref(v *Version) {
+	v.refs++
+	vs.versions[v] = true
+}
+
+/* Returns true if this was the last reference to v, i.e. files which only belonged to v are no longer needed */
+func (vs *VersionSet) Unref(v *Version) bool {
+	v.refs--
+	if v.refs > 0 {
+		return false
+	}
+	delete(vs.versions, v)
+	return true
+}
+
+/* Returns all file numbers part of any version which still has references */
+func (vs *VersionSet) liveFiles() map[uint64]bool {
+	live := map[uint64]bool{}
+	for v := range vs.versions {
+		for number := range v.liveFiles() {
+			live[number] = true
+		}
+	}
+	return live
+}
+
+/* Allocates a new file number, numbers are never reused */
+func (vs *VersionSet) NewFileNumber() uint64 {
+	num := vs.nextFileNumber
+	vs.nextFileNumber++
+	return num
+}
+
+/* Oldest log number of any column family, older logs hold no writes which are not in SSTables */
+func (vs *VersionSet) LogNumber() uint64 {
+	logNumber := vs.defaultColumnFamily().logNumber
+	for _, cf := range vs.families {
+		if cf.logNumber < logNumber {
+			logNumber = cf.logNumber
+		}
+	}
+	return logNumber
+}
+
+func (vs *VersionSet) LastSequence() uint64 {
+	return vs.lastSequence
+}
+
+func (vs *VersionSet) SetLastSequence(seq uint64) {
+	vs.lastSequence = seq
+}
+
+func (vs *VersionSet) ManifestNumber() uint64 {
+	return vs.manifestNumber
+}
+
+func (vs *VersionSet) Close() error {
+	if vs.manifest == nil {
+		return nil
+	}
+	return vs.manifest.Close()
+}
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionEditMarshal(t *testing.T) {
+	edit := VersionEdit{}
+	edit.SetComparatorName("leveldb.BytewiseComparator")
+	edit.SetLogNumber(3)
+	edit.SetNextFileNumber(9)
+	edit.SetLastSequence(42)
+	edit.DeleteFile(0, 4)
+	edit.AddFile(1, &FileMetadata{number: 7, size: 100, smallest: []byte("key1"), largest: []byte("key5")})
+	edit.AddFile(0, &FileMetadata{number: 8, size: 50, smallest: []byte("a"), largest: []byte("z")})
+
+	data, err := edit.MarshalBinary()
+	require.NoError(t, err)
+
+	got := VersionEdit{}
+	require.NoError(t, got.UnmarshalBinary(data))
+	require.Equal(t, edit, got)
+
+	/* Truncated edits must not decode */
+	require.ErrorIs(t, (&VersionEdit{}).UnmarshalBinary(data[:len(data)-1]), ErrVersionEditDecode)
+
+	/* Edits creating + dropping column families */
+	add, drop := VersionEdit{}, VersionEdit{}
+	add.SetColumnFamily(5)
+	add.AddColumnFamily("users")
+	add.SetMaxColumnFamily(5)
+	drop.SetColumnFamily(5)
+	drop.DropColumnFamily()
+	for _, edit := range []VersionEdit{add, drop} {
+		data, err := edit.MarshalBinary()
+		require.NoError(t, err)
+		got := VersionEdit{}
+		require.NoError(t, got.UnmarshalBinary(data))
+		require.Equal(t, edit, got)
+	}
+}
+
+func TestManifestRecovery(t *testing.T) {
+	defer cleanupTestDB(t)
+
+	config := DBConfig{dirName: TESTDBCONFIG.dirName, memdbLimit: 13, createNew: true}
+	db1, err := NewDB(config)
+	require.NoError(t, err)
+	for i := 1; i <= 12; i++ {
+		k, v := []byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i))
+		require.NoError(t, db1.Put(k, v))
+	}
+	require.NoError(t, db1.waitForBackgroundWork())
+	levelsWant := [][]*FileMetadata{}
+	for level := 0; level < db1.versions.defaultColumnFamily().current.NumLevels(); level++ {
+		levelsWant = append(levelsWant, db1.versions.defaultColumnFamily().current.Files(level))
+	}
+	require.NotEmpty(t, levelsWant[0])
+	require.NoError(t, db1.Close())
+
+	/* A stray SSTable which is not part of the MANIFEST should be ignored and cleaned up */
+	strayPath := sstFileName(config.dirName, 999)
+	require.NoError(t, os.WriteFile(strayPath, []byte("garbage"), 0666))
+
+	config.createNew = false
+	db2, err := NewDB(config)
+	require.NoError(t, err)
+	defer db2.Close()
+	/* What the memdb held is recovered from the WAL into one more level 0 table */
+	levelsWant[0] = append(levelsWant[0], db2.versions.defaultColumnFamily().current.Files(0)[len(levelsWant[0])])
+	for level := 0; level < db2.versions.defaultColumnFamily().current.NumLevels(); level++ {
+		require.Equal(t, levelsWant[level], db2.versions.defaultColumnFamily().current.Files(level))
+	}
+	exists, err := fileOrDirExists(strayPath)
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	/* Data flushed to SSTables or recovered from the WAL is visible after reopening */
+	for i := 1; i <= 12; i++ {
+		v, err := db2.Get([]byte(fmt.Sprintf("key%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("val%d", i)), v)
+	}
+}
+
+func TestFileNumbersNotReused(t *testing.T) {
+	defer cleanupTestDB(t)
+
+	config := DBConfig{dirName: TESTDBCONFIG.dirName, memdbLimit: 13, createNew: true}
+	db1, err := NewDB(config)
+	require.NoError(t, err)
+	for i := 1; i <= 4; i++ {
+		require.NoError(t, db1.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i))))
+	}
+	require.NoError(t, db1.waitForBackgroundWork())
+	files := db1.versions.defaultColumnFamily().current.Files(0)
+	require.NotEmpty(t, files)
+	lastNumber := files[len(files)-1].number
+	require.NoError(t, db1.Close())
+
+	/* Numbers allocated after a restart must be greater than any number handed out before */
+	config.createNew = false
+	db2, err := NewDB(config)
+	require.NoError(t, err)
+	defer db2.Close()
+	require.Greater(t, db2.versions.NewFileNumber(), lastNumber)
+}
@@ -0,0 +1,272 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/* Tags identifying each field of an encoded version edit */
+const (
+	EDITTAGLOGNUMBER = byte(iota + 1)
+	EDITTAGNEXTFILENUMBER
+	EDITTAGLASTSEQUENCE
+	EDITTAGDELETEDFILE
+	EDITTAGNEWFILE
+	EDITTAGCOMPACTPOINTER
+	EDITTAGCOMPARATOR
+	EDITTAGCOLUMNFAMILY
+	EDITTAGCOLUMNFAMILYADD
+	EDITTAGCOLUMNFAMILYDROP
+	EDITTAGMAXCOLUMNFAMILY
+)
+
+var ErrVersionEditDecode = errors.New("error decoding version edit")
+
+type deletedFile struct {
+	level  int
+	number uint64
+}
+
+type newFile struct {
+	level int
+	meta  *FileMetadata
+}
+
+type compactPointer struct {
+	level int
+	key   []byte
+}
+
+/*
+- A version edit is a delta between two versions of the DB, every flush/compaction produces one
+- Edits are appended to the MANIFEST, replaying all of them in order gives us the current version
+- An edit applies to a single column family, the default one unless set otherwise - the counters (next file number, last sequence, max column family) are shared by every family
+*/
+type VersionEdit struct {
+	columnFamily       uint32
+	columnFamilyName   string /* Set when the edit creates the column family */
+	isColumnFamilyAdd  bool
+	isColumnFamilyDrop bool
+	maxColumnFamily    uint32
+	hasMaxColumnFamily bool
+	comparatorName     string
+	hasComparatorName  bool
+	logNumber          uint64
+	hasLogNumber       bool
+	nextFileNumber     uint64
+	hasNextFileNumber  bool
+	lastSequence       uint64
+	hasLastSequence    bool
+	compactPointers    []compactPointer
+	deletedFiles       []deletedFile
+	newFiles           []newFile
+}
+
+func (edit *VersionEdit) SetColumnFamily(id uint32) {
+	edit.columnFamily = id
+}
+
+/* The edit creates the column family, the edit's other fields describe the new family */
+func (edit *VersionEdit) AddColumnFamily(name string) {
+	edit.columnFamilyName, edit.isColumnFamilyAdd = name, true
+}
+
+/* The edit drops the column family along with all of its files */
+func (edit *VersionEdit) DropColumnFamily() {
+	edit.isColumnFamilyDrop = true
+}
+
+func (edit *VersionEdit) SetMaxColumnFamily(id uint32) {
+	edit.maxColumnFamily, edit.hasMaxColumnFamily = id, true
+}
+
+func (edit *VersionEdit) SetComparatorName(name string) {
+	edit.comparatorName, edit.hasComparatorName = name, true
+}
+
+func (edit *VersionEdit) SetLogNumber(num uint64) {
+	edit.logNumber, edit.hasLogNumber = num, true
+}
+
+func (edit *VersionEdit) SetNextFileNumber(num uint64) {
+	edit.nextFileNumber, edit.hasNextFileNumber = num, true
+}
+
+func (edit *VersionEdit) SetLastSequence(seq uint64) {
+	edit.lastSequence, edit.hasLastSequence = seq, true
+}
+
+func (edit *VersionEdit) SetCompactPointer(level int, key []byte) {
+	edit.compactPointers = append(edit.compactPointers, compactPointer{level: level, key: key})
+}
+
+func (edit *VersionEdit) AddFile(level int, meta *FileMetadata) {
+	edit.newFiles = append(edit.newFiles, newFile{level: level, meta: meta})
+}
+
+func (edit *VersionEdit) DeleteFile(level int, number uint64) {
+	edit.deletedFiles = append(edit.deletedFiles, deletedFile{level: level, number: number})
+}
+
+/*
+Format: a sequence of [tag(1 byte):field], where field is
+- column family, max column family: 4 bytes - the column family is left out for the default family, so edits written before column families existed decode as edits of the default family
+- column family add: [name length(4 bytes):name], column family drop: nothing
+- comparator name: [name length(4 bytes):name]
+- log number, next file number, last sequence: 8 bytes
+- compact pointer: [level(4 bytes):key length(4 bytes):key]
+- deleted file: [level(4 bytes):file number(8 bytes)]
+- new file: [level(4 bytes):file number(8 bytes):file size(8 bytes):smallest key length(4 bytes):smallest key:largest key length(4 bytes):largest key]
+*/
+func (edit *VersionEdit) MarshalBinary() (data []byte, err error) {
+	if edit.columnFamily != DEFAULTCOLUMNFAMILYID {
+		data = append(data, EDITTAGCOLUMNFAMILY)
+		data = binary.BigEndian.AppendUint32(data, edit.columnFamily)
+	}
+	if edit.isColumnFamilyAdd {
+		data = append(data, EDITTAGCOLUMNFAMILYADD)
+		data = binary.BigEndian.AppendUint32(data, uint32(len(edit.columnFamilyName)))
+		data = append(data, edit.columnFamilyName...)
+	}
+	if edit.isColumnFamilyDrop {
+		data = append(data, EDITTAGCOLUMNFAMILYDROP)
+	}
+	if edit.hasMaxColumnFamily {
+		data = append(data, EDITTAGMAXCOLUMNFAMILY)
+		data = binary.BigEndian.AppendUint32(data, edit.maxColumnFamily)
+	}
+	if edit.hasComparatorName {
+		data = append(data, EDITTAGCOMPARATOR)
+		data = binary.BigEndian.AppendUint32(data, uint32(len(edit.comparatorName)))
+		data = append(data, edit.comparatorName...)
+	}
+	if edit.hasLogNumber {
+		data = append(data, EDITTAGLOGNUMBER)
+		data = binary.BigEndian.AppendUint64(data, edit.logNumber)
+	}
+	if edit.hasNextFileNumber {
+		data = append(data, EDITTAGNEXTFILENUMBER)
+		data = binary.BigEndian.AppendUint64(data, edit.nextFileNumber)
+	}
+	if edit.hasLastSequence {
+		data = append(data, EDITTAGLASTSEQUENCE)
+		data = binary.BigEndian.AppendUint64(data, edit.lastSequence)
+	}
+	for _, p := range edit.compactPointers {
+		data = append(data, EDITTAGCOMPACTPOINTER)
+		data = binary.BigEndian.AppendUint32(data, uint32(p.level))
+		data = binary.BigEndian.AppendUint32(data, uint32(len(p.key)))
+		data = append(data, p.key...)
+	}
+	for _, f := range edit.deletedFiles {
+		data = append(data, EDITTAGDELETEDFILE)
+		data = binary.BigEndian.AppendUint32(data, uint32(f.level))
+		data = binary.BigEndian.AppendUint64(data, f.number)
+	}
+	for _, f := range edit.newFiles {
+		data = append(data, EDITTAGNEWFILE)
+		data = binary.BigEndian.AppendUint32(data, uint32(f.level))
+		data = binary.BigEndian.AppendUint64(data, f.meta.number)
+		data = binary.BigEndian.AppendUint64(data, f.meta.size)
+		data = binary.BigEndian.AppendUint32(data, uint32(len(f.meta.smallest)))
+		data = append(data, f.meta.smallest...)
+		data = binary.BigEndian.AppendUint32(data, uint32(len(f.meta.largest)))
+		data = append(data, f.meta.largest...)
+	}
+	return data, nil
+}
+
+func (edit *VersionEdit) UnmarshalBinary(data []byte) error {
+	d := editDecoder{data: data}
+	for d.err == nil && d.offset < len(data) {
+		tag := d.readByte()
+		switch tag {
+		case EDITTAGCOLUMNFAMILY:
+			edit.SetColumnFamily(d.readUint32())
+		case EDITTAGCOLUMNFAMILYADD:
+			edit.AddColumnFamily(string(d.readBytes()))
+		case EDITTAGCOLUMNFAMILYDROP:
+			edit.DropColumnFamily()
+		case EDITTAGMAXCOLUMNFAMILY:
+			edit.SetMaxColumnFamily(d.readUint32())
+		case EDITTAGCOMPARATOR:
+			edit.SetComparatorName(string(d.readBytes()))
+		case EDITTAGLOGNUMBER:
+			edit.SetLogNumber(d.readUint64())
+		case EDITTAGNEXTFILENUMBER:
+			edit.SetNextFileNumber(d.readUint64())
+		case EDITTAGLASTSEQUENCE:
+			edit.SetLastSequence(d.readUint64())
+		case EDITTAGCOMPACTPOINTER:
+			level := int(d.readUint32())
+			edit.SetCompactPointer(level, d.readBytes())
+		case EDITTAGDELETEDFILE:
+			level := int(d.readUint32())
+			edit.DeleteFile(level, d.readUint64())
+		case EDITTAGNEWFILE:
+			level := int(d.readUint32())
+			meta := &FileMetadata{}
+			meta.number = d.readUint64()
+			meta.size = d.readUint64()
+			meta.smallest = d.readBytes()
+			meta.largest = d.readBytes()
+			edit.AddFile(level, meta)
+		default:
+			return ErrVersionEditDecode
+		}
+	}
+	return d.err
+}
+
+/* Helper to read fields in order while remembering the first error encountered */
+type editDecoder struct {
+	data   []byte
+	offset int
+	err    error
+}
+
+func (d *editDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if d.offset+n > len(d.data) {
+		d.err = ErrVersionEditDecode
+		return nil
+	}
+	b := d.data[d.offset : d.offset+n]
+	d.offset += n
+	return b
+}
+
+func (d *editDecoder) readByte() byte {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *editDecoder) readUint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *editDecoder) readUint64() uint64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (d *editDecoder) readBytes() []byte {
+	n := d.readUint32()
+	b := d.next(int(n))
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
@@ -0,0 +1,79 @@
+package db
+
+import "sync"
+
+/*
+- Writers queue up in db.writers, the writer at the front of the queue is the leader
+- The leader takes the writes of the writers queued behind it, logs all of them as a single WAL record with (at most) one sync, applies them to memdb and then wakes the writers whose writes it did
+- The writers it woke find their write done and return, the next writer in the queue becomes the leader
+- So concurrent writers share log appends and syncs instead of waiting for each other's, which is what keeps Sync writes fast under concurrency
+*/
+
+const (
+	MAXBATCHGROUPSIZE   = 1 << 20   /* Max size of the keys + values written by a batch group */
+	SMALLBATCHGROUPSIZE = 128 << 10 /* A group led by a write smaller than this only grows by this much, so that small writes aren't delayed by large ones */
+)
+
+type writer struct {
+	batch *WriteBatch
+	sync  bool
+	done  bool  /* Set once the leader has done the write */
+	err   error /* Result of the write, set along with done */
+	cond  *sync.Cond
+}
+
+/*
+- Returns the batch to be written by the leader at the front of the queue, along with the last writer whose write it holds
+- Stops at a writer wanting a sync if the leader doesn't, since the leader won't sync
+- Must be called with mu held by the leader
+*/
+func (db *DB) buildBatchGroup() (*WriteBatch, *writer) {
+	first := db.writers[0]
+	maxSize := MAXBATCHGROUPSIZE
+	if first.batch.size <= SMALLBATCHGROUPSIZE {
+		maxSize = first.batch.size + SMALLBATCHGROUPSIZE
+	}
+
+	group, last := first.batch, first
+	size := first.batch.size
+	for _, w := range db.writers[1:] {
+		if w.sync && !first.sync {
+			break
+		}
+		if size+w.batch.size > maxSize {
+			break
+		}
+		/* The leader's batch belongs to the caller, the group gets a batch of its own */
+		if group == first.batch {
+			group = NewWriteBatch()
+			group.appendBatch(first.batch)
+		}
+		group.appendBatch(w.batch)
+		size += w.batch.size
+		last = w
+	}
+	return group, last
+}
+
+/*
+- Removes the writers up to and including last from the queue, handing them the result of the write
+- Wakes up the next leader, or whoever is waiting for the queue to drain
+- Must be called with mu held by the leader
+*/
+func (db *DB) finishBatchGroup(last *writer, err error) {
+	for {
+		w := db.writers[0]
+		db.writers = db.writers[1:]
+		w.done, w.err = true, err
+		w.cond.Signal()
+		if w == last {
+			break
+		}
+	}
+
+	if len(db.writers) > 0 {
+		db.writers[0].cond.Signal()
+		return
+	}
+	db.bgCond.Broadcast()
+}
@@ -0,0 +1,166 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chettriyuvraj/leveldb-clone/wal"
+	"github.com/stretchr/testify/require"
+)
+
+/*
+- Puts a writer which never writes at the front of the queue, queues up a Put for each of opts behind it and then lets them through
+- Returns the records logged for the Puts
+*/
+func queuePuts(t *testing.T, db *DB, opts []WriteOptions) []wal.LogRecord {
+	writes := []func() error{}
+	for i, o := range opts {
+		i, o := i, o
+		writes = append(writes, func() error {
+			return db.PutWithOptions([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("val%03d", i)), o)
+		})
+	}
+	queueWrites(t, db, writes)
+
+	log, err := wal.Open(logFileName(db.dirName, db.logNumber))
+	require.NoError(t, err)
+	defer log.Close()
+	records, err := log.Replay()
+	require.NoError(t, err)
+	return records
+}
+
+/* Puts a writer which never writes at the front of the queue, queues up each of writes behind it in order and then lets them through */
+func queueWrites(t *testing.T, db *DB, writes []func() error) {
+	db.mu.Lock()
+	blocker := &writer{batch: NewWriteBatch(), cond: sync.NewCond(&db.mu)}
+	db.writers = append(db.writers, blocker)
+	db.mu.Unlock()
+
+	wg := sync.WaitGroup{}
+	for i, write := range writes {
+		wg.Add(1)
+		go func(write func() error) {
+			defer wg.Done()
+			require.NoError(t, write())
+		}(write)
+
+		/* Wait for the write to be queued, so that writes are queued in order */
+		for {
+			db.mu.Lock()
+			queued := len(db.writers)
+			db.mu.Unlock()
+			if queued == i+2 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	db.mu.Lock()
+	db.writers = db.writers[1:]
+	db.writers[0].cond.Signal()
+	db.mu.Unlock()
+	wg.Wait()
+}
+
+func TestGroupCommit(t *testing.T) {
+	tcs := []struct {
+		name        string
+		opts        []WriteOptions
+		wantRecords []int /* Number of entries in each record logged */
+	}{
+		{name: "synced writes are grouped", opts: []WriteOptions{{Sync: true}, {Sync: true}, {Sync: true}, {Sync: true}}, wantRecords: []int{4}},
+		{name: "unsynced writes are grouped", opts: []WriteOptions{{}, {}, {}}, wantRecords: []int{3}},
+		{name: "synced leader takes unsynced writes", opts: []WriteOptions{{Sync: true}, {}, {Sync: true}}, wantRecords: []int{3}},
+		{name: "unsynced leader stops at synced write", opts: []WriteOptions{{}, {}, {Sync: true}, {}}, wantRecords: []int{2, 2}},
+	}
+
+	for _, tc := range tcs {
+		db, err := NewDB(NewDBConfigWithOptions(1<<20, true, t.TempDir(), Options{}))
+		require.NoError(t, err)
+
+		records := queuePuts(t, db, tc.opts)
+		require.Len(t, records, len(tc.wantRecords), tc.name)
+		for i, record := range records {
+			batch := NewWriteBatch()
+			require.NoError(t, batch.UnmarshalBinary(record.Val()), tc.name)
+			require.Equal(t, tc.wantRecords[i], batch.Len(), tc.name)
+		}
+
+		/* Every write of a group is visible, in the order it was queued */
+		for i := range tc.opts {
+			v, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+			require.NoError(t, err, tc.name)
+			require.Equal(t, []byte(fmt.Sprintf("val%03d", i)), v, tc.name)
+		}
+		require.NoError(t, db.Close())
+	}
+}
+
+func TestBatchGroupMakesRoom(t *testing.T) {
+	const memdbLimit = 100
+	db, err := NewDB(NewDBConfigWithOptions(memdbLimit, true, t.TempDir(), Options{}))
+	require.NoError(t, err)
+	defer db.Close()
+	other, err := db.CreateColumnFamily("other", Options{})
+	require.NoError(t, err)
+	require.NoError(t, other.Put([]byte("first"), bytes.Repeat([]byte("v"), 50)))
+
+	/* The leader writes to the default family, the writes it takes fill up the other one past its limit */
+	writes := []func() error{func() error { return db.Put([]byte("k"), []byte("v")) }}
+	for i := 0; i < 5; i++ {
+		i := i
+		writes = append(writes, func() error {
+			return other.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("val%03d", i)))
+		})
+	}
+	queueWrites(t, db, writes)
+
+	db.mu.Lock()
+	size := db.versions.families[other.id].memdb.Size()
+	db.mu.Unlock()
+	require.LessOrEqual(t, size, memdbLimit)
+	for i := 0; i < 5; i++ {
+		v, err := other.Get([]byte(fmt.Sprintf("key%03d", i)))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("val%03d", i)), v)
+	}
+}
+
+func TestConcurrentSyncWrites(t *testing.T) {
+	dirName := t.TempDir()
+	key := func(g, i int) []byte { return []byte(fmt.Sprintf("key%02d-%03d", g, i)) }
+	val := func(g, i int) []byte { return []byte(fmt.Sprintf("val%02d-%03d", g, i)) }
+
+	/* A small memdb makes leaders swap out memdb + log while others are queued */
+	const goroutines, writes = 8, 50
+	db, err := NewDB(NewDBConfigWithOptions(2000, true, dirName, Options{Sync: true}))
+	require.NoError(t, err)
+	wg := sync.WaitGroup{}
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				require.NoError(t, db.Put(key(g, i), val(g, i)))
+			}
+		}(g)
+	}
+	wg.Wait()
+	require.NoError(t, db.Close())
+
+	db, err = NewDB(NewDBConfigWithOptions(2000, false, dirName, Options{}))
+	require.NoError(t, err)
+	defer db.Close()
+	for g := 0; g < goroutines; g++ {
+		for i := 0; i < writes; i++ {
+			v, err := db.Get(key(g, i))
+			require.NoError(t, err)
+			require.Equal(t, val(g, i), v)
+		}
+	}
+}
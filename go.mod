@@ -2,11 +2,14 @@ module github.com/chettriyuvraj/leveldb-clone
 
 go 1.20
 
+require (
+	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db
+	github.com/stretchr/testify v1.9.0
+	github.com/syndtr/goleveldb v1.0.0
+)
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.9.0 // indirect
-	github.com/syndtr/goleveldb v1.0.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
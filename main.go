@@ -19,16 +19,6 @@ func main() {
 		return
 	}
 	defer db.Close()
-	if err != nil {
-		fmt.Printf("error attaching WAL: %v", err)
-		return
-	}
-	err = db.Replay()
-	if err != nil {
-		fmt.Printf("error replaying data from WAL: %v", err)
-		return
-	}
-
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
 		op := scanner.Bytes()
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/chettriyuvraj/leveldb-clone/common"
 	"github.com/chettriyuvraj/leveldb-clone/skiplist"
@@ -12,60 +13,128 @@ import (
 )
 
 const (
-	P                    = 0.25
-	MAXLEVEL             = 12
-	DEFAULTINDEXDISTANCE = 15
-)
-
-const (
-	REGULARNODE = iota
-	TOMBSTONENODE
+	P        = 0.25
+	MAXLEVEL = 12
 )
 
 var ErrEmptyKeyNotAllowed = errors.New("empty key not allowed")
 
+/*
+- Entries are keyed by internal keys (see common.MakeInternalKey), so every version of a key is kept and the newest one sorts first
+- Put/Delete stamp writes with the memdb's own sequence numbers, the top level DB instead uses Add with sequence numbers of its own
+- Safe for concurrent use, mu is held for reading by Get/Has and iterators, and for writing by Put/Delete/Add
+- The skiplist itself is unsynchronized, so it must only be accessed through MemDB
+*/
 type MemDB struct {
 	skiplist.SkipList
-	size int /* Sum of sizes of the k-v pairs */
+	icmp    *common.InternalKeyComparator
+	mu      sync.RWMutex
+	size    int    /* Sum of sizes of the user keys + values of all entries */
+	lastSeq uint64 /* Largest sequence number added */
 }
+
+/*
+- A user iterator yields the newest version of each user key, an internal iterator yields every entry with its internal key
+- limitKey -> nil indicates scan till end of range
+*/
 type MemDBIterator struct {
 	*MemDB
 	startKey, limitKey []byte
 	curNode            *skiplist.Node
 	hasEnded           bool
 	skipTombstones     bool
+	internal           bool
 	err                error
 }
 
 func (db *MemDB) String() string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 	return db.SkipList.String()
 }
 
 func (db *MemDB) Size() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 	return db.size
 }
 
 func NewMemDB() (*MemDB, error) {
-	return &MemDB{SkipList: *skiplist.NewSkipList(P, MAXLEVEL)}, nil
+	return NewMemDBWithComparator(common.BytewiseComparator)
+}
+
+/* User keys are ordered by ucmp */
+func NewMemDBWithComparator(ucmp common.Comparator) (*MemDB, error) {
+	icmp := common.NewInternalKeyComparator(ucmp)
+	return &MemDB{SkipList: *skiplist.NewSkipListWithCompare(P, MAXLEVEL, icmp.Compare), icmp: icmp}, nil
+}
+
+func (db *MemDB) compareUserKeys(a, b []byte) int {
+	return db.icmp.UserComparator().Compare(a, b)
 }
 
 func (db *MemDB) Get(key []byte) (val []byte, err error) {
-	node := db.Search(key)
-	if node == nil {
-		return nil, common.ErrKeyDoesNotExist
+	return db.Lookup(key, common.MaxSequenceNumber)
+}
+
+/*
+- Returns the value of the newest version of key with a sequence number <= seq
+- If that version is a deletion, the error wraps both common.ErrKeyDoesNotExist and common.ErrTombstoneEncountered, so callers know not to look any further
+- If it is a merge operand, the error is common.ErrMergeOperandEncountered - memdb has no merge operator, it is up to the caller to merge the versions of the key
+- If it is a value with an expiry, the error is common.ErrExpiringValueEncountered - see LookupEntry
+*/
+func (db *MemDB) Lookup(key []byte, seq uint64) (val []byte, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.lookup(key, seq)
+}
+
+func (db *MemDB) lookup(key []byte, seq uint64) (val []byte, err error) {
+	val, valueType, err := db.lookupEntry(key, seq)
+	if err != nil {
+		return nil, err
+	}
+	switch valueType {
+	case common.TypeDeletion:
+		return nil, errors.Join(common.ErrKeyDoesNotExist, common.ErrTombstoneEncountered)
+	case common.TypeMerge:
+		return nil, common.ErrMergeOperandEncountered
+	case common.TypeValueWithExpiry:
+		return nil, common.ErrExpiringValueEncountered
 	}
+	return val, nil
+}
+
+/* Returns the newest version of key with a sequence number <= seq as it is stored along with its value type, common.ErrKeyDoesNotExist if there is none */
+func (db *MemDB) LookupEntry(key []byte, seq uint64) (val []byte, valueType common.ValueType, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.lookupEntry(key, seq)
+}
 
-	if bytes.Equal(node.Metadata(), []byte{TOMBSTONENODE}) {
-		return nil, nil
+func (db *MemDB) lookupEntry(key []byte, seq uint64) (val []byte, valueType common.ValueType, err error) {
+	node := db.SearchClosest(common.MakeInternalKey(key, seq, common.ValueTypeForSeek))
+	if node == nil {
+		return nil, 0, common.ErrKeyDoesNotExist
 	}
 
-	return node.Val(), nil
+	userKey, _, valueType, err := common.ParseInternalKey(node.Key())
+	if err != nil {
+		return nil, 0, err
+	}
+	if db.compareUserKeys(userKey, key) != 0 {
+		return nil, 0, common.ErrKeyDoesNotExist
+	}
+	return node.Val(), valueType, nil
 }
 
 func (db *MemDB) Has(key []byte) (ret bool, err error) {
-	node := db.Search(key)
-	if node == nil {
-		return false, nil
+	_, err = db.Get(key)
+	if err != nil {
+		if errors.Is(err, common.ErrKeyDoesNotExist) {
+			return false, nil
+		}
+		return false, err
 	}
 	return true, nil
 }
@@ -76,71 +145,75 @@ func (db *MemDB) Put(key, val []byte) error {
 		return ErrEmptyKeyNotAllowed
 	}
 
-	/* Check if key already exists - this is actually for updating the size of memdb */
-	prevVal, err := db.Get(key)
-	keyAlreadyExists := true
-	if err != nil {
-		if !errors.Is(err, common.ErrKeyDoesNotExist) {
-			return err
-		}
-		keyAlreadyExists = false
-	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.add(db.lastSeq+1, common.TypeValue, key, val)
+}
 
-	if err := db.Insert(key, val, []byte{REGULARNODE}); err != nil {
-		return err
-	}
+func (db *MemDB) Delete(key []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-	/* Modify db size depending on whether key already existed or not */
-	if keyAlreadyExists {
-		db.size += len(val) - len(prevVal)
-	} else {
-		db.size += len(key) + len(val)
+	/* We will insert a tombstone only if record exists */
+	if _, err := db.lookup(key, common.MaxSequenceNumber); err != nil { /* Return err regardless of whether it is actual error / key does not exist error */
+		return err
 	}
 
-	return nil
+	return db.add(db.lastSeq+1, common.TypeDeletion, key, nil)
 }
 
-func (db *MemDB) Delete(key []byte) error {
-	/* Get value of key if it already exists - we will insert a tombstone only if record exists */
-	val, err := db.Get(key)
-	if err != nil { /* Return err regardless of whether it is actual error / key does not exist error */
-		return err
+/* Adds a version of key with the given sequence number, a deletion acts as a tombstone for older versions */
+func (db *MemDB) Add(seq uint64, valueType common.ValueType, key, val []byte) error {
+	if bytes.Equal(key, []byte{}) {
+		return ErrEmptyKeyNotAllowed
 	}
 
-	/* Delete will insert a tombstone node */
-	if err := db.InsertTombstone(key); err != nil {
-		return err
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.add(seq, valueType, key, val)
+}
+
+func (db *MemDB) add(seq uint64, valueType common.ValueType, key, val []byte) error {
+	if err := db.Insert(common.MakeInternalKey(key, seq, valueType), val, nil); err != nil {
+		return fmt.Errorf("error inserting into memdb: %w", err)
 	}
 
 	db.size += len(key) + len(val)
-	return nil
-}
-
-func (db *MemDB) InsertTombstone(key []byte) error {
-	if err := db.Insert(key, nil, []byte{TOMBSTONENODE}); err != nil {
-		return fmt.Errorf("error inserting tombstone")
+	if seq > db.lastSeq {
+		db.lastSeq = seq
 	}
 	return nil
 }
 
 /* Note: limitKey -> nil indicates scan till end of range */
 func NewMemDBIterator(db *MemDB, startKey, limitKey []byte, skipTombstones bool) (*MemDBIterator, error) {
-	iter := MemDBIterator{MemDB: db, startKey: startKey, limitKey: limitKey}
+	return newMemDBIterator(db, startKey, limitKey, skipTombstones, false)
+}
+
+func newMemDBIterator(db *MemDB, startKey, limitKey []byte, skipTombstones, internal bool) (*MemDBIterator, error) {
+	iter := MemDBIterator{MemDB: db, startKey: startKey, limitKey: limitKey, skipTombstones: skipTombstones, internal: internal}
 
-	if bytes.Compare(startKey, limitKey) > 0 && limitKey != nil {
+	if startKey != nil && limitKey != nil && db.compareUserKeys(startKey, limitKey) > 0 {
 		return nil, common.ErrInvalidRange
 	}
 
-	firstNode := db.SearchClosest(startKey)
-	if firstNode == nil {
-		iter.hasEnded = true
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	/* A nil startKey starts at the first entry, an empty key isn't necessarily the smallest under every comparator */
+	if startKey == nil {
+		iter.curNode = db.First()
 	} else {
-		iter.curNode = firstNode
+		iter.curNode = db.SearchClosest(common.MakeInternalKey(startKey, common.MaxSequenceNumber, common.ValueTypeForSeek))
 	}
+	iter.settle()
 
 	return &iter, nil
 }
 
+/*
+- Yields the newest version of each user key in [start, limit], skipping keys whose newest version is a deletion
+- Entries are yielded raw: a key whose newest version is a merge operand (see Add) is yielded with the operand as its value, memdb has no merge operator to resolve it - use InternalScan to merge the versions of a key
+*/
 func (db *MemDB) RangeScan(start, limit []byte) (common.Iterator, error) {
 	iter, err := NewMemDBIterator(db, start, limit, true)
 	if err != nil {
@@ -152,7 +225,17 @@ func (db *MemDB) RangeScan(start, limit []byte) (common.Iterator, error) {
 
 /* Gives entire data including tombstones */
 func (db *MemDB) FullScan() (common.Iterator, error) {
-	iter, err := NewMemDBIterator(db, db.FirstKey(), nil, false)
+	iter, err := NewMemDBIterator(db, nil, nil, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return iter, iter.Error()
+}
+
+/* Gives every entry with a user key in [start, limit] keyed by its internal key, including all older versions + deletions */
+func (db *MemDB) InternalScan(start, limit []byte) (common.Iterator, error) {
+	iter, err := newMemDBIterator(db, start, limit, false, true)
 	if err != nil {
 		return nil, err
 	}
@@ -160,13 +243,14 @@ func (db *MemDB) FullScan() (common.Iterator, error) {
 	return iter, iter.Error()
 }
 
+/* The SSTable is keyed by internal keys */
 func (db *MemDB) FlushSSTable(f io.Writer) error {
-	iter, err := db.FullScan()
+	iter, err := db.InternalScan(nil, nil)
 	if err != nil {
 		return err
 	}
 
-	data, err := sstable.GetSSTableData(iter, DEFAULTINDEXDISTANCE)
+	data, err := sstable.GetSSTableDataWithOptions(iter, sstable.DEFAULTBLOCKSIZE, sstable.Options{Comparator: db.icmp})
 	if err != nil {
 		return fmt.Errorf("error flushing to SSTable: %w", err)
 	}
@@ -181,37 +265,59 @@ func (db *MemDB) FlushSSTable(f io.Writer) error {
 
 /*
 - Assuming iter always initialized using NewMemDBIterator func so all constraints defined there hold
+- An iterator may be used concurrently with writes to its memdb, but not from multiple goroutines at once
 */
 func (iter *MemDBIterator) Next() bool {
+	iter.mu.RLock()
+	defer iter.mu.RUnlock()
+	return iter.next()
+}
+
+func (iter *MemDBIterator) next() bool {
 	iter.err = nil
 
 	if iter.hasEnded {
 		return false
 	}
 
-	iter.curNode = iter.curNode.GetAdjacent()
-
-	/* limitKey -> nil indicates scan till end of range */
-	if iter.limitKey == nil && iter.curNode != nil {
-		return true
+	if iter.internal {
+		iter.curNode = iter.curNode.GetAdjacent()
+	} else {
+		iter.curNode = iter.nextUserKey()
 	}
+	iter.settle()
 
-	if iter.curNode == nil || bytes.Compare(iter.curNode.Key(), iter.limitKey) > 0 {
-		iter.curNode = nil
-		iter.hasEnded = true
-		return false
+	return !iter.hasEnded
+}
+
+/* Skips the older versions of the current user key */
+func (iter *MemDBIterator) nextUserKey() *skiplist.Node {
+	userKey := common.ExtractUserKey(iter.curNode.Key())
+	node := iter.curNode.GetAdjacent()
+	for node != nil && iter.compareUserKeys(common.ExtractUserKey(node.Key()), userKey) == 0 {
+		node = node.GetAdjacent()
 	}
+	return node
+}
 
-	if bytes.Equal(iter.curNode.Metadata(), []byte{TOMBSTONENODE}) {
-		if iter.skipTombstones {
-			return iter.Next()
+/* Ends the iterator once the limit is crossed, and moves past tombstones if they are to be skipped */
+func (iter *MemDBIterator) settle() {
+	for iter.curNode != nil {
+		userKey, _, valueType, _ := common.ParseInternalKey(iter.curNode.Key())
+
+		/* limitKey -> nil indicates scan till end of range */
+		if iter.limitKey != nil && iter.compareUserKeys(userKey, iter.limitKey) > 0 {
+			break
 		}
-		// else {
-		// 	iter.err = errors.Join(common.ErrTombstoneEncountered, common.ErrIdxOutOfBounds)
-		// }
+
+		if iter.internal || valueType != common.TypeDeletion || !iter.skipTombstones {
+			return
+		}
+		iter.curNode = iter.nextUserKey()
 	}
 
-	return true
+	iter.curNode = nil
+	iter.hasEnded = true
 }
 
 func (iter *MemDBIterator) Key() []byte {
@@ -220,15 +326,26 @@ func (iter *MemDBIterator) Key() []byte {
 	if iter.hasEnded || iter.err != nil || iter.curNode == nil {
 		return nil
 	}
-	return iter.curNode.Key()
+	iter.mu.RLock()
+	defer iter.mu.RUnlock()
+	if iter.internal {
+		return iter.curNode.Key()
+	}
+	return common.ExtractUserKey(iter.curNode.Key())
 }
 
+/*
+- Tombstones have a nil value
+- Values are returned as stored: a value with an expiry keeps its expiry prefix and is returned even once it has expired, memdb has no clock to check it against - see LookupEntry
+*/
 func (iter *MemDBIterator) Value() []byte {
 	iter.err = nil
 
 	if iter.hasEnded || iter.err != nil || iter.curNode == nil {
 		return nil
 	}
+	iter.mu.RLock()
+	defer iter.mu.RUnlock()
 	return iter.curNode.Val()
 }
 
@@ -1,17 +1,22 @@
 package memdb
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
 
 	"github.com/chettriyuvraj/leveldb-clone/common"
-	"github.com/chettriyuvraj/leveldb-clone/skiplist"
 	"github.com/chettriyuvraj/leveldb-clone/test"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 /* Workaround done exclusively to match signature with test suite */
 func newMemDBAsInterface() common.DB {
-	return &MemDB{*skiplist.NewSkipList(P, MAXLEVEL), 0}
+	db, _ := NewMemDB()
+	return db
 }
 
 func newMemDBIteratorAsInterface(db common.DB) common.Iterator {
@@ -90,3 +95,133 @@ func TestFullScan(t *testing.T) {
 	}
 
 }
+
+func TestConcurrentAccess(t *testing.T) {
+	db, err := NewMemDB()
+	require.NoError(t, err)
+
+	/* Writers overwrite keys while readers Get and iterate over them, values always carry the key they belong to */
+	const keys, writers, readers = 50, 4, 4
+	wg := sync.WaitGroup{}
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				k := []byte(fmt.Sprintf("key%02d", (i*(w+1))%keys))
+				assert.NoError(t, db.Put(k, append(append([]byte{}, k...), fmt.Sprintf("-%d", w)...)))
+			}
+		}(w)
+	}
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				k := []byte(fmt.Sprintf("key%02d", i%keys))
+				if v, err := db.Get(k); err == nil {
+					assert.True(t, bytes.HasPrefix(v, k))
+				}
+
+				iter, err := db.FullScan()
+				if !assert.NoError(t, err) {
+					return
+				}
+				var prev []byte
+				for ; iter.Key() != nil; iter.Next() {
+					assert.True(t, bytes.HasPrefix(iter.Value(), iter.Key()))
+					assert.Less(t, bytes.Compare(prev, iter.Key()), 0)
+					prev = iter.Key()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestLookup(t *testing.T) {
+	db, err := NewMemDB()
+	require.NoError(t, err)
+
+	k := []byte("key1")
+	require.NoError(t, db.Add(5, common.TypeValue, k, []byte("val5")))
+	require.NoError(t, db.Add(10, common.TypeDeletion, k, nil))
+	require.NoError(t, db.Add(7, common.TypeValue, k, []byte("val7")))
+
+	/* Newest version with sequence number <= seq wins, regardless of insertion order */
+	tcs := []struct {
+		seq       uint64
+		val       []byte
+		tombstone bool
+	}{
+		{seq: 4},
+		{seq: 5, val: []byte("val5")},
+		{seq: 6, val: []byte("val5")},
+		{seq: 7, val: []byte("val7")},
+		{seq: 10, tombstone: true},
+		{seq: common.MaxSequenceNumber, tombstone: true},
+	}
+	for _, tc := range tcs {
+		val, err := db.Lookup(k, tc.seq)
+		if tc.val == nil {
+			require.ErrorIs(t, err, common.ErrKeyDoesNotExist)
+			require.Equal(t, tc.tombstone, errors.Is(err, common.ErrTombstoneEncountered))
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, tc.val, val)
+	}
+
+	/* Internal scans give every version, newest first */
+	iter, err := db.InternalScan(nil, nil)
+	require.NoError(t, err)
+	for _, seq := range []uint64{10, 7, 5} {
+		userKey, gotSeq, _, err := common.ParseInternalKey(iter.Key())
+		require.NoError(t, err)
+		require.Equal(t, k, userKey)
+		require.Equal(t, seq, gotSeq)
+		iter.Next()
+	}
+	require.Nil(t, iter.Key())
+}
+
+/* Orders user keys in reverse */
+type reverseComparator struct{}
+
+func (reverseComparator) Compare(a, b []byte) int { return bytes.Compare(b, a) }
+
+func (reverseComparator) Name() string { return "test.ReverseComparator" }
+
+func (reverseComparator) FindShortestSeparator(start, limit []byte) []byte { return start }
+
+func (reverseComparator) FindShortSuccessor(key []byte) []byte { return key }
+
+func TestComparator(t *testing.T) {
+	db, err := NewMemDBWithComparator(reverseComparator{})
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i))))
+	}
+	require.NoError(t, db.Delete([]byte("key5")))
+
+	v, err := db.Get([]byte("key3"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("val3"), v)
+	_, err = db.Get([]byte("key5"))
+	require.ErrorIs(t, err, common.ErrKeyDoesNotExist)
+
+	/* Ranges + full scans follow the comparator's order */
+	iter, err := db.RangeScan([]byte("key7"), []byte("key2"))
+	require.NoError(t, err)
+	got := []string{}
+	for ; iter.Key() != nil; iter.Next() {
+		got = append(got, string(iter.Key()))
+	}
+	require.Equal(t, []string{"key7", "key6", "key4", "key3", "key2"}, got)
+	_, err = db.RangeScan([]byte("key2"), []byte("key7"))
+	require.ErrorIs(t, err, common.ErrInvalidRange)
+
+	iter, err = db.InternalScan(nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("key9"), common.ExtractUserKey(iter.Key()))
+}
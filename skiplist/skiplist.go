@@ -1,6 +1,7 @@
 package skiplist
 
 import (
+	"bytes"
 	"errors"
 )
 
@@ -13,16 +14,23 @@ type Node struct {
 	forward  []*Node
 }
 
+/* Not safe for concurrent use, callers are expected to synchronize access (see MemDB) */
 type SkipList struct {
 	head     *Node
 	level    int
 	nil      *Node
 	p        float64
 	maxLevel int
+	compare  func(a, b []byte) int
 }
 
 func NewSkipList(p float64, maxLevel int) *SkipList {
-	skiplist := SkipList{head: NewNode(nil, nil, nil), nil: NewNode(nil, nil, nil), level: 1, p: p, maxLevel: maxLevel}
+	return NewSkipListWithCompare(p, maxLevel, bytes.Compare)
+}
+
+/* Keys are ordered using compare instead of bytes.Compare */
+func NewSkipListWithCompare(p float64, maxLevel int, compare func(a, b []byte) int) *SkipList {
+	skiplist := SkipList{head: NewNode(nil, nil, nil), nil: NewNode(nil, nil, nil), level: 1, p: p, maxLevel: maxLevel, compare: compare}
 	skiplist.head.forward = append(skiplist.head.forward, skiplist.nil)
 	return &skiplist
 }
@@ -1,7 +1,6 @@
 package skiplist
 
 import (
-	"bytes"
 	"fmt"
 	"math/rand"
 	"strings"
@@ -48,6 +47,11 @@ func (sl *SkipList) FirstKey() []byte {
 	return sl.head.forward[1].key
 }
 
+/* First node of the list, nil if it is empty */
+func (sl *SkipList) First() *Node {
+	return sl.head.GetAdjacent()
+}
+
 func (sl *SkipList) Nil() *Node {
 	return sl.nil
 }
@@ -69,7 +73,7 @@ func (sl *SkipList) compareKey(n1, n2 *Node) int {
 		return -1
 	}
 
-	return bytes.Compare(n1.key, n2.key)
+	return sl.compare(n1.key, n2.key)
 }
 
 func (sl *SkipList) randomLevel() int {
@@ -0,0 +1,176 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+const (
+	DEFAULTBLOCKSIZE            = 4 * 1024 /* In bytes */
+	DEFAULTBLOCKRESTARTINTERVAL = 16
+)
+
+var ErrCorruptBlock = errors.New("corrupt SSTable block")
+
+/*
+- Builds a block: a sorted run of entries, each key stored as the length of the prefix it shares with the previous key + the rest of it
+- Every 'restartInterval' entries the full key is stored instead, these entries are _restart points_, their offsets are listed at the end of the block so that a seek can binary search them
+- Format: [entry 1]...[entry n][restart offset 1(4 bytes)]...[restart offset m(4 bytes)][m(4 bytes)]
+- Entry format: [shared key length(uvarint):unshared key length(uvarint):val length(uvarint):unshared key bytes:val]
+*/
+type blockBuilder struct {
+	restartInterval int
+	buf             []byte
+	restarts        []uint32
+	counter         int /* Entries since the last restart point */
+	lastKey         []byte
+	entries         int
+}
+
+func newBlockBuilder(restartInterval int) *blockBuilder {
+	return &blockBuilder{restartInterval: restartInterval, restarts: []uint32{0}}
+}
+
+/* Keys must be added in sorted order */
+func (b *blockBuilder) add(key, val []byte) {
+	shared := 0
+	if b.counter < b.restartInterval {
+		for shared < len(key) && shared < len(b.lastKey) && key[shared] == b.lastKey[shared] {
+			shared++
+		}
+	} else {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+		b.counter = 0
+	}
+
+	b.buf = binary.AppendUvarint(b.buf, uint64(shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(key)-shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(val)))
+	b.buf = append(b.buf, key[shared:]...)
+	b.buf = append(b.buf, val...)
+
+	b.lastKey = append(b.lastKey[:0], key...)
+	b.counter++
+	b.entries++
+}
+
+/* Size of the block if it were finished now */
+func (b *blockBuilder) estimatedSize() int {
+	return len(b.buf) + 4*len(b.restarts) + 4
+}
+
+func (b *blockBuilder) empty() bool {
+	return b.entries == 0
+}
+
+/* Appends the restart array and returns the block, the builder is reset for the next block */
+func (b *blockBuilder) finish() []byte {
+	block := b.buf
+	for _, restart := range b.restarts {
+		block = binary.BigEndian.AppendUint32(block, restart)
+	}
+	block = binary.BigEndian.AppendUint32(block, uint32(len(b.restarts)))
+
+	*b = blockBuilder{restartInterval: b.restartInterval, restarts: []uint32{0}}
+	return block
+}
+
+/* A block read back from a table, the restart array is parsed up front */
+type block struct {
+	data        []byte /* Entries only, without the restart array */
+	restarts    []byte /* Restart array, 4 bytes per restart point */
+	numRestarts int
+}
+
+func parseBlock(data []byte) (*block, error) {
+	if len(data) < 4 {
+		return nil, ErrCorruptBlock
+	}
+	numRestarts := int(binary.BigEndian.Uint32(data[len(data)-4:]))
+	restartsOffset := len(data) - 4 - 4*numRestarts
+	if numRestarts == 0 || restartsOffset < 0 {
+		return nil, ErrCorruptBlock
+	}
+	return &block{data: data[:restartsOffset], restarts: data[restartsOffset : len(data)-4], numRestarts: numRestarts}, nil
+}
+
+func (b *block) restartOffset(i int) int {
+	return int(binary.BigEndian.Uint32(b.restarts[4*i:]))
+}
+
+/* Iterates the entries of a block, keys are rebuilt from the shared prefix as the iterator moves forward */
+type blockIterator struct {
+	b        *block
+	compare  func(a, b []byte) int
+	offset   int /* Offset of the entry after the current one */
+	key, val []byte
+	valid    bool
+	err      error
+}
+
+func newBlockIterator(b *block, compare func(a, b []byte) int) *blockIterator {
+	return &blockIterator{b: b, compare: compare}
+}
+
+/* Decodes the entry at offset, which must follow the current entry or be a restart point (with key reset to nil) */
+func (iter *blockIterator) next() bool {
+	if iter.err != nil || iter.offset >= len(iter.b.data) {
+		iter.valid = false
+		return false
+	}
+
+	data := iter.b.data[iter.offset:]
+	lengths, header := [3]uint64{}, 0
+	for i := range lengths {
+		length, n := binary.Uvarint(data[header:])
+		if n <= 0 {
+			iter.err, iter.valid = ErrCorruptBlock, false
+			return false
+		}
+		lengths[i], header = length, header+n
+	}
+	shared, unshared, valLen := lengths[0], lengths[1], lengths[2]
+	if uint64(len(data)-header) < unshared+valLen || shared > uint64(len(iter.key)) {
+		iter.err, iter.valid = ErrCorruptBlock, false
+		return false
+	}
+
+	/* A fresh slice per key, so that keys handed out earlier are never overwritten */
+	key := make([]byte, 0, int(shared+unshared))
+	key = append(key, iter.key[:shared]...)
+	key = append(key, data[header:header+int(unshared)]...)
+	iter.key = key
+	iter.val = data[header+int(unshared) : header+int(unshared+valLen)]
+	iter.offset += header + int(unshared+valLen)
+	iter.valid = true
+	return true
+}
+
+func (iter *blockIterator) seekToFirst() bool {
+	iter.offset, iter.key, iter.err = 0, nil, nil
+	return iter.next()
+}
+
+/* Moves to the first entry with a key >= target, binary searching the restart points first */
+func (iter *blockIterator) seek(target []byte) bool {
+	/* Last restart point whose key is < target, the entry we want is at or after it */
+	restart := sort.Search(iter.b.numRestarts, func(i int) bool {
+		iter.offset, iter.key = iter.b.restartOffset(i), nil
+		return !iter.next() || iter.compare(iter.key, target) >= 0
+	}) - 1
+	if iter.err != nil {
+		return false
+	}
+	if restart < 0 {
+		restart = 0
+	}
+
+	iter.offset, iter.key = iter.b.restartOffset(restart), nil
+	for iter.next() {
+		if iter.compare(iter.key, target) >= 0 {
+			return true
+		}
+	}
+	return false
+}
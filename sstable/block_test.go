@@ -0,0 +1,79 @@
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlock(t *testing.T) {
+	records := []kvRecord{}
+	for i := 0; i < 40; i++ {
+		records = append(records, kvRecord{[]byte(fmt.Sprintf("prefix/key%03d", 2*i)), []byte(fmt.Sprintf("val%d", i))})
+	}
+	records[3].v = []byte{}
+
+	builder := newBlockBuilder(4)
+	require.True(t, builder.empty())
+	for _, record := range records {
+		builder.add(record.k, record.v)
+	}
+	require.False(t, builder.empty())
+	estimatedSize := builder.estimatedSize()
+	data := builder.finish()
+	require.Equal(t, estimatedSize, len(data))
+	require.True(t, builder.empty())
+
+	/* Keys share their prefix with the previous key, so the block is smaller than the records it holds */
+	recordsSize := 0
+	for _, record := range records {
+		recordsSize += len(record.k) + len(record.v)
+	}
+	require.Less(t, len(data), recordsSize)
+
+	b, err := parseBlock(data)
+	require.NoError(t, err)
+	require.Equal(t, 10, b.numRestarts)
+
+	/* Iterate the whole block */
+	iter := newBlockIterator(b, bytes.Compare)
+	i := 0
+	for ok := iter.seekToFirst(); ok; ok = iter.next() {
+		require.Equal(t, records[i].k, iter.key)
+		require.Equal(t, records[i].v, iter.val)
+		i++
+	}
+	require.NoError(t, iter.err)
+	require.Equal(t, len(records), i)
+
+	/* Seek to keys in the block, between keys of the block and past its end */
+	tcs := []struct {
+		name   string
+		target []byte
+		want   []byte
+	}{
+		{name: "seek before first key", target: []byte("a"), want: records[0].k},
+		{name: "seek to restart point", target: records[8].k, want: records[8].k},
+		{name: "seek to key between restart points", target: records[13].k, want: records[13].k},
+		{name: "seek to key not in block", target: []byte("prefix/key027"), want: records[14].k},
+		{name: "seek to last key", target: records[39].k, want: records[39].k},
+		{name: "seek past last key", target: []byte("prefix/key999"), want: nil},
+	}
+	for _, tc := range tcs {
+		iter := newBlockIterator(b, bytes.Compare)
+		found := iter.seek(tc.target)
+		require.Equal(t, tc.want != nil, found, tc.name)
+		if tc.want != nil {
+			require.Equal(t, tc.want, iter.key, tc.name)
+		}
+	}
+
+	/* Blocks which are cut short are reported as corrupt */
+	_, err = parseBlock(data[:2])
+	require.ErrorIs(t, err, ErrCorruptBlock)
+	b, err = parseBlock(append(append([]byte{}, data[:len(data)-4]...), 0xff, 0xff, 0xff, 0xff))
+	require.ErrorIs(t, err, ErrCorruptBlock)
+	require.Nil(t, b)
+}
@@ -0,0 +1,69 @@
+package sstable
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+
+	"github.com/golang/snappy"
+)
+
+/* Stored in the trailer of every block, so that blocks of a table may be compressed differently */
+type CompressionType byte
+
+const (
+	NoCompression CompressionType = iota
+	SnappyCompression
+	FlateCompression
+)
+
+var ErrUnknownCompression = errors.New("unknown SSTable block compression type")
+
+/*
+- Compresses a block using 'compression', falling back to storing it as is if that saves less than 1/8th of its size
+- Returns the bytes to store along with the compression they were stored with
+*/
+func compressBlock(raw []byte, compression CompressionType) ([]byte, CompressionType, error) {
+	var compressed []byte
+	switch compression {
+	case NoCompression:
+		return raw, NoCompression, nil
+	case SnappyCompression:
+		compressed = snappy.Encode(nil, raw)
+	case FlateCompression:
+		buf := bytes.Buffer{}
+		w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, 0, err
+		}
+		if _, err := w.Write(raw); err != nil {
+			return nil, 0, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, 0, err
+		}
+		compressed = buf.Bytes()
+	default:
+		return nil, 0, ErrUnknownCompression
+	}
+
+	if len(compressed) >= len(raw)-len(raw)/8 {
+		return raw, NoCompression, nil
+	}
+	return compressed, compression, nil
+}
+
+func decompressBlock(data []byte, compression CompressionType) ([]byte, error) {
+	switch compression {
+	case NoCompression:
+		return data, nil
+	case SnappyCompression:
+		return snappy.Decode(nil, data)
+	case FlateCompression:
+		r := flate.NewReader(bytes.NewReader(data))
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+	return nil, ErrUnknownCompression
+}
@@ -0,0 +1,63 @@
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompression(t *testing.T) {
+	/* JSON values compress well, random ones don't - blocks of a table hold one kind or the other */
+	rng := rand.New(rand.NewSource(1))
+	records := []kvRecord{}
+	for i := 0; i < 200; i++ {
+		v := []byte(fmt.Sprintf(`{"id": %d, "name": "user", "email": "user@example.com", "active": true}`, i))
+		if i/20%2 == 1 {
+			v = make([]byte, 64)
+			rng.Read(v)
+		}
+		records = append(records, kvRecord{[]byte(fmt.Sprintf("key%03d", i)), v})
+	}
+
+	sizes := map[CompressionType]int{}
+	for _, compression := range []CompressionType{NoCompression, SnappyCompression, FlateCompression} {
+		sstData, err := GetSSTableDataWithOptions(NewDummyIterator(records), 512, Options{Compression: compression})
+		require.NoError(t, err)
+		sizes[compression] = len(sstData)
+		sstdb, err := NewSSTableDB(BytesReadWriteSeekCloser{bytes.NewReader(sstData)})
+		require.NoError(t, err)
+
+		/* Poorly compressed blocks are stored as is, so a table holds a mix of both */
+		types := map[CompressionType]bool{}
+		for _, entry := range sstdb.index {
+			types[CompressionType(sstData[entry.handle.offset+entry.handle.size])] = true
+		}
+		wantTypes := 2
+		if compression == NoCompression {
+			wantTypes = 1
+		}
+		require.True(t, types[NoCompression])
+		require.True(t, types[compression])
+		require.Len(t, types, wantTypes)
+
+		iter, err := sstdb.FullScan()
+		require.NoError(t, err)
+		for _, record := range records {
+			require.Equal(t, record.k, iter.Key())
+			require.Equal(t, record.v, iter.Value())
+			iter.Next()
+		}
+		require.Nil(t, iter.Key())
+		v, err := sstdb.Get(records[42].k)
+		require.NoError(t, err)
+		require.Equal(t, records[42].v, v)
+	}
+	require.Less(t, sizes[SnappyCompression], sizes[NoCompression])
+	require.Less(t, sizes[FlateCompression], sizes[NoCompression])
+
+	_, err := GetSSTableDataWithOptions(NewDummyIterator(records), 512, Options{Compression: 42})
+	require.ErrorIs(t, err, ErrUnknownCompression)
+}
@@ -0,0 +1,95 @@
+package sstable
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+)
+
+const DEFAULTFILTERBITSPERKEY = 10
+
+/*
+- Bloom filter over the keys of a table, a lookup for a key which is not in the table can skip the table without reading it most of the time
+- Format: [bit array:number of probes(1 byte)]
+- Each key is probed at k positions derived from a single hash using double hashing (as done by LevelDB), k is chosen to minimise false positives for bitsPerKey
+*/
+type bloomFilter []byte
+
+func newBloomFilter(keyHashes []uint32, bitsPerKey int) bloomFilter {
+	/* k = bitsPerKey * ln(2) minimises the false positive rate */
+	k := int(float64(bitsPerKey) * 0.69)
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+
+	/* Very small filters have a very high false positive rate, so use at least 64 bits */
+	bits := len(keyHashes) * bitsPerKey
+	if bits < 64 {
+		bits = 64
+	}
+	bytesN := (bits + 7) / 8
+	bits = bytesN * 8
+
+	filter := make(bloomFilter, bytesN+1)
+	for _, h := range keyHashes {
+		delta := h>>17 | h<<15
+		for j := 0; j < k; j++ {
+			pos := h % uint32(bits)
+			filter[pos/8] |= 1 << (pos % 8)
+			h += delta
+		}
+	}
+	filter[bytesN] = byte(k)
+	return filter
+}
+
+/* False if the key is definitely not in the filter, true if it may be - a missing or malformed filter matches everything */
+func (filter bloomFilter) mayContain(key []byte) bool {
+	if len(filter) < 2 {
+		return true
+	}
+
+	bits := uint32(len(filter)-1) * 8
+	k := int(filter[len(filter)-1])
+	if k > 30 {
+		return true
+	}
+
+	h := filterHash(key)
+	delta := h>>17 | h<<15
+	for j := 0; j < k; j++ {
+		pos := h % bits
+		if filter[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+func filterHash(key []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32()
+}
+
+/*
+- Counts how the bloom filters of tables fared on lookups, safe for concurrent use
+- A single FilterStats can be shared by many tables through Options.FilterStats
+*/
+type FilterStats struct {
+	useful        atomic.Uint64
+	falsePositive atomic.Uint64
+}
+
+/* Number of lookups where the filter ruled the key out, so the table was not read */
+func (stats *FilterStats) Useful() uint64 {
+	return stats.useful.Load()
+}
+
+/* Number of lookups where the filter let the key through, but the table did not contain it */
+func (stats *FilterStats) FalsePositive() uint64 {
+	return stats.falsePositive.Load()
+}
@@ -0,0 +1,120 @@
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/chettriyuvraj/leveldb-clone/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBloomFilter(t *testing.T) {
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+	const keys = 1000
+
+	keyHashes := []uint32{}
+	for i := 0; i < keys; i++ {
+		keyHashes = append(keyHashes, filterHash(key(i)))
+	}
+	filter := newBloomFilter(keyHashes, DEFAULTFILTERBITSPERKEY)
+
+	/* No false negatives */
+	for i := 0; i < keys; i++ {
+		require.True(t, filter.mayContain(key(i)))
+	}
+
+	/* ~1% false positives expected at 10 bits per key, leave some room */
+	falsePositives := 0
+	for i := keys; i < 11*keys; i++ {
+		if filter.mayContain(key(i)) {
+			falsePositives++
+		}
+	}
+	require.Less(t, falsePositives, 10*keys/50)
+
+	/* An empty filter matches everything */
+	require.True(t, bloomFilter(nil).mayContain(key(0)))
+}
+
+func TestSSTableFilter(t *testing.T) {
+	records := []kvRecord{
+		{[]byte("biot"), []byte("b")},
+		{[]byte("comp"), []byte("c")},
+		{[]byte("elec"), []byte("e")},
+		{[]byte("mecha"), []byte("mechanical")},
+		{[]byte("zebr"), []byte("?")},
+	}
+	missing := [][]byte{}
+	for i := 0; i < 100; i++ {
+		missing = append(missing, []byte(fmt.Sprintf("missing%03d", i)))
+	}
+
+	tcs := []struct {
+		name     string
+		opts     Options
+		filtered bool
+	}{
+		{name: "default filter", opts: Options{}, filtered: true},
+		{name: "filter disabled", opts: Options{FilterBitsPerKey: -1}, filtered: false},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			sstData, err := GetSSTableDataWithOptions(NewDummyIterator(records), 10, tc.opts)
+			require.NoError(t, err)
+			stats := &FilterStats{}
+			tc.opts.FilterStats = stats
+			sstDB, err := NewSSTableDBWithOptions(BytesReadWriteSeekCloser{bytes.NewReader(sstData)}, tc.opts)
+			require.NoError(t, err)
+			require.Equal(t, stats, sstDB.FilterStats())
+
+			for _, record := range records {
+				v, err := sstDB.Get(record.k)
+				require.NoError(t, err)
+				require.Equal(t, record.v, v)
+			}
+			for _, k := range missing {
+				has, err := sstDB.Has(k)
+				require.NoError(t, err)
+				require.False(t, has)
+			}
+
+			if !tc.filtered {
+				require.Zero(t, stats.Useful())
+				require.Zero(t, stats.FalsePositive())
+				return
+			}
+			require.Equal(t, uint64(len(missing)), stats.Useful()+stats.FalsePositive())
+			require.Greater(t, stats.Useful(), stats.FalsePositive())
+		})
+	}
+}
+
+func TestSSTableFilterKey(t *testing.T) {
+	/* Keys are [name:version], the filter only holds the name */
+	records := []kvRecord{
+		{[]byte("a:1"), []byte("a")},
+		{[]byte("b:5"), []byte("b")},
+		{[]byte("d:3"), []byte("d")},
+	}
+	opts := Options{FilterKey: func(key []byte) []byte { return key[:1] }}
+	sstData, err := GetSSTableDataWithOptions(NewDummyIterator(records), 10, opts)
+	require.NoError(t, err)
+	stats := &FilterStats{}
+	opts.FilterStats = stats
+	sstDB, err := NewSSTableDBWithOptions(BytesReadWriteSeekCloser{bytes.NewReader(sstData)}, opts)
+	require.NoError(t, err)
+
+	foundKey, v, err := sstDB.Lookup([]byte("b:0"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("b:5"), foundKey)
+	require.Equal(t, []byte("b"), v)
+
+	/* Names in the table only under versions sorting before the one looked for pass the filter, but are misses */
+	for _, k := range []string{"a:2", "b:6", "d:9"} {
+		_, _, err := sstDB.Lookup([]byte(k))
+		require.ErrorIs(t, err, common.ErrKeyDoesNotExist, k)
+	}
+	require.Zero(t, stats.Useful())
+	require.Equal(t, uint64(3), stats.FalsePositive())
+}
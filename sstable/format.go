@@ -0,0 +1,88 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	BLOCKHANDLESIZE  = 16                    /* Offset(8 bytes) + size(8 bytes) */
+	BLOCKTRAILERSIZE = 5                     /* Compression type(1 byte) + masked CRC32C of the block and type(4 bytes), follows every block */
+	FOOTERSIZE       = 2*BLOCKHANDLESIZE + 8 /* Metaindex handle + index handle + magic number */
+	TABLEMAGICNUMBER = 0xdb4775248b80fb57
+	FILTERMETAKEY    = "filter.bloom" /* Metaindex key of the bloom filter block */
+)
+
+var ErrInvalidSSTableFooter = errors.New("invalid SSTable footer")
+var ErrBadSSTableMagic = errors.New("bad magic number in SSTable footer, not an SSTable")
+var ErrInvalidBlockHandle = errors.New("invalid SSTable block handle")
+var ErrChecksumMismatch = errors.New("SSTable block checksum mismatch")
+
+/*
+- The bytes read from a table are not what was written, e.g. a block whose checksum doesn't match - most likely bit-rot or a torn write rather than a bug
+- Err says what was wrong, errors.Is sees through to it
+*/
+type ErrCorruption struct {
+	File   string /* Name of the table file, empty if the table was not opened from a named file */
+	Offset uint64 /* Offset of the corrupt block (or footer) in the file */
+	Err    error
+}
+
+func (e *ErrCorruption) Error() string {
+	return fmt.Sprintf("corruption in SSTable %q at offset %d: %v", e.File, e.Offset, e.Err)
+}
+
+func (e *ErrCorruption) Unwrap() error {
+	return e.Err
+}
+
+/* Location of a block in the table file */
+type blockHandle struct {
+	offset, size uint64
+}
+
+func (h blockHandle) encode() []byte {
+	b := binary.BigEndian.AppendUint64(make([]byte, 0, BLOCKHANDLESIZE), h.offset)
+	return binary.BigEndian.AppendUint64(b, h.size)
+}
+
+func decodeBlockHandle(b []byte) (blockHandle, error) {
+	if len(b) != BLOCKHANDLESIZE {
+		return blockHandle{}, ErrInvalidBlockHandle
+	}
+	return blockHandle{offset: binary.BigEndian.Uint64(b), size: binary.BigEndian.Uint64(b[8:])}, nil
+}
+
+/* Whether the block + its trailer fit in the first 'size' bytes of the file */
+func (h blockHandle) within(size uint64) bool {
+	return h.offset <= size && h.size+BLOCKTRAILERSIZE <= size-h.offset
+}
+
+/* Fixed size footer at the very end of the table, the only part of a table which can be found without reading the rest of it */
+type footer struct {
+	metaindex, index blockHandle
+}
+
+func (f footer) encode() []byte {
+	b := append(f.metaindex.encode(), f.index.encode()...)
+	return binary.BigEndian.AppendUint64(b, TABLEMAGICNUMBER)
+}
+
+/* Checks the magic number + that both blocks lie in the first 'size' bytes of the file */
+func decodeFooter(b []byte, size uint64) (f footer, err error) {
+	if len(b) != FOOTERSIZE {
+		return f, ErrInvalidSSTableFooter
+	}
+	if binary.BigEndian.Uint64(b[2*BLOCKHANDLESIZE:]) != TABLEMAGICNUMBER {
+		return f, ErrBadSSTableMagic
+	}
+	f.metaindex, _ = decodeBlockHandle(b[:BLOCKHANDLESIZE])
+	f.index, _ = decodeBlockHandle(b[BLOCKHANDLESIZE : 2*BLOCKHANDLESIZE])
+	for _, h := range []blockHandle{f.metaindex, f.index} {
+		if !h.within(size) {
+			return f, ErrInvalidSSTableFooter
+		}
+	}
+	return f, nil
+}
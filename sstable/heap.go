@@ -1,8 +1,6 @@
 package sstable
 
 import (
-	"bytes"
-
 	"github.com/chettriyuvraj/leveldb-clone/common"
 )
 
@@ -10,7 +8,7 @@ type SSTIterHeap []*SSTableIterator
 
 func (h SSTIterHeap) Len() int { return len(h) }
 
-func (h SSTIterHeap) Less(i, j int) bool { return bytes.Compare(h[i].Key(), h[j].Key()) < 0 }
+func (h SSTIterHeap) Less(i, j int) bool { return h[i].db.compare(h[i].Key(), h[j].Key()) < 0 }
 
 func (h SSTIterHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
 
@@ -4,45 +4,73 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
+	"math"
 	"os"
 	"sort"
 
+	"github.com/chettriyuvraj/leveldb-clone/cache"
 	"github.com/chettriyuvraj/leveldb-clone/common"
 )
 
-const DEFAULTINDEXDISTANCE = 15
-
-type SSTableDirectory struct {
-	entries []*SSTableDirEntry
+/* SSTables are only read using ReadAt, so that Get and any number of iterators can read the same file concurrently */
+type SSTableFile interface {
+	io.ReaderAt
+	io.Closer
 }
 
-type SSTableDirEntry struct {
-	len    uint32
-	key    []byte
-	offset uint64
+type Options struct {
+	Comparator           common.Comparator       /* Order of the keys in the table, common.BytewiseComparator if nil - must be the same when writing + reading a table */
+	Compression          CompressionType         /* Compression of the blocks written, blocks which don't compress well are stored as is */
+	BlockRestartInterval int                     /* Entries between restart points of a data block, DEFAULTBLOCKRESTARTINTERVAL if 0 */
+	BlockCache           *cache.Cache            /* Blocks read are cached here if set, a cache may be shared by any number of tables */
+	CacheNamespace       uint64                  /* Namespace of the table's blocks in BlockCache, a new one is taken from the cache if 0 */
+	FileNumber           uint64                  /* Tells apart tables sharing a namespace in BlockCache */
+	FilterBitsPerKey     int                     /* Bits per key used by the bloom filter written with the table, DEFAULTFILTERBITSPERKEY if 0 and no filter if negative */
+	FilterKey            func(key []byte) []byte /* Part of a key added to the bloom filter, the whole key if nil - must be the same when writing + reading a table */
+	FilterKeyComparator  common.Comparator       /* Order of the filter keys, tells a lookup whether the key it found matches the one it looked for - Comparator if nil, which only fits when FilterKey is nil too */
+	FilterStats          *FilterStats            /* Where filter lookups are counted, each table counts its own if nil */
 }
 
+/* Safe for concurrent use, the table is immutable once created */
 type SSTableDB struct {
-	f         io.ReadSeekCloser
-	dir       *SSTableDirectory
-	dirOffset uint64
+	f                       SSTableFile
+	name                    string /* Name of the file, if f has one - reported in ErrCorruption */
+	compare                 func(a, b []byte) int
+	index                   []indexEntry /* One entry per data block, in order */
+	size                    uint64       /* Size of the entire SSTable file */
+	smallestKey, largestKey []byte
+	filter                  bloomFilter
+	filterKey               func(key []byte) []byte
+	compareFilterKeys       func(a, b []byte) int
+	filterStats             *FilterStats
+	blockCache              *cache.Cache
+	cacheNamespace          uint64
+	fileNumber              uint64
+}
+
+/*
+- Entry of the index block, every key of the data block is <= separator and > the separator of the block before it
+- The separator of the last block is its last key, the others are shortened to any key between the last key of the block and the first key of the next one
+*/
+type indexEntry struct {
+	separator []byte
+	handle    blockHandle
 }
 
-/* Iterator will store the current offset for the range, and move to the next one on next + check if we have exceeded limit */
+/* Iterator holds an iterator on the data block it is in, moving on to the next block once it is exhausted + checks if we have exceeded limit */
 type SSTableIterator struct {
 	db             *SSTableDB
-	fileOffset     uint64
+	ro             ReadOptions
+	block          int /* Index of the data block being read */
+	blockIter      *blockIterator
 	endKey         []byte
 	fullScan       bool
-	curKey, curVal []byte /* After first call to Value() or Key(), this is cached */
+	curKey, curVal []byte
 	hasEnded       bool
 	err            error
 }
 
-var ErrNoSSTableDirOffset = errors.New("no offset for directory in SSTable file")
-var ErrInvalidSSTableDirOffset = errors.New("dir offset does not exist in SSTable file")
 var ErrNewSSTableOpen = errors.New("error opening new SSTable")
 var ErrNewSSTableCreate = errors.New("error creating new SSTable")
 var ErrSSTableGet = errors.New("error getting data from SSTable")
@@ -50,215 +78,461 @@ var ErrNewSSTableIter = errors.New("error creating new SST iterator")
 var ErrSSTableIterNext = errors.New("error moving to next item in SSTable iterator")
 var ErrNoSSTableDataToWrite = errors.New("no SSTable data to write")
 
+/* Options for a single read of a table */
+type ReadOptions struct {
+	VerifyChecksums bool /* Check the checksum of every data block read from the file, blocks read when opening the table are always checked */
+}
+
 func OpenSSTableDB(filename string) (db SSTableDB, err error) {
+	return OpenSSTableDBWithOptions(filename, Options{})
+}
+
+func OpenSSTableDBWithOptions(filename string, opts Options) (db SSTableDB, err error) {
 	f, err := os.Open(filename)
 	if err != nil {
 		return db, errors.Join(ErrNewSSTableOpen, err)
 	}
 
-	/* TODO: SSTables at higher levels will be larger so read them in a buffered manner instead of all at once */
-	return NewSSTableDB(f)
+	db, err = NewSSTableDBWithOptions(f, opts)
+	if err != nil {
+		f.Close()
+	}
+	return db, err
 }
 
-func NewSSTableDB(f io.ReadSeekCloser) (db SSTableDB, err error) {
-	data, err := io.ReadAll(f)
+func NewSSTableDB(f SSTableFile) (db SSTableDB, err error) {
+	return NewSSTableDBWithOptions(f, Options{})
+}
+
+func NewSSTableDBWithOptions(f SSTableFile, opts Options) (db SSTableDB, err error) {
+	cmp, filterKey, filterStats := opts.Comparator, opts.FilterKey, opts.FilterStats
+	if cmp == nil {
+		cmp = common.BytewiseComparator
+	}
+	if filterKey == nil {
+		filterKey = func(key []byte) []byte { return key }
+	}
+	filterKeyCmp := opts.FilterKeyComparator
+	if filterKeyCmp == nil {
+		filterKeyCmp = cmp
+	}
+	if filterStats == nil {
+		filterStats = &FilterStats{}
+	}
+	cacheNamespace := opts.CacheNamespace
+	if opts.BlockCache != nil && cacheNamespace == 0 {
+		cacheNamespace = opts.BlockCache.NewNamespace()
+	}
+
+	/* Only the footer, index block + filter are read into memory, data blocks are read when needed */
+	size, err := fileSize(f)
 	if err != nil {
 		return db, errors.Join(ErrNewSSTableCreate, err)
 	}
-
-	dir, dirOffset, err := getSSTableDir(data)
+	if size < FOOTERSIZE {
+		return db, errors.Join(ErrNewSSTableCreate, ErrInvalidSSTableFooter)
+	}
+	name := ""
+	if f, ok := f.(interface{ Name() string }); ok {
+		name = f.Name()
+	}
+	footerData, err := readAt(f, blockHandle{offset: size - FOOTERSIZE, size: FOOTERSIZE})
 	if err != nil {
 		return db, errors.Join(ErrNewSSTableCreate, err)
 	}
+	footer, err := decodeFooter(footerData, size-FOOTERSIZE)
+	if err != nil {
+		return db, errors.Join(ErrNewSSTableCreate, &ErrCorruption{File: name, Offset: size - FOOTERSIZE, Err: err})
+	}
 
-	return SSTableDB{f: f, dir: dir, dirOffset: dirOffset}, nil
+	db = SSTableDB{
+		f:                 f,
+		name:              name,
+		compare:           cmp.Compare,
+		size:              size,
+		filterKey:         filterKey,
+		compareFilterKeys: filterKeyCmp.Compare,
+		filterStats:       filterStats,
+		blockCache:        opts.BlockCache,
+		cacheNamespace:    cacheNamespace,
+		fileNumber:        opts.FileNumber,
+	}
+	if err := db.readIndex(footer.index); err != nil {
+		return SSTableDB{}, errors.Join(ErrNewSSTableCreate, err)
+	}
+	if err := db.readMetaindex(footer.metaindex); err != nil {
+		return SSTableDB{}, errors.Join(ErrNewSSTableCreate, err)
+	}
+
+	/* Largest key is the last index key, smallest is the first key of the first block */
+	if len(db.index) > 0 {
+		db.largestKey = db.index[len(db.index)-1].separator
+		_, iter, err := db.seek(0, nil, ReadOptions{VerifyChecksums: true})
+		if err != nil {
+			return SSTableDB{}, errors.Join(ErrNewSSTableCreate, err)
+		}
+		if iter != nil {
+			db.smallestKey = iter.key
+		}
+	}
+
+	return db, nil
+}
+
+/* Reads every entry of the index block */
+func (db *SSTableDB) readIndex(handle blockHandle) error {
+	data, err := db.readBlockContents(handle, true)
+	if err != nil {
+		return err
+	}
+	b, err := parseBlock(data)
+	if err != nil {
+		return db.corruption(handle.offset, err)
+	}
+
+	db.index = []indexEntry{}
+	iter := newBlockIterator(b, db.compare)
+	for ok := iter.seekToFirst(); ok; ok = iter.next() {
+		blockHandle, err := decodeBlockHandle(iter.val)
+		if err == nil && !blockHandle.within(db.size) {
+			err = ErrInvalidBlockHandle
+		}
+		if err != nil {
+			return db.corruption(handle.offset, err)
+		}
+		db.index = append(db.index, indexEntry{separator: iter.key, handle: blockHandle})
+	}
+	if iter.err != nil {
+		return db.corruption(handle.offset, iter.err)
+	}
+	return nil
+}
+
+/* Reads the meta blocks listed in the metaindex block, unknown ones are skipped so that newer tables can add their own */
+func (db *SSTableDB) readMetaindex(handle blockHandle) error {
+	data, err := db.readBlockContents(handle, true)
+	if err != nil {
+		return err
+	}
+	b, err := parseBlock(data)
+	if err != nil {
+		return db.corruption(handle.offset, err)
+	}
+
+	iter := newBlockIterator(b, bytes.Compare)
+	if !iter.seek([]byte(FILTERMETAKEY)) || !bytes.Equal(iter.key, []byte(FILTERMETAKEY)) {
+		if iter.err != nil {
+			return db.corruption(handle.offset, iter.err)
+		}
+		return nil
+	}
+	filterHandle, err := decodeBlockHandle(iter.val)
+	if err == nil && !filterHandle.within(db.size) {
+		err = ErrInvalidBlockHandle
+	}
+	if err != nil {
+		return db.corruption(handle.offset, err)
+	}
+	filter, err := db.readBlockContents(filterHandle, true)
+	if err != nil {
+		return err
+	}
+	db.filter = bloomFilter(filter)
+	return nil
 }
 
 /*
 Format specified in README
 */
 
-func GetSSTableData(iter common.Iterator, distBetweenIndexKeys int) (data []byte, err error) {
-	if err != nil {
-		return nil, fmt.Errorf("error getting SSTable: %w", err)
+func GetSSTableData(iter common.Iterator, blockSize int) (data []byte, err error) {
+	return GetSSTableDataWithOptions(iter, blockSize, Options{})
+}
+
+/*
+- Uses opts to build the data blocks + bloom filter of the table
+- A data block is cut once it reaches blockSize bytes, so blocks may be slightly larger than blockSize
+*/
+func GetSSTableDataWithOptions(iter common.Iterator, blockSize int, opts Options) (data []byte, err error) {
+	cmp, filterBitsPerKey, filterKey, restartInterval := opts.Comparator, opts.FilterBitsPerKey, opts.FilterKey, opts.BlockRestartInterval
+	if cmp == nil {
+		cmp = common.BytewiseComparator
+	}
+	if filterBitsPerKey == 0 {
+		filterBitsPerKey = DEFAULTFILTERBITSPERKEY
+	}
+	if filterKey == nil {
+		filterKey = func(key []byte) []byte { return key }
+	}
+	if restartInterval <= 0 {
+		restartInterval = DEFAULTBLOCKRESTARTINTERVAL
 	}
 
-	/* Scan all entries in sorted order + keep track of their offsets + construct SSTable */
-	dir := SSTableDirectory{}
-	curOffset, curDistanceBetweenKeys := 8, 0
+	/* Index entries hold whole keys, so every entry of the index block is a restart point */
+	/* The index entry of a block is only added once the first key of the next block is known, so that a short separator can be used instead of its last key */
+	dataBlock, indexBlock := newBlockBuilder(restartInterval), newBlockBuilder(1)
+	lastKey := []byte{}
+	var pendingHandle *blockHandle
+	writeDataBlock := func() error {
+		var handle blockHandle
+		data, handle, err = appendBlock(data, dataBlock.finish(), opts.Compression)
+		pendingHandle = &handle
+		return err
+	}
+
+	/* Scan all entries in sorted order + cut them into data blocks */
+	keyHashes, lastFilterKey := []uint32{}, []byte(nil)
 	for {
 		k, v := iter.Key(), iter.Value()
-		kvSize := len(k) + len(v)
 		if k == nil {
 			break
 		}
 
-		/* Only append entry to index if distance between keys ~ distBetween keys OR key is the first key, since we are creating a sparse index  */
-		if len(data) == 0 || curDistanceBetweenKeys+kvSize > distBetweenIndexKeys {
-			dirEntry := &SSTableDirEntry{key: k, offset: uint64(curOffset)}
-			dir.entries = append(dir.entries, dirEntry)
-			curDistanceBetweenKeys = 0
-		} else {
-			curDistanceBetweenKeys += kvSize
+		if pendingHandle != nil {
+			indexBlock.add(cmp.FindShortestSeparator(lastKey, k), pendingHandle.encode())
+			pendingHandle = nil
+		}
+		dataBlock.add(k, v)
+		lastKey = append(lastKey[:0], k...)
+		if dataBlock.estimatedSize() >= blockSize {
+			if err := writeDataBlock(); err != nil {
+				return nil, err
+			}
 		}
 
-		/* Append data record to data */
-		dataRecord := createSSTableDataRecord(k, v)
-		curOffset += len(dataRecord)
-		data = append(data, dataRecord...)
+		/* Consecutive keys may share a filter key e.g. versions of the same user key, it only needs to be added once */
+		if fk := filterKey(k); lastFilterKey == nil || !bytes.Equal(fk, lastFilterKey) {
+			keyHashes = append(keyHashes, filterHash(fk))
+			lastFilterKey = fk
+		}
 
 		if nextExists := iter.Next(); !nextExists {
 			break
 		}
 	}
+	if !dataBlock.empty() {
+		if err := writeDataBlock(); err != nil {
+			return nil, err
+		}
+	}
+	/* The last key is kept as is, it is the largest key of the table */
+	if pendingHandle != nil {
+		indexBlock.add(lastKey, pendingHandle.encode())
+	}
 
-	if len(data) == 0 {
+	if indexBlock.empty() {
 		return nil, ErrNoSSTableDataToWrite
 	}
 
-	/* Note the offset at which directory starts + construct the directory for SSTable  */
-	dirOffset := binary.BigEndian.AppendUint64([]byte{}, uint64(curOffset))
-	dirData := []byte{}
-	for _, entry := range dir.entries {
-		keyLen := binary.BigEndian.AppendUint32([]byte{}, uint32(len(entry.key)))
-		keyOffset := binary.BigEndian.AppendUint64([]byte{}, entry.offset)
-		dirData = append(dirData, keyLen...)
-		dirData = append(dirData, entry.key...)
-		dirData = append(dirData, keyOffset...)
+	/* Combine dataBlocks:filter:metaindexBlock:indexBlock:footer, the filter is mostly random bits so it is never compressed */
+	metaindexBlock := newBlockBuilder(1)
+	if filterBitsPerKey > 0 {
+		var filterHandle blockHandle
+		data, filterHandle, _ = appendBlock(data, newBloomFilter(keyHashes, filterBitsPerKey), NoCompression)
+		metaindexBlock.add([]byte(FILTERMETAKEY), filterHandle.encode())
 	}
-
-	/* Combine directoryOffset:SSTableData:directory*/
-	data = append(dirOffset, data...)
-	data = append(data, dirData...)
+	footer := footer{}
+	if data, footer.metaindex, err = appendBlock(data, metaindexBlock.finish(), opts.Compression); err != nil {
+		return nil, err
+	}
+	if data, footer.index, err = appendBlock(data, indexBlock.finish(), opts.Compression); err != nil {
+		return nil, err
+	}
+	data = append(data, footer.encode()...)
 
 	return data, nil
-
 }
 
-/*
-Format for a single record: [key_length(4 bytes):key:val_length(4 bytes):val]
-*/
-func createSSTableDataRecord(k, v []byte) (record []byte) {
-	record = binary.BigEndian.AppendUint32(record, uint32(len(k)))
-	record = append(record, k...)
-	record = binary.BigEndian.AppendUint32(record, uint32(len(v)))
-	if len(v) > 0 {
-		record = append(record, v...)
+/* Size of the file, files which can't report their size are read through to find out */
+func fileSize(f SSTableFile) (uint64, error) {
+	switch f := f.(type) {
+	case interface{ Stat() (os.FileInfo, error) }:
+		info, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return uint64(info.Size()), nil
+	case interface{ Size() int64 }:
+		return uint64(f.Size()), nil
 	}
-	return record
+	n, err := io.Copy(io.Discard, io.NewSectionReader(f, 0, math.MaxInt64))
+	return uint64(n), err
 }
 
-/* Note: It will ignore incomplete entries at the end */
-func getSSTableDir(SSTableData []byte) (dir *SSTableDirectory, dirOffset uint64, err error) {
-	if len(SSTableData) < 8 {
-		return nil, 0, ErrNoSSTableDirOffset
+/* Compresses block + appends it to data followed by its trailer, the handle returned excludes the trailer */
+func appendBlock(data, block []byte, compression CompressionType) ([]byte, blockHandle, error) {
+	block, compression, err := compressBlock(block, compression)
+	if err != nil {
+		return data, blockHandle{}, err
 	}
+	handle := blockHandle{offset: uint64(len(data)), size: uint64(len(block))}
+	data = append(data, block...)
+	data = append(data, byte(compression))
+	data = binary.BigEndian.AppendUint32(data, common.MaskedCRC(data[handle.offset:]))
+	return data, handle, nil
+}
 
-	dirOffset = binary.BigEndian.Uint64(SSTableData[:8])
-	curOffset := dirOffset
-	dir = &SSTableDirectory{entries: []*SSTableDirEntry{}}
-	for {
-		if curOffset+4 > uint64(len(SSTableData)) {
-			break
-		}
-		keyLen := binary.BigEndian.Uint32(SSTableData[curOffset : curOffset+4])
-		curOffset += 4
+/*
+- Reads the block 'handle' points at + its trailer, returning the block uncompressed
+- The checksum in the trailer is checked if verifyChecksum is set, a block which doesn't match it or can't be decompressed is reported as ErrCorruption
+*/
+func (db *SSTableDB) readBlockContents(handle blockHandle, verifyChecksum bool) ([]byte, error) {
+	data, err := readAt(db.f, blockHandle{offset: handle.offset, size: handle.size + BLOCKTRAILERSIZE})
+	if err != nil {
+		return nil, err
+	}
+	if verifyChecksum && common.MaskedCRC(data[:handle.size+1]) != binary.BigEndian.Uint32(data[handle.size+1:]) {
+		return nil, db.corruption(handle.offset, ErrChecksumMismatch)
+	}
+	block, err := decompressBlock(data[:handle.size], CompressionType(data[handle.size]))
+	if err != nil {
+		return nil, db.corruption(handle.offset, err)
+	}
+	return block, nil
+}
 
-		if curOffset+uint64(keyLen) > uint64(len(SSTableData)) {
-			break
-		}
-		key := SSTableData[curOffset : curOffset+uint64(keyLen)]
-		curOffset += uint64(keyLen)
+func (db *SSTableDB) corruption(offset uint64, err error) error {
+	return &ErrCorruption{File: db.name, Offset: offset, Err: err}
+}
 
-		if curOffset+8 > uint64(len(SSTableData)) {
-			break
+/* Reads the bytes of the file 'handle' points at */
+func readAt(f SSTableFile, handle blockHandle) ([]byte, error) {
+	b := make([]byte, handle.size)
+	/* ReadAt may return io.EOF along with a full read at the end of the file */
+	if n, err := f.ReadAt(b, int64(handle.offset)); n < len(b) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
 		}
-		keyOffset := binary.BigEndian.Uint64(SSTableData[curOffset : curOffset+8])
-		curOffset += 8
-
-		dirEntry := SSTableDirEntry{len: keyLen, key: key, offset: keyOffset}
-		dir.entries = append(dir.entries, &dirEntry)
+		return nil, err
 	}
-
-	return dir, dirOffset, nil
+	return b, nil
 }
 
-/* Find index of first key greater than or equal to the current key using binary search. Returns 'n' if key does not exist */
-func (db *SSTableDB) getRightBisect(key []byte) int {
-	entries, entriesN := db.dir.entries, len(db.dir.entries)
-	return sort.Search(entriesN, func(i int) bool {
-		return bytes.Compare(entries[i].key, key) >= 0
+/* Index of the first data block which may hold keys >= key, len(index) if there is none */
+func (db *SSTableDB) searchIndex(key []byte) int {
+	return sort.Search(len(db.index), func(i int) bool {
+		return db.compare(db.index[i].separator, key) >= 0
 	})
 }
 
 func (db *SSTableDB) Get(key []byte) (value []byte, err error) {
-	entries := db.dir.entries
-
-	/* First find left and right bounds using binary search */
-	rightBound := db.getRightBisect(key)
-	leftBound := rightBound - 1
-	if rightBound < len(entries) && bytes.Equal(entries[rightBound].key, key) {
-		leftBound = rightBound
+	foundKey, value, err := db.Lookup(key)
+	if err != nil {
+		return nil, err
 	}
-	if leftBound < 0 {
+	if db.compare(foundKey, key) != 0 {
 		return nil, common.ErrKeyDoesNotExist
 	}
+	return value, nil
+}
 
-	/* Seek to the left bound */
-	curOffset := entries[leftBound].offset
-	_, err = db.Seek(int64(curOffset), 0)
-	if err != nil {
-		return nil, errors.Join(ErrSSTableGet)
+/*
+- Returns the first record with a key greater than or equal to key which has the same filter key as key, common.ErrKeyDoesNotExist if there is none
+- The bloom filter is consulted first, so a table which can't contain the filter key is usually not read at all
+- With the default filter key this is an exact match, the DB filters on user keys so that it finds the newest version of a user key
+*/
+func (db *SSTableDB) Lookup(key []byte) (foundKey, value []byte, err error) {
+	return db.LookupWithOptions(key, ReadOptions{})
+}
+
+func (db *SSTableDB) LookupWithOptions(key []byte, ro ReadOptions) (foundKey, value []byte, err error) {
+	filterKey := db.filterKey(key)
+	if !db.filter.mayContain(filterKey) {
+		db.filterStats.useful.Add(1)
+		return nil, nil, common.ErrKeyDoesNotExist
 	}
 
-	/* Now continue searching until we are sure key cannot be found */
-	for curOffset < db.dirOffset {
-		keyLen := make([]byte, 4)
-		_, err = db.f.Read(keyLen)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, errors.Join(ErrSSTableGet)
+	foundKey, value, err = db.find(key, ro)
+	if err == nil && db.compareFilterKeys(db.filterKey(foundKey), filterKey) != 0 {
+		err = common.ErrKeyDoesNotExist
+	}
+	if errors.Is(err, common.ErrKeyDoesNotExist) {
+		/* The filter let through a key the table doesn't hold */
+		if len(db.filter) > 0 {
+			db.filterStats.falsePositive.Add(1)
 		}
+		return nil, nil, err
+	}
+	return foundKey, value, err
+}
 
-		curKey := make([]byte, binary.BigEndian.Uint32(keyLen))
-		_, err = db.f.Read(curKey)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, errors.Join(ErrSSTableGet)
-		}
+/* Counts of how the filter of this table fared on lookups, shared with other tables if Options.FilterStats was set */
+func (db *SSTableDB) FilterStats() *FilterStats {
+	return db.filterStats
+}
 
-		valLen := make([]byte, 4)
-		_, err = db.f.Read(valLen)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, errors.Join(ErrSSTableGet)
-		}
+/* Returns the first record with a key greater than or equal to key, common.ErrKeyDoesNotExist if there is none */
+func (db *SSTableDB) Find(key []byte) (foundKey, value []byte, err error) {
+	return db.find(key, ReadOptions{})
+}
 
-		curVal := make([]byte, binary.BigEndian.Uint32(valLen))
-		_, err = db.f.Read(curVal)
+func (db *SSTableDB) find(key []byte, ro ReadOptions) (foundKey, value []byte, err error) {
+	_, iter, err := db.seek(db.searchIndex(key), key, ro)
+	if err != nil {
+		return nil, nil, errors.Join(ErrSSTableGet, err)
+	}
+	if iter == nil {
+		return nil, nil, common.ErrKeyDoesNotExist
+	}
+	return iter.key, iter.val, nil
+}
+
+/*
+- Returns an iterator at the first entry with a key >= key (the first entry if key is nil) in the data block at idx or any block after it
+- The index of the block it is in is returned along with it, a nil iterator means there is no such entry
+*/
+func (db *SSTableDB) seek(idx int, key []byte, ro ReadOptions) (int, *blockIterator, error) {
+	for ; idx < len(db.index); idx++ {
+		b, err := db.readBlock(idx, ro)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, errors.Join(ErrSSTableGet)
+			return idx, nil, err
 		}
 
-		if bytes.Equal(key, curKey) {
-			return curVal, nil
+		iter := newBlockIterator(b, db.compare)
+		found := false
+		if key == nil {
+			found = iter.seekToFirst()
+		} else {
+			found = iter.seek(key)
+		}
+		if found {
+			return idx, iter, nil
 		}
+		if iter.err != nil {
+			return idx, nil, db.corruption(db.index[idx].handle.offset, iter.err)
+		}
+	}
+	return idx, nil, nil
+}
 
-		if bytes.Compare(key, curKey) < 0 {
-			break
+/*
+- Returns the data block at idx, from the block cache if it has it, otherwise read from the file + added to the cache
+- Blocks are cached uncompressed, so a cached block is never decompressed again - nor is its checksum checked again
+- Uses ReadAt so that concurrent readers of the same table don't share a file offset
+- The returned block may be shared with other readers, it must not be modified
+*/
+func (db *SSTableDB) readBlock(idx int, ro ReadOptions) (*block, error) {
+	handle := db.index[idx].handle
+	cacheKey := cache.Key{Namespace: db.cacheNamespace, File: db.fileNumber, Offset: handle.offset}
+	if db.blockCache != nil {
+		if data, ok := db.blockCache.Get(cacheKey); ok {
+			/* Only blocks which parsed fine are cached */
+			return parseBlock(data)
 		}
 	}
 
-	return nil, common.ErrKeyDoesNotExist
+	data, err := db.readBlockContents(handle, ro.VerifyChecksums)
+	if err != nil {
+		return nil, err
+	}
+	b, err := parseBlock(data)
+	if err != nil {
+		return nil, db.corruption(handle.offset, err)
+	}
+	if db.blockCache != nil {
+		db.blockCache.Insert(cacheKey, data)
+	}
+	return b, nil
 }
 
 func (db *SSTableDB) Has(key []byte) (ret bool, err error) {
@@ -273,7 +547,11 @@ func (db *SSTableDB) Has(key []byte) (ret bool, err error) {
 }
 
 func (db *SSTableDB) FullScan() (common.Iterator, error) {
-	iter, err := NewFullSSTableIterator(db)
+	return db.FullScanWithOptions(ReadOptions{})
+}
+
+func (db *SSTableDB) FullScanWithOptions(ro ReadOptions) (common.Iterator, error) {
+	iter, err := NewFullSSTableIteratorWithOptions(db, ro)
 	if err != nil {
 		return nil, err
 	}
@@ -281,19 +559,28 @@ func (db *SSTableDB) FullScan() (common.Iterator, error) {
 }
 
 func (db *SSTableDB) RangeScan(start, limit []byte) (common.Iterator, error) {
-	iter, err := NewSSTableIterator(db, start, limit)
+	return db.RangeScanWithOptions(start, limit, ReadOptions{})
+}
+
+func (db *SSTableDB) RangeScanWithOptions(start, limit []byte, ro ReadOptions) (common.Iterator, error) {
+	iter, err := NewSSTableIteratorWithOptions(db, start, limit, ro)
 	if err != nil {
 		return nil, err
 	}
 	return iter, nil
 }
 
-func (db *SSTableDB) Seek(offset int64, whence int) (int64, error) {
-	originOffset, err := db.f.Seek(offset, whence)
-	if err != nil {
-		return -1, err
-	}
-	return originOffset, nil
+/* Size of the entire SSTable file in bytes, including the index, filter + footer */
+func (db *SSTableDB) Size() uint64 {
+	return db.size
+}
+
+func (db *SSTableDB) SmallestKey() []byte {
+	return db.smallestKey
+}
+
+func (db *SSTableDB) LargestKey() []byte {
+	return db.largestKey
 }
 
 func (db *SSTableDB) Close() error {
@@ -301,214 +588,78 @@ func (db *SSTableDB) Close() error {
 }
 
 func NewSSTableIterator(db *SSTableDB, start, limit []byte) (*SSTableIterator, error) {
-	entries, entriesN := db.dir.entries, len(db.dir.entries)
+	return NewSSTableIteratorWithOptions(db, start, limit, ReadOptions{})
+}
 
-	if bytes.Compare(start, limit) > 0 {
+func NewSSTableIteratorWithOptions(db *SSTableDB, start, limit []byte, ro ReadOptions) (*SSTableIterator, error) {
+	if db.compare(start, limit) > 0 {
 		return nil, common.ErrInvalidRange
 	}
 
 	/* Find first key equal to or greater than startKey */
-	startIdx := db.getRightBisect(start)
-	if startIdx == entriesN {
-		return &SSTableIterator{db: db, hasEnded: true, endKey: limit}, nil
-	}
-
-	/* Seek to this key  */
-	curOffset := entries[startIdx].offset
-	_, err := db.Seek(int64(curOffset), 0)
-	if err != nil {
-		return nil, errors.Join(ErrNewSSTableIter, err)
-	}
-
-	/* Add first key, val to iterator */
-	keyLen := make([]byte, 4)
-	_, err = db.f.Read(keyLen)
-	if err != nil {
-		if err == io.EOF {
-			return &SSTableIterator{db: db, hasEnded: true, endKey: limit}, nil
-		}
-		return nil, errors.Join(ErrNewSSTableIter, err)
-	}
-	curOffset += 4
-
-	curKey := make([]byte, binary.BigEndian.Uint32(keyLen))
-	_, err = db.f.Read(curKey)
-	if err != nil {
-		if err == io.EOF {
-			return &SSTableIterator{db: db, hasEnded: true, endKey: limit}, nil
-		}
-		return nil, errors.Join(ErrNewSSTableIter, err)
-	}
-	curOffset += uint64(len(curKey))
-
-	valLen := make([]byte, 4)
-	_, err = db.f.Read(valLen)
+	idx, blockIter, err := db.seek(db.searchIndex(start), start, ro)
 	if err != nil {
-		if err == io.EOF {
-			return &SSTableIterator{db: db, hasEnded: true, endKey: limit}, nil
-		}
 		return nil, errors.Join(ErrNewSSTableIter, err)
 	}
-	curOffset += 4
 
-	curVal := make([]byte, binary.BigEndian.Uint32(valLen))
-	_, err = db.f.Read(curVal)
-	if err != nil {
-		if err == io.EOF {
-			return &SSTableIterator{db: db, hasEnded: true, endKey: limit}, nil
-		}
-		return nil, errors.Join(ErrNewSSTableIter, err)
+	/* No elems found in the range - no key >= start, or first key itself exceeds limit */
+	if blockIter == nil || db.compare(blockIter.key, limit) > 0 {
+		return &SSTableIterator{db: db, ro: ro, endKey: limit, hasEnded: true}, nil
 	}
-	curOffset += uint64(len(curVal))
 
-	/* No elems found in the range - first key itself exceeds limit */
-	if bytes.Compare(curKey, limit) > 0 {
-		return &SSTableIterator{db: db, fileOffset: curOffset, endKey: limit, hasEnded: true}, nil
-	}
-
-	return &SSTableIterator{db: db, fileOffset: curOffset, endKey: limit, curKey: curKey, curVal: curVal}, nil
+	return &SSTableIterator{db: db, ro: ro, block: idx, blockIter: blockIter, endKey: limit, curKey: blockIter.key, curVal: blockIter.val}, nil
 }
 
 func NewFullSSTableIterator(db *SSTableDB) (*SSTableIterator, error) {
-	entries, entriesN := db.dir.entries, len(db.dir.entries)
-
-	/* No directory entries */
-	if entriesN == 0 {
-		return &SSTableIterator{hasEnded: true, fullScan: true}, nil
-	}
-
-	/* Seek to first key  */
-	curOffset := entries[0].offset
-	_, err := db.Seek(int64(curOffset), 0)
-	if err != nil {
-		return nil, errors.Join(ErrNewSSTableIter, err)
-	}
-
-	/* Add first key, val to iterator */
-	keyLen := make([]byte, 4)
-	_, err = db.f.Read(keyLen)
-	if err != nil {
-		if err == io.EOF {
-			return &SSTableIterator{db: db, hasEnded: true, fullScan: true}, nil
-		}
-		return nil, errors.Join(ErrNewSSTableIter, err)
-	}
-	curOffset += 4
-
-	curKey := make([]byte, binary.BigEndian.Uint32(keyLen))
-	_, err = db.f.Read(curKey)
-	if err != nil {
-		if err == io.EOF {
-			return &SSTableIterator{db: db, hasEnded: true, fullScan: true}, nil
-		}
-		return nil, errors.Join(ErrNewSSTableIter, err)
-	}
-	curOffset += uint64(len(curKey))
+	return NewFullSSTableIteratorWithOptions(db, ReadOptions{})
+}
 
-	valLen := make([]byte, 4)
-	_, err = db.f.Read(valLen)
+func NewFullSSTableIteratorWithOptions(db *SSTableDB, ro ReadOptions) (*SSTableIterator, error) {
+	idx, blockIter, err := db.seek(0, nil, ro)
 	if err != nil {
-		if err == io.EOF {
-			return &SSTableIterator{db: db, hasEnded: true, fullScan: true}, nil
-		}
 		return nil, errors.Join(ErrNewSSTableIter, err)
 	}
-	curOffset += 4
-
-	curVal := make([]byte, binary.BigEndian.Uint32(valLen))
-	_, err = db.f.Read(curVal)
-	if err != nil {
-		if err == io.EOF {
-			return &SSTableIterator{db: db, hasEnded: true, fullScan: true}, nil
-		}
-		return nil, errors.Join(ErrNewSSTableIter, err)
+	if blockIter == nil {
+		return &SSTableIterator{db: db, ro: ro, hasEnded: true, fullScan: true}, nil
 	}
-	curOffset += uint64(len(curVal))
 
-	return &SSTableIterator{db: db, fileOffset: curOffset, fullScan: true, curKey: curKey, curVal: curVal}, nil
+	return &SSTableIterator{db: db, ro: ro, block: idx, blockIter: blockIter, fullScan: true, curKey: blockIter.key, curVal: blockIter.val}, nil
 }
 
 /*
-- If iterator errors out other than for io.EOF, it will remain at the same offset with same k,v
+- If iterator errors out, it will remain at the same k,v
+- Each iterator tracks its own position, so any number of them can be used concurrently on the same table
 */
 func (iter *SSTableIterator) Next() bool {
 	if iter.hasEnded {
 		return false
 	}
 
-	if iter.fileOffset >= iter.db.dirOffset {
-		iter.curKey, iter.curVal = nil, nil
-		iter.hasEnded = true
-		return false
-	}
-
-	db := iter.db
-	offset := iter.fileOffset
-
-	/* Add next key, val to iterator */
-	keyLen := make([]byte, 4)
-	_, err := db.f.Read(keyLen)
-	if err != nil {
-		if err == io.EOF {
-			iter.curKey, iter.curVal = nil, nil
-			iter.hasEnded = true
-			return false
-		}
-		iter.err = err
-		return false
-	}
-	offset += 4
-
-	curKey := make([]byte, binary.BigEndian.Uint32(keyLen))
-	_, err = db.f.Read(curKey)
-	if err != nil {
-		if err == io.EOF {
-			iter.curKey, iter.curVal = nil, nil
-			iter.hasEnded = true
+	/* Move to the next entry of the block, or the first entry of the blocks after it */
+	idx, blockIter := iter.block, iter.blockIter
+	if !blockIter.next() {
+		if blockIter.err != nil {
+			iter.err = errors.Join(ErrSSTableIterNext, iter.db.corruption(iter.db.index[idx].handle.offset, blockIter.err))
 			return false
 		}
-		iter.err = err
-		return false
-	}
-	offset += uint64(len(curKey))
-
-	valLen := make([]byte, 4)
-	_, err = db.f.Read(valLen)
-	if err != nil {
-		if err == io.EOF {
-			iter.curKey, iter.curVal = nil, nil
-			iter.hasEnded = true
-			return false
-		}
-		iter.err = err
-		return false
-	}
-	offset += 4
-
-	curVal := make([]byte, binary.BigEndian.Uint32(valLen))
-	_, err = db.f.Read(curVal)
-	if err != nil {
-		if err == io.EOF {
-			iter.curKey, iter.curVal = nil, nil
-			iter.hasEnded = true
+		var err error
+		idx, blockIter, err = iter.db.seek(idx+1, nil, iter.ro)
+		if err != nil {
+			iter.err = errors.Join(ErrSSTableIterNext, err)
 			return false
 		}
-		iter.err = err
-		return false
 	}
-	offset += uint64(len(curVal))
 
-	/* Check if range limit exceeded - unless we are full scanning*/
-	if !iter.fullScan && bytes.Compare(curKey, iter.endKey) > 0 {
+	/* Check if table exhausted or range limit exceeded - unless we are full scanning */
+	if blockIter == nil || (!iter.fullScan && iter.db.compare(blockIter.key, iter.endKey) > 0) {
 		iter.curKey, iter.curVal = nil, nil
 		iter.hasEnded = true
 		return false
 	}
 
-	iter.curKey = curKey
-	iter.curVal = curVal
+	iter.block, iter.blockIter = idx, blockIter
+	iter.curKey, iter.curVal = blockIter.key, blockIter.val
 	iter.err = nil
-	iter.fileOffset = offset
 
 	return true
 }
@@ -517,9 +668,6 @@ func (iter *SSTableIterator) Key() []byte {
 	return iter.curKey
 }
 
-/*
-- We use Get which searches for the offset again, even though we already have the offset with us, can be improved
-*/
 func (iter *SSTableIterator) Value() []byte {
 	return iter.curVal
 }
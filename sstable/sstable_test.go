@@ -4,10 +4,15 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
+	"github.com/chettriyuvraj/leveldb-clone/cache"
 	"github.com/chettriyuvraj/leveldb-clone/common"
 	"github.com/chettriyuvraj/leveldb-clone/test"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -73,36 +78,55 @@ func (b BytesReadWriteSeekCloser) Close() error {
 }
 
 /* Implementation-specific tests */
-/* Can be more robust, but for now we are testing our ss table generation solely by comparing the directory generated */
-func TestGetSSTableDir(t *testing.T) {
-	/* Populate DB */
-	distBetweenIndexKeys := 10
-	records := []kvRecord{
-		{[]byte("comp"), []byte("c")},
-		{[]byte("extc"), []byte{}},
-		{[]byte("mecha"), []byte("mechanical")},
-		{[]byte("zebr"), []byte("?")},
+func TestSSTableFormat(t *testing.T) {
+	records := []kvRecord{}
+	for i := 0; i < 50; i++ {
+		records = append(records, kvRecord{[]byte(fmt.Sprintf("key%03d", i*3)), []byte(fmt.Sprintf("val%03d", i*3))})
 	}
+	sstData, err := GetSSTableData(NewDummyIterator(records), 64)
+	require.NoError(t, err)
 
-	/* Get SSTable data for DB, convert it to dir and compare to expected dir */
-	iter := NewDummyIterator(records)
-	sstData, err := GetSSTableData(iter, distBetweenIndexKeys)
+	/* Footer is at the very end + points at the index and metaindex blocks */
+	footer, err := decodeFooter(sstData[len(sstData)-FOOTERSIZE:], uint64(len(sstData)-FOOTERSIZE))
 	require.NoError(t, err)
-	gotDir, _, err := getSSTableDir(sstData)
+	require.Greater(t, footer.index.offset, footer.metaindex.offset)
+
+	/* Every data block is listed in the index with a separator between its last key and the first key of the next block, blocks are cut once they reach the block size */
+	sstdb, err := NewSSTableDB(BytesReadWriteSeekCloser{bytes.NewReader(sstData)})
 	require.NoError(t, err)
-	expectedDir := SSTableDirectory{
-		entries: []*SSTableDirEntry{
-			{len: 4, key: records[0].k, offset: 8},
-			{len: 5, key: records[2].k, offset: 8 + 16 + 9},
-		},
+	require.Greater(t, len(sstdb.index), 1)
+	i := 0
+	for idx, entry := range sstdb.index {
+		b, err := sstdb.readBlock(idx, ReadOptions{})
+		require.NoError(t, err)
+		iter := newBlockIterator(b, bytes.Compare)
+		for ok := iter.seekToFirst(); ok; ok = iter.next() {
+			require.Equal(t, records[i].k, iter.key)
+			i++
+		}
+		require.GreaterOrEqual(t, bytes.Compare(entry.separator, records[i-1].k), 0)
+		if idx < len(sstdb.index)-1 {
+			require.Less(t, bytes.Compare(entry.separator, records[i].k), 0)
+			require.GreaterOrEqual(t, int(entry.handle.size), 64)
+		}
 	}
+	require.Equal(t, len(records), i)
+	require.Equal(t, records[0].k, sstdb.SmallestKey())
+	require.Equal(t, records[len(records)-1].k, sstdb.LargestKey())
+	require.NotEmpty(t, sstdb.filter)
 
-	require.Equal(t, expectedDir, *gotDir)
+	/* Tables with a bad magic number or cut short are rejected */
+	corrupt := append([]byte{}, sstData...)
+	corrupt[len(corrupt)-1]++
+	_, err = NewSSTableDB(BytesReadWriteSeekCloser{bytes.NewReader(corrupt)})
+	require.ErrorIs(t, err, ErrBadSSTableMagic)
+	_, err = NewSSTableDB(BytesReadWriteSeekCloser{bytes.NewReader(sstData[:FOOTERSIZE-1])})
+	require.ErrorIs(t, err, ErrInvalidSSTableFooter)
 }
 
 func TestSSTableGet(t *testing.T) {
 	/* Populate db */
-	distBetweenIndexKeys := 10
+	blockSize := 16
 	records := []kvRecord{
 		{[]byte("biot"), []byte("b")},
 		{[]byte("comp"), []byte("c")},
@@ -114,7 +138,7 @@ func TestSSTableGet(t *testing.T) {
 
 	/* Get SSTable */
 	iter := NewDummyIterator(records)
-	sstData, err := GetSSTableData(iter, distBetweenIndexKeys)
+	sstData, err := GetSSTableData(iter, blockSize)
 	require.NoError(t, err)
 	sstDB, err := NewSSTableDB(BytesReadWriteSeekCloser{bytes.NewReader(sstData)})
 	require.NoError(t, err)
@@ -127,8 +151,8 @@ func TestSSTableGet(t *testing.T) {
 	}{
 		{name: "get first record", record: records[0]},
 		{name: "get last record", record: records[5]},
-		{name: "get last dir indexed record", record: records[4]},
-		{name: "get non dir indexed record", record: records[2]},
+		{name: "get last key of a block", record: records[4]},
+		{name: "get key in the middle of the table", record: records[2]},
 		{name: "get non-existent record lesser than first key", record: struct {
 			k []byte
 			v []byte
@@ -150,6 +174,49 @@ func TestSSTableGet(t *testing.T) {
 	}
 }
 
+/* Orders keys in reverse */
+type reverseComparator struct{}
+
+func (reverseComparator) Compare(a, b []byte) int { return bytes.Compare(b, a) }
+
+func (reverseComparator) Name() string { return "test.ReverseComparator" }
+
+func (reverseComparator) FindShortestSeparator(start, limit []byte) []byte { return start }
+
+func (reverseComparator) FindShortSuccessor(key []byte) []byte { return key }
+
+func TestSSTableComparator(t *testing.T) {
+	records := []kvRecord{}
+	for i := 49; i >= 0; i-- {
+		records = append(records, kvRecord{[]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("val%03d", i))})
+	}
+	opts := Options{Comparator: reverseComparator{}}
+	sstData, err := GetSSTableDataWithOptions(NewDummyIterator(records), 64, opts)
+	require.NoError(t, err)
+	sstdb, err := NewSSTableDBWithOptions(BytesReadWriteSeekCloser{bytes.NewReader(sstData)}, opts)
+	require.NoError(t, err)
+	require.Greater(t, len(sstdb.index), 1)
+	require.Equal(t, []byte("key049"), sstdb.SmallestKey())
+	require.Equal(t, []byte("key000"), sstdb.LargestKey())
+
+	for _, record := range records {
+		v, err := sstdb.Get(record.k)
+		require.NoError(t, err)
+		require.Equal(t, record.v, v)
+	}
+	_, err = sstdb.Get([]byte("key050"))
+	require.ErrorIs(t, err, common.ErrKeyDoesNotExist)
+
+	/* Ranges run in the order of the comparator */
+	iter, err := NewSSTableIterator(&sstdb, []byte("key030"), []byte("key020"))
+	require.NoError(t, err)
+	got := []kvRecord{}
+	for ok := iter.Key() != nil; ok; ok = iter.Next() {
+		got = append(got, kvRecord{iter.Key(), iter.Value()})
+	}
+	require.Equal(t, records[19:30], got)
+}
+
 func TestSSTableRangeScan(t *testing.T) {
 	records := []kvRecord{
 		{[]byte("key1"), []byte("val1")},
@@ -160,7 +227,7 @@ func TestSSTableRangeScan(t *testing.T) {
 	}
 
 	iter := NewDummyIterator(records)
-	sstData, err := GetSSTableData(iter, DEFAULTINDEXDISTANCE)
+	sstData, err := GetSSTableData(iter, 16)
 	require.NoError(t, err)
 	sstdb, err := NewSSTableDB(BytesReadWriteSeekCloser{bytes.NewReader(sstData)})
 	require.NoError(t, err)
@@ -200,6 +267,17 @@ func TestSSTableRangeScan(t *testing.T) {
 	test.IteratorTestNext(t, iterator, false, false)
 	test.IteratorTestKey(t, iterator, nil, false)
 	test.IteratorTestVal(t, iterator, nil, false)
+
+	/* Range starting at a key which is not in the table, it must start at the next key even if that is in the next block */
+	start, end = []byte("key2"), []byte("key6")
+	iterator, err = sstdb.RangeScan(start, end)
+	require.NoError(t, err)
+	for i := 3; i <= 5; i += 2 {
+		test.IteratorTestKey(t, iterator, []byte(fmt.Sprintf("key%d", i)), false)
+		test.IteratorTestVal(t, iterator, []byte(fmt.Sprintf("val%d", i)), false)
+		test.IteratorTestNext(t, iterator, i < 5, false)
+	}
+	test.IteratorTestKey(t, iterator, nil, false)
 }
 
 func TestFullScan(t *testing.T) {
@@ -215,7 +293,7 @@ func TestFullScan(t *testing.T) {
 		/* Populate a subset of the test case records */
 		curRecords := records[:i+1]
 		dummyIter := NewDummyIterator(curRecords)
-		sstData, err := GetSSTableData(dummyIter, DEFAULTINDEXDISTANCE)
+		sstData, err := GetSSTableData(dummyIter, 16)
 		require.NoError(t, err)
 		db, err := NewSSTableDB(BytesReadWriteSeekCloser{bytes.NewReader(sstData)})
 		require.NoError(t, err)
@@ -240,3 +318,151 @@ func TestFullScan(t *testing.T) {
 		test.IteratorTestVal(t, iter, nil, false)
 	}
 }
+
+func TestSSTableConcurrentReads(t *testing.T) {
+	records := []kvRecord{}
+	for i := 0; i < 100; i++ {
+		records = append(records, kvRecord{[]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("val%03d", i))})
+	}
+	sstData, err := GetSSTableData(NewDummyIterator(records), 64)
+	require.NoError(t, err)
+	sstdb, err := NewSSTableDB(BytesReadWriteSeekCloser{bytes.NewReader(sstData)})
+	require.NoError(t, err)
+
+	/* Iterators and Gets interleave on the same table, each must see the records in order regardless of the others */
+	wg := sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			iter, err := sstdb.FullScan()
+			if !assert.NoError(t, err) {
+				return
+			}
+			for i := 0; i < len(records); i++ {
+				assert.Equal(t, records[i].k, iter.Key())
+				assert.Equal(t, records[i].v, iter.Value())
+
+				k := records[(i*7+g)%len(records)]
+				v, err := sstdb.Get(k.k)
+				assert.NoError(t, err)
+				assert.Equal(t, k.v, v)
+
+				iter.Next()
+			}
+			assert.Nil(t, iter.Key())
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestSSTableBlockCache(t *testing.T) {
+	records := []kvRecord{}
+	for i := 0; i < 100; i++ {
+		records = append(records, kvRecord{[]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("val%03d", i))})
+	}
+	sstData, err := GetSSTableData(NewDummyIterator(records), 64)
+	require.NoError(t, err)
+
+	/* Two tables with the same file number share a cache, they are kept apart by namespace */
+	blockCache := cache.NewLRUCache(1 << 20)
+	opts := Options{BlockCache: blockCache, FileNumber: 1}
+	sstdb, err := NewSSTableDBWithOptions(BytesReadWriteSeekCloser{bytes.NewReader(sstData)}, opts)
+	require.NoError(t, err)
+	otherData, err := GetSSTableData(NewDummyIterator([]kvRecord{{[]byte("key000"), []byte("other")}}), 64)
+	require.NoError(t, err)
+	otherdb, err := NewSSTableDBWithOptions(BytesReadWriteSeekCloser{bytes.NewReader(otherData)}, opts)
+	require.NoError(t, err)
+
+	/* First read of a block misses, the next one hits - opening a table reads its first block, so keys are taken from the last one */
+	last := records[len(records)-1]
+	hits, misses := blockCache.Hits(), blockCache.Misses()
+	v, err := sstdb.Get(last.k)
+	require.NoError(t, err)
+	require.Equal(t, last.v, v)
+	require.Equal(t, hits, blockCache.Hits())
+	require.Equal(t, misses+1, blockCache.Misses())
+	v, err = sstdb.Get(last.k)
+	require.NoError(t, err)
+	require.Equal(t, last.v, v)
+	require.Equal(t, hits+1, blockCache.Hits())
+
+	/* The other table's only block was read when opening it */
+	v, err = otherdb.Get(records[0].k)
+	require.NoError(t, err)
+	require.Equal(t, []byte("other"), v)
+	require.Equal(t, hits+2, blockCache.Hits())
+	require.Equal(t, misses+1, blockCache.Misses())
+
+	/* Scanning twice reads every block from the cache the second time */
+	for round := 0; round < 2; round++ {
+		misses := blockCache.Misses()
+		iter, err := sstdb.FullScan()
+		require.NoError(t, err)
+		for _, record := range records {
+			require.Equal(t, record.k, iter.Key())
+			require.Equal(t, record.v, iter.Value())
+			iter.Next()
+		}
+		require.Nil(t, iter.Key())
+		if round == 1 {
+			require.Equal(t, misses, blockCache.Misses())
+		}
+	}
+}
+
+func TestSSTableCorruption(t *testing.T) {
+	records := []kvRecord{}
+	for i := 0; i < 50; i++ {
+		records = append(records, kvRecord{[]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("val%03d", i))})
+	}
+	sstData, err := GetSSTableData(NewDummyIterator(records), 64)
+	require.NoError(t, err)
+	filename := filepath.Join(t.TempDir(), "corrupt.sst")
+	sstdb, err := NewSSTableDB(BytesReadWriteSeekCloser{bytes.NewReader(sstData)})
+	require.NoError(t, err)
+	index := sstdb.index
+
+	/* Flip a bit in the value of the last record, only a read verifying checksums notices */
+	corrupt := append([]byte{}, sstData...)
+	last := index[len(index)-1].handle
+	corrupt[bytes.Index(corrupt[last.offset:], []byte("val049"))+int(last.offset)] ^= 1
+	require.NoError(t, os.WriteFile(filename, corrupt, 0644))
+	sstdb, err = OpenSSTableDB(filename)
+	require.NoError(t, err)
+	defer sstdb.Close()
+
+	v, err := sstdb.Get(records[49].k)
+	require.NoError(t, err)
+	require.NotEqual(t, records[49].v, v)
+	_, _, err = sstdb.LookupWithOptions(records[49].k, ReadOptions{VerifyChecksums: true})
+	corruption := &ErrCorruption{}
+	require.ErrorAs(t, err, &corruption)
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+	require.Equal(t, filename, corruption.File)
+	require.Equal(t, last.offset, corruption.Offset)
+
+	/* Iterators verifying checksums stop at the corrupt block, records before it are read fine */
+	iter, err := sstdb.FullScanWithOptions(ReadOptions{VerifyChecksums: true})
+	require.NoError(t, err)
+	n := 0
+	for ; iter.Key() != nil && n < len(records); n++ {
+		require.Equal(t, records[n].k, iter.Key())
+		if !iter.Next() {
+			break
+		}
+	}
+	require.ErrorAs(t, iter.Error(), &corruption)
+	require.Equal(t, last.offset, corruption.Offset)
+	require.Less(t, n, len(records)-1)
+
+	/* Blocks read when opening the table are always checked */
+	corrupt = append([]byte{}, sstData...)
+	footer, err := decodeFooter(sstData[len(sstData)-FOOTERSIZE:], uint64(len(sstData)-FOOTERSIZE))
+	require.NoError(t, err)
+	corrupt[footer.index.offset] ^= 1
+	_, err = NewSSTableDB(BytesReadWriteSeekCloser{bytes.NewReader(corrupt)})
+	require.ErrorAs(t, err, &corruption)
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+	require.Equal(t, footer.index.offset, corruption.Offset)
+}
@@ -8,40 +8,45 @@ import (
 const (
 	PUT = byte(iota)
 	DELETE
+	BATCH /* Key is empty, val holds an encoded batch of writes which are stamped with consecutive sequence numbers starting at seq */
 )
 
 const (
-	MINIMUMRECORDSIZE = 9
+	MINIMUMRECORDSIZE = 17
 )
 
 var opmap map[byte]bool = map[byte]bool{
 	PUT:    true,
 	DELETE: true,
+	BATCH:  true,
 }
 
 var ErrOpDoesNotExist = errors.New("the provided op does not exist")
 var ErrMinRecordSize = errors.New("size of record lesser than the minimum record size")
-var ErrNoKeyLength = errors.New("no key length exists after op")
 var ErrNoKeyData = errors.New("key data of the specified key length does not exist after key length")
-var ErrNoValLength = errors.New("no val length exists after key")
 var ErrNoValData = errors.New("val data of the specified key length does not exist after val length")
 
 type LogRecord struct {
 	key, val []byte
 	op       byte
+	seq      uint64 /* Sequence number the write was stamped with */
 }
 
-func NewLogRecord(k, v []byte, op byte) (*LogRecord, error) {
+func NewLogRecord(k, v []byte, op byte, seq uint64) (*LogRecord, error) {
 	if exists := opmap[op]; !exists {
 		return nil, ErrOpDoesNotExist
 	}
-	return &LogRecord{key: k, val: v, op: op}, nil
+	return &LogRecord{key: k, val: v, op: op, seq: seq}, nil
 }
 
 func (record *LogRecord) Op() byte {
 	return record.op
 }
 
+func (record *LogRecord) Seq() uint64 {
+	return record.seq
+}
+
 func (record *LogRecord) Key() []byte {
 	return record.key
 }
@@ -52,6 +57,7 @@ func (record *LogRecord) Val() []byte {
 
 func (record *LogRecord) MarshalBinary() (data []byte, err error) {
 	data = []byte{record.op}
+	data = binary.BigEndian.AppendUint64(data, record.seq)
 	data = binary.BigEndian.AppendUint32(data, uint32(len(record.key)))
 	data = append(data, record.key...)
 	data = binary.BigEndian.AppendUint32(data, uint32(len(record.val)))
@@ -76,12 +82,16 @@ func (record *LogRecord) UnmarshalBinary(data []byte) error {
 	record.op = op
 	bytesRead += 1
 
+	/* Read sequence number */
+	record.seq = binary.BigEndian.Uint64(data[1:9])
+	bytesRead += 8
+
 	/* Read key len */
-	kLen := data[1:5]
+	kLen := data[9:13]
 	bytesRead += 4
 
 	/* Read key */
-	kStart, kEnd := 5, int(5+binary.BigEndian.Uint32(kLen))
+	kStart, kEnd := 13, int(13+binary.BigEndian.Uint32(kLen))
 	if kEnd-kStart > len(data)-bytesRead {
 		return ErrNoKeyData
 	}
@@ -101,7 +111,9 @@ func (record *LogRecord) UnmarshalBinary(data []byte) error {
 	if vEnd-vStart > len(data)-bytesRead {
 		return ErrNoValData
 	}
-	record.val = data[vStart:vEnd]
+	if vEnd > vStart {
+		record.val = data[vStart:vEnd]
+	}
 	bytesRead += vEnd - vStart
 
 	return nil
@@ -7,13 +7,13 @@ import (
 )
 
 func TestRecordMarshal(t *testing.T) {
-	k, v, op := []byte("key4344"), []byte("val334"), DELETE
-	record, err := NewLogRecord(k, v, op)
+	k, v, op, seq := []byte("key4344"), []byte("val334"), DELETE, uint64(258)
+	record, err := NewLogRecord(k, v, op, seq)
 	require.NoError(t, err)
 	data, err := record.MarshalBinary()
 
 	/* Compute expected result by hand and then compare */
-	e1 := append([]byte{DELETE, 0x00, 0x00, 0x00, 0x07}, k...)
+	e1 := append([]byte{DELETE, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x00, 0x00, 0x00, 0x07}, k...)
 	e2 := append([]byte{0x00, 0x00, 0x00, 0x06}, v...)
 	expected := append(e1, e2...)
 	require.NoError(t, err)
@@ -22,10 +22,12 @@ func TestRecordMarshal(t *testing.T) {
 
 func TestRecordUnmarshal(t *testing.T) {
 	k, v, op := []byte("key4344"), []byte("val334"), DELETE
-	record, err := NewLogRecord(k, v, op)
+	record, err := NewLogRecord(k, v, op, 7)
 	require.NoError(t, err)
 	data, err := record.MarshalBinary()
 	require.NoError(t, err)
+	seq := []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x07}
+	withSeq := func(rest ...byte) []byte { return append(append([]byte{DELETE}, seq...), rest...) }
 
 	tcs := []struct {
 		name string
@@ -35,9 +37,9 @@ func TestRecordUnmarshal(t *testing.T) {
 	}{
 		{name: "unmarshal a simple binary log record", want: record, data: data},
 		{name: "violates minimum log size", data: []byte{DELETE, 0x01, 0x02}, err: ErrMinRecordSize},
-		{name: "key smaller than key length", data: []byte{DELETE, 0x00, 0x00, 0x00, 0x08, 0x01, 0x02, 0x02, 0x03, 0x04}, err: ErrNoKeyData},
-		{name: "no val data exists", data: []byte{DELETE, 0x00, 0x00, 0x00, 0x04, 0x01, 0x02, 0x03, 0x08}, err: ErrNoValData},
-		{name: "val smaller than val length", data: []byte{DELETE, 0x00, 0x00, 0x00, 0x03, 0x01, 0x02, 0x03, 0x00, 0x00, 0x00, 0x02, 0x01}, err: ErrNoValData},
+		{name: "key smaller than key length", data: withSeq(0x00, 0x00, 0x00, 0x08, 0x01, 0x02, 0x02, 0x03, 0x04), err: ErrNoKeyData},
+		{name: "no val data exists", data: withSeq(0x00, 0x00, 0x00, 0x04, 0x01, 0x02, 0x03, 0x08), err: ErrNoValData},
+		{name: "val smaller than val length", data: withSeq(0x00, 0x00, 0x00, 0x03, 0x01, 0x02, 0x03, 0x00, 0x00, 0x00, 0x02, 0x01), err: ErrNoValData},
 	}
 
 	for _, tc := range tcs {
@@ -0,0 +1,193 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/chettriyuvraj/leveldb-clone/common"
+)
+
+var ErrTornWrite = errors.New("log ends in a write cut short by a crash")
+
+/*
+- Reads the records of a log one at a time, holding a single block of the log in memory
+- A damaged fragment or incomplete record at the tail of the log is what a crash in the middle of a write leaves behind, it is returned as ErrCorruption wrapping ErrTornWrite
+- Damage anywhere else is returned as ErrCorruption, calling Next again skips past it to the next record which can be read
+*/
+type Reader struct {
+	file         io.Reader
+	filename     string
+	buf          []byte
+	block        []byte /* Block being read, shorter than BLOCKSIZE only if it is the last one */
+	blockOffset  int64  /* Offset of block within the log */
+	pos          int    /* Offset of the next fragment within block */
+	last         bool   /* block is the last block of the log */
+	done         bool
+	payload      []byte /* Fragments of the record being reassembled */
+	recordOffset int64
+	inRecord     bool
+}
+
+/* Reads from the current offset of the file, which must be the start of a block */
+func (log *WAL) NewReader() (*Reader, error) {
+	if log.file == nil {
+		return nil, ErrNoUnderlyingFileForLog
+	}
+	return &Reader{file: log.file, filename: log.filename, buf: make([]byte, BLOCKSIZE)}, nil
+}
+
+/* Returns the next record, or io.EOF once the log is read to its end */
+func (r *Reader) Next() (*LogRecord, error) {
+	for {
+		if r.done {
+			return nil, io.EOF
+		}
+
+		/* Rest of the block is padding, or the block is used up */
+		if r.pos >= len(r.block) || BLOCKSIZE-r.pos < HEADERSIZE {
+			if r.last {
+				return nil, r.finish(nil)
+			}
+			if err := r.readBlock(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		offset := r.blockOffset + int64(r.pos)
+		header := r.block[r.pos:]
+		if len(header) < HEADERSIZE {
+			/* Only the last block can end in the middle of a header */
+			if isZeros(header) {
+				return nil, r.finish(nil)
+			}
+			return nil, r.finish(r.corruption(offset, ErrTornWrite))
+		}
+		if isZeros(header[:HEADERSIZE]) {
+			/* Never written, which is what a preallocated file holds past its last write */
+			atEnd, err := r.skipDamage(r.pos)
+			if err != nil {
+				return nil, err
+			}
+			if atEnd {
+				return nil, r.finish(nil)
+			}
+			return nil, r.corruption(offset, ErrBadFragment)
+		}
+
+		/* A fragment which is cut short or doesn't match its checksum is a torn write if nothing was written after it */
+		fragmentLen, fragmentType := int(binary.BigEndian.Uint16(header[4:6])), header[6]
+		end := r.pos + HEADERSIZE + fragmentLen
+		if end > len(r.block) {
+			if r.last {
+				return nil, r.finish(r.corruption(offset, ErrTornWrite))
+			}
+			r.pos, r.inRecord = len(r.block), false
+			return nil, r.corruption(offset, ErrBadFragment)
+		}
+		fragment := r.block[r.pos+HEADERSIZE : end]
+		if common.MaskedCRC([]byte{fragmentType}, fragment) != binary.BigEndian.Uint32(header) {
+			atEnd, err := r.skipDamage(end)
+			if err != nil {
+				return nil, err
+			}
+			if atEnd {
+				return nil, r.finish(r.corruption(offset, ErrTornWrite))
+			}
+			return nil, r.corruption(offset, ErrChecksumMismatch)
+		}
+
+		/* Reassemble records from their fragments, a fragment out of order drops the record being reassembled */
+		switch {
+		case (fragmentType == FULLTYPE || fragmentType == FIRSTTYPE) && !r.inRecord:
+			r.payload, r.recordOffset, r.inRecord = r.payload[:0], offset, true
+		case (fragmentType == MIDDLETYPE || fragmentType == LASTTYPE) && r.inRecord:
+		default:
+			r.pos, r.inRecord = end, false
+			return nil, r.corruption(offset, ErrBadFragment)
+		}
+		r.payload = append(r.payload, fragment...)
+		r.pos = end
+
+		if fragmentType == FULLTYPE || fragmentType == LASTTYPE {
+			r.inRecord = false
+			record := LogRecord{}
+			if err := record.UnmarshalBinary(append([]byte{}, r.payload...)); err != nil {
+				return nil, r.corruption(r.recordOffset, err)
+			}
+			return &record, nil
+		}
+	}
+}
+
+func (r *Reader) readBlock() error {
+	r.blockOffset += int64(len(r.block))
+	n, err := io.ReadFull(r.file, r.buf)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		r.last = true
+	case err != nil:
+		return err
+	}
+	r.block, r.pos = r.buf[:n], 0
+	return nil
+}
+
+/*
+- Looks past a bad fragment which ends at 'from' within the block, returns true if nothing but zeros follows it
+- Otherwise the reader moves on to the next block holding anything, since lengths within this block can't be trusted anymore
+*/
+func (r *Reader) skipDamage(from int) (bool, error) {
+	blockOffset := r.blockOffset
+	atEnd, err := r.zerosToEnd(from)
+	if err != nil || atEnd {
+		return atEnd, err
+	}
+	if r.blockOffset == blockOffset {
+		r.pos = len(r.block)
+	}
+	r.inRecord = false
+	return false, nil
+}
+
+/* Reads ahead as long as the log holds nothing but zeros, stopping at the first block holding anything else */
+func (r *Reader) zerosToEnd(from int) (bool, error) {
+	if !isZeros(r.block[from:]) {
+		return false, nil
+	}
+	for !r.last {
+		if err := r.readBlock(); err != nil {
+			return false, err
+		}
+		if !isZeros(r.block) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+/* Ends the log, a record whose last fragment is missing was being written when the log was cut short */
+func (r *Reader) finish(err error) error {
+	r.done = true
+	if err == nil && r.inRecord {
+		err = r.corruption(r.recordOffset, ErrTornWrite)
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	return err
+}
+
+func (r *Reader) corruption(offset int64, err error) error {
+	return &ErrCorruption{File: r.filename, Offset: offset, Err: err}
+}
+
+func isZeros(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
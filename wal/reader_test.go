@@ -0,0 +1,67 @@
+package wal
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader(t *testing.T) {
+	/* k2 starts in the first block and ends in the second */
+	records := []LogRecord{
+		{key: []byte("k0"), val: []byte("v0"), op: PUT, seq: 0},
+		{key: []byte("k1"), val: []byte("v1"), op: PUT, seq: 1},
+		{key: []byte("k2"), val: bytes.Repeat([]byte("v"), BLOCKSIZE), op: PUT, seq: 2},
+		{key: []byte("k3"), val: []byte("v3"), op: PUT, seq: 3},
+	}
+	buf := &BytesBufferSeekCloser{}
+	log := &WAL{file: buf}
+	for _, record := range records {
+		require.NoError(t, log.Append(record.key, record.val, record.op, record.seq))
+	}
+	data := buf.Bytes()
+	recordLen := HEADERSIZE + MINIMUMRECORDSIZE + 4
+
+	newReader := func(data []byte) *Reader {
+		reader, err := (&WAL{file: &BytesBufferSeekCloser{Buffer: *bytes.NewBuffer(append([]byte{}, data...))}, filename: "test.log"}).NewReader()
+		require.NoError(t, err)
+		return reader
+	}
+	/* Each step expects either a record or an error */
+	type step struct {
+		record *LogRecord
+		err    error
+	}
+	check := func(reader *Reader, steps []step) {
+		for i, s := range steps {
+			record, err := reader.Next()
+			if s.err != nil {
+				require.ErrorIs(t, err, s.err, "step %d", i)
+				continue
+			}
+			require.NoError(t, err, "step %d", i)
+			require.Equal(t, s.record, record, "step %d", i)
+		}
+	}
+
+	check(newReader(data), []step{{record: &records[0]}, {record: &records[1]}, {record: &records[2]}, {record: &records[3]}, {err: io.EOF}, {err: io.EOF}})
+
+	/* A bad checksum skips the rest of its block (which holds the start of k2), the rest of k2 is then out of place and reading picks up again at k3 */
+	corrupt := append([]byte{}, data...)
+	corrupt[recordLen+HEADERSIZE+1] ^= 1
+	reader := newReader(corrupt)
+	check(reader, []step{{record: &records[0]}, {err: ErrChecksumMismatch}, {err: ErrBadFragment}, {record: &records[3]}, {err: io.EOF}})
+
+	/* A torn tail is reported as such once, along with where it is */
+	reader = newReader(data[:len(data)-1])
+	check(reader, []step{{record: &records[0]}, {record: &records[1]}, {record: &records[2]}})
+	_, err := reader.Next()
+	require.ErrorIs(t, err, ErrTornWrite)
+	corruption := &ErrCorruption{}
+	require.ErrorAs(t, err, &corruption)
+	require.Equal(t, "test.log", corruption.File)
+	require.Equal(t, int64(len(data)-recordLen), corruption.Offset)
+	check(reader, []step{{err: io.EOF}})
+}
@@ -3,8 +3,26 @@ package wal
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"sync"
+
+	"github.com/chettriyuvraj/leveldb-clone/common"
+)
+
+const (
+	BLOCKSIZE  = 32 * 1024 /* In bytes, a fragment never crosses a block boundary */
+	HEADERSIZE = 7         /* Checksum(4 bytes) + length(2 bytes) + fragment type(1 byte) */
+)
+
+/* Fragment types, a record which doesn't fit in what is left of a block is split into a FIRST, any number of MIDDLE and a LAST fragment */
+const (
+	ZEROTYPE = byte(iota) /* Never written, a header of zeros is what a preallocated or partially synced file leaves behind */
+	FULLTYPE
+	FIRSTTYPE
+	MIDDLETYPE
+	LASTTYPE
 )
 
 type ReadWriteSeekCloser interface {
@@ -12,13 +30,41 @@ type ReadWriteSeekCloser interface {
 	io.Closer
 }
 
+/*
+- Append must not be called concurrently with itself, Sync may be called concurrently with Append and Close
+- Nothing is synced to disk unless Sync is called, except when the log is closed
+*/
 type WAL struct {
-	file     ReadWriteSeekCloser
-	filename string
+	file        ReadWriteSeekCloser
+	filename    string
+	blockOffset int        /* Offset of the writer within the current block */
+	mu          sync.Mutex /* Keeps Sync from using the file while it is being closed */
+	closed      bool
 }
 
 var ErrNoUnderlyingFileForLog = errors.New("log does not have any underlying file")
+var ErrChecksumMismatch = errors.New("log fragment checksum mismatch")
+var ErrBadFragment = errors.New("bad log fragment")
+
+/*
+- A record or fragment of the log is not what was written
+- Err says what was wrong, errors.Is sees through to it - it is ErrTornWrite if the damage is at the tail of the log and is explained by a write cut short by a crash
+*/
+type ErrCorruption struct {
+	File   string
+	Offset int64 /* Offset of the bad fragment, or of the first fragment of the bad record */
+	Err    error
+}
+
+func (e *ErrCorruption) Error() string {
+	return fmt.Sprintf("corruption in log %q at offset %d: %v", e.File, e.Offset, e.Err)
+}
+
+func (e *ErrCorruption) Unwrap() error {
+	return e.Err
+}
 
+/* Logs are written from the start of the file, so a log must be opened on a new file to be appended to */
 func Open(filename string) (*WAL, error) {
 	log := WAL{filename: filename}
 
@@ -31,12 +77,12 @@ func Open(filename string) (*WAL, error) {
 	return &log, nil
 }
 
-func (log *WAL) Append(k, v []byte, op byte) error {
+func (log *WAL) Append(k, v []byte, op byte, seq uint64) error {
 	if log.file == nil {
 		return ErrNoUnderlyingFileForLog
 	}
 
-	record, err := NewLogRecord(k, v, op)
+	record, err := NewLogRecord(k, v, op, seq)
 	if err != nil {
 		return err
 	}
@@ -55,6 +101,9 @@ func (log *WAL) Append(k, v []byte, op byte) error {
 }
 
 /*
+- Writes b as a single record, split into fragments so that no fragment crosses a block boundary
+- A block with less than HEADERSIZE bytes left is padded with zeros, the next fragment starts in the next block
+- All fragments go out in a single write to the file
 - Don't use by itself, use only through Append() function
 */
 func (log *WAL) Write(b []byte) (n int, err error) {
@@ -62,84 +111,73 @@ func (log *WAL) Write(b []byte) (n int, err error) {
 		return 0, ErrNoUnderlyingFileForLog
 	}
 
-	return log.file.Write(b)
+	/* The offset only moves once the fragments are written, so a failed write doesn't misalign the ones after it */
+	data, first, blockOffset := []byte{}, true, log.blockOffset
+	for rest := b; first || len(rest) > 0; first = false {
+		left := BLOCKSIZE - blockOffset
+		if left < HEADERSIZE {
+			data = append(data, make([]byte, left)...)
+			blockOffset, left = 0, BLOCKSIZE
+		}
+
+		fragmentLen := left - HEADERSIZE
+		if fragmentLen > len(rest) {
+			fragmentLen = len(rest)
+		}
+		last := fragmentLen == len(rest)
+		fragmentType := MIDDLETYPE
+		switch {
+		case first && last:
+			fragmentType = FULLTYPE
+		case first:
+			fragmentType = FIRSTTYPE
+		case last:
+			fragmentType = LASTTYPE
+		}
+
+		data = appendFragment(data, fragmentType, rest[:fragmentLen])
+		blockOffset += HEADERSIZE + fragmentLen
+		rest = rest[fragmentLen:]
+	}
+
+	if _, err := log.file.Write(data); err != nil {
+		return 0, err
+	}
+	log.blockOffset = blockOffset
+	return len(b), nil
+}
+
+/* Format: [checksum of type + payload(4 bytes):payload length(2 bytes):type(1 byte):payload] */
+func appendFragment(data []byte, fragmentType byte, payload []byte) []byte {
+	data = binary.BigEndian.AppendUint32(data, common.MaskedCRC([]byte{fragmentType}, payload))
+	data = binary.BigEndian.AppendUint16(data, uint16(len(payload)))
+	data = append(data, fragmentType)
+	return append(data, payload...)
 }
 
+/*
+- Reads every record from the current offset of the file to its end
+- A damaged fragment or incomplete record at the tail of the log is what a crash in the middle of a write leaves behind, it is dropped and the records before it are returned without an error
+- Damage anywhere else is returned as ErrCorruption along with the records before it
+- Holds every record in memory, use a Reader to go through them one at a time
+*/
 func (log *WAL) Replay() ([]LogRecord, error) {
-	if log.file == nil {
-		return nil, ErrNoUnderlyingFileForLog
+	reader, err := log.NewReader()
+	if err != nil {
+		return nil, err
 	}
 
 	records := []LogRecord{}
 	for {
-		record := LogRecord{}
-		bytesRead := 0
-
-		/* Read op */
-		op := make([]byte, 1)
-		if _, err := log.file.Read(op); err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
-			return records, err
-		}
-		if _, exists := opmap[op[0]]; !exists {
-			return records, ErrOpDoesNotExist
-		}
-		record.op = op[0]
-		bytesRead += 1
-
-		/* Read key len */
-		kLen := make([]byte, 4)
-		if _, err := log.file.Read(kLen); err != nil {
-			if errors.Is(err, io.EOF) {
-				return records, ErrNoKeyLength
-			}
-			return records, err
-		}
-		bytesRead += 4
-
-		/* Read key */
-		key := make([]byte, binary.BigEndian.Uint32(kLen))
-		if _, err := log.file.Read(key); err != nil {
-			if errors.Is(err, io.EOF) {
-				return records, ErrNoKeyData
-			}
-			return records, err
+		record, err := reader.Next()
+		if err == io.EOF || errors.Is(err, ErrTornWrite) {
+			return records, nil
 		}
-		record.key = key
-		bytesRead += int(binary.BigEndian.Uint32(kLen))
-
-		/* Read val len*/
-		vLen := make([]byte, 4)
-		if _, err := log.file.Read(vLen); err != nil {
-			if errors.Is(err, io.EOF) {
-				return records, ErrNoValLength
-			}
+		if err != nil {
 			return records, err
 		}
-		bytesRead += 4
-
-		if binary.BigEndian.Uint32(vLen) == 0 {
-			records = append(records, record)
-			continue
-		}
-
-		/* Read val */
-		val := make([]byte, binary.BigEndian.Uint32(vLen))
-		if _, err := log.file.Read(val); err != nil {
-			if errors.Is(err, io.EOF) {
-				return records, ErrNoValData
-			}
-			return records, err
-		}
-		record.val = val
-		bytesRead += int(binary.BigEndian.Uint32(vLen))
-
-		records = append(records, record)
+		records = append(records, *record)
 	}
-
-	return records, nil
 }
 
 func (log *WAL) Filename() string {
@@ -153,9 +191,40 @@ func (log *WAL) Seek(offset int64, whence int) (int64, error) {
 	return log.file.Seek(offset, whence)
 }
 
+/* Flushes everything appended so far to stable storage, files which can't be synced (e.g. in memory ones) are left as is */
+func (log *WAL) Sync() error {
+	if log.file == nil {
+		return ErrNoUnderlyingFileForLog
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	/* Everything was synced when the log was closed */
+	if log.closed {
+		return nil
+	}
+	return log.sync()
+}
+
+/* Must be called with mu held */
+func (log *WAL) sync() error {
+	if f, ok := log.file.(interface{ Sync() error }); ok {
+		return f.Sync()
+	}
+	return nil
+}
+
+/* Syncs the log before closing it, so a closed log never loses what was appended to it */
 func (log *WAL) Close() error {
 	if log.file == nil {
 		return ErrNoUnderlyingFileForLog
 	}
-	return log.file.Close()
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	if log.closed {
+		return os.ErrClosed
+	}
+	log.closed = true
+	return errors.Join(log.sync(), log.file.Close())
 }
@@ -2,8 +2,13 @@ package wal
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/chettriyuvraj/leveldb-clone/common"
 	"github.com/stretchr/testify/require"
 )
 
@@ -22,9 +27,9 @@ func (b *BytesBufferSeekCloser) Close() error {
 
 func TestAppendAndReplay(t *testing.T) {
 	records := []LogRecord{
-		{key: []byte("k1"), val: nil, op: DELETE},
-		{key: []byte("k2"), val: []byte("v2"), op: PUT},
-		{key: []byte("k3"), val: nil, op: DELETE},
+		{key: []byte("k1"), val: nil, op: DELETE, seq: 1},
+		{key: []byte("k2"), val: []byte("v2"), op: PUT, seq: 2},
+		{key: []byte("k3"), val: nil, op: DELETE, seq: 3},
 	}
 
 	/* Append to log and replay the same data successfully */
@@ -39,7 +44,7 @@ func TestAppendAndReplay(t *testing.T) {
 	for _, tc := range tcs {
 		log := &WAL{file: &BytesBufferSeekCloser{}}
 		for _, record := range tc.records {
-			err := log.Append(record.key, record.val, record.op)
+			err := log.Append(record.key, record.val, record.op, record.seq)
 			require.NoError(t, err)
 		}
 		replayLogs, err := log.Replay()
@@ -48,3 +53,127 @@ func TestAppendAndReplay(t *testing.T) {
 	}
 
 }
+
+func TestFragments(t *testing.T) {
+	/* Records larger than a block are split across blocks, small ones fill up what is left of a block */
+	records := []LogRecord{}
+	for i, size := range []int{10, BLOCKSIZE - 40, 3 * BLOCKSIZE, 0, 100} {
+		val := bytes.Repeat([]byte{byte('a' + i)}, size)
+		records = append(records, LogRecord{key: []byte(fmt.Sprintf("k%d", i)), val: val, op: PUT, seq: uint64(i)})
+	}
+	records[3].val, records[3].op = nil, DELETE
+
+	buf := &BytesBufferSeekCloser{}
+	log := &WAL{file: buf}
+	for _, record := range records {
+		require.NoError(t, log.Append(record.key, record.val, record.op, record.seq))
+	}
+
+	/* Walk the fragments, none of them crosses a block boundary */
+	data := buf.Bytes()
+	types := []byte{}
+	for offset := 0; offset < len(data); {
+		if left := BLOCKSIZE - offset%BLOCKSIZE; left < HEADERSIZE {
+			require.Equal(t, make([]byte, left), data[offset:offset+left])
+			offset += left
+			continue
+		}
+		fragmentLen := int(binary.BigEndian.Uint16(data[offset+4:]))
+		require.LessOrEqual(t, offset%BLOCKSIZE+HEADERSIZE+fragmentLen, BLOCKSIZE)
+		types = append(types, data[offset+6])
+		offset += HEADERSIZE + fragmentLen
+	}
+	require.Equal(t, []byte{FULLTYPE, FIRSTTYPE, LASTTYPE, FIRSTTYPE, MIDDLETYPE, MIDDLETYPE, LASTTYPE, FULLTYPE, FULLTYPE}, types)
+
+	replayLogs, err := log.Replay()
+	require.NoError(t, err)
+	require.Equal(t, records, replayLogs)
+}
+
+func TestReplayTornWrite(t *testing.T) {
+	records := []LogRecord{
+		{key: []byte("k1"), val: []byte("v1"), op: PUT, seq: 1},
+		{key: []byte("k2"), val: bytes.Repeat([]byte("v"), BLOCKSIZE), op: PUT, seq: 2},
+	}
+	buf := &BytesBufferSeekCloser{}
+	log := &WAL{file: buf}
+	for _, record := range records {
+		require.NoError(t, log.Append(record.key, record.val, record.op, record.seq))
+	}
+	data := buf.Bytes()
+	firstLen := HEADERSIZE + MINIMUMRECORDSIZE + 4
+
+	/* Wherever the last record is cut short, it is dropped and the one before it survives */
+	for _, cut := range []int{firstLen + 3, firstLen + HEADERSIZE + 10, BLOCKSIZE + 2, len(data) - 1} {
+		torn := &WAL{file: &BytesBufferSeekCloser{Buffer: *bytes.NewBuffer(append([]byte{}, data[:cut]...))}}
+		replayLogs, err := torn.Replay()
+		require.NoError(t, err)
+		require.Equal(t, records[:1], replayLogs)
+	}
+
+	/* Same if the tail was zero filled or garbled rather than cut */
+	zeroed := append(append([]byte{}, data[:firstLen]...), make([]byte, 100)...)
+	replayLogs, err := (&WAL{file: &BytesBufferSeekCloser{Buffer: *bytes.NewBuffer(zeroed)}}).Replay()
+	require.NoError(t, err)
+	require.Equal(t, records[:1], replayLogs)
+	garbled := append([]byte{}, data...)
+	garbled[len(garbled)-1] ^= 1
+	replayLogs, err = (&WAL{file: &BytesBufferSeekCloser{Buffer: *bytes.NewBuffer(garbled)}}).Replay()
+	require.NoError(t, err)
+	require.Equal(t, records[:1], replayLogs)
+}
+
+func TestReplayCorruption(t *testing.T) {
+	buf := &BytesBufferSeekCloser{}
+	log := &WAL{file: buf, filename: "test.log"}
+	for i := 0; i < 3; i++ {
+		require.NoError(t, log.Append([]byte(fmt.Sprintf("k%d", i)), []byte("val"), PUT, uint64(i)))
+	}
+	data := buf.Bytes()
+	recordLen := len(data) / 3
+
+	/* Damage before the tail is reported with its offset, the records before it are returned */
+	corrupt := append([]byte{}, data...)
+	corrupt[recordLen+HEADERSIZE+1] ^= 1
+	replayLogs, err := (&WAL{file: &BytesBufferSeekCloser{Buffer: *bytes.NewBuffer(corrupt)}, filename: "test.log"}).Replay()
+	corruption := &ErrCorruption{}
+	require.ErrorAs(t, err, &corruption)
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+	require.Equal(t, "test.log", corruption.File)
+	require.Equal(t, int64(recordLen), corruption.Offset)
+	require.Len(t, replayLogs, 1)
+
+	/* A fragment out of place e.g. a LAST without a FIRST */
+	corrupt = append([]byte{}, data...)
+	corrupt[6] = LASTTYPE
+	binary.BigEndian.PutUint32(corrupt, common.MaskedCRC([]byte{LASTTYPE}, corrupt[HEADERSIZE:recordLen]))
+	replayLogs, err = (&WAL{file: &BytesBufferSeekCloser{Buffer: *bytes.NewBuffer(corrupt)}}).Replay()
+	require.ErrorIs(t, err, ErrBadFragment)
+	require.ErrorAs(t, err, &corruption)
+	require.Equal(t, int64(0), corruption.Offset)
+	require.Empty(t, replayLogs)
+}
+
+func TestSync(t *testing.T) {
+	/* Logs over files which can't be synced are left as is */
+	log := &WAL{file: &BytesBufferSeekCloser{}}
+	require.NoError(t, log.Append([]byte("k1"), []byte("v1"), PUT, 1))
+	require.NoError(t, log.Sync())
+
+	/* A real file is synced, and syncing after close is a no-op since closing syncs */
+	filename := filepath.Join(t.TempDir(), "000001.log")
+	log, err := Open(filename)
+	require.NoError(t, err)
+	require.NoError(t, log.Append([]byte("k1"), []byte("v1"), PUT, 1))
+	require.NoError(t, log.Sync())
+	require.NoError(t, log.Close())
+	require.NoError(t, log.Sync())
+	require.ErrorIs(t, log.Close(), os.ErrClosed)
+
+	log, err = Open(filename)
+	require.NoError(t, err)
+	defer log.Close()
+	records, err := log.Replay()
+	require.NoError(t, err)
+	require.Equal(t, []LogRecord{{key: []byte("k1"), val: []byte("v1"), op: PUT, seq: 1}}, records)
+}